@@ -0,0 +1,46 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/zeromicro/go-zero/rest/httpx"
+	"github.com/zxw/ciligo/logging"
+)
+
+type logReq struct {
+	Levels string `form:"levels,optional"` // 例如"info,dht=debug"
+	Trace  string `form:"trace,optional,options=on|off"`
+	Sample int    `form:"sample,optional,range=[0:1000000]"`
+}
+
+type logResp struct {
+	Levels string `json:"levels"`
+	Trace  bool   `json:"trace"`
+}
+
+// logHandler 查看和修改日志级别，trace=on时输出所有包日志
+func (s *Server) logHandler(w http.ResponseWriter, r *http.Request) {
+	var req logReq
+	if err := httpx.Parse(r, &req); err != nil {
+		httpx.Error(w, err)
+		return
+	}
+	if r.Method == http.MethodPost {
+		if req.Levels != "" {
+			if err := logging.SetLevels(req.Levels); err != nil {
+				httpx.Error(w, err)
+				return
+			}
+		}
+		if req.Trace != "" {
+			logging.SetTrace(req.Trace == "on")
+		}
+		if req.Sample > 0 {
+			logging.SetSample(req.Sample)
+		}
+	}
+	httpx.OkJson(w, &logResp{
+		Levels: logging.Levels(),
+		Trace:  logging.Tracing(),
+	})
+}
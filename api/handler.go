@@ -0,0 +1,177 @@
+package api
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zeromicro/go-zero/rest/httpx"
+	"github.com/zxw/ciligo/catalog"
+)
+
+const lookupTimeout = time.Second * 15
+
+var (
+	errNotFound    = errors.New("torrent not found")
+	errBadInfoHash = errors.New("infohash must be 40 hex characters")
+)
+
+type listReq struct {
+	Limit int `form:"limit,default=50,range=[1:500]"`
+}
+
+type searchReq struct {
+	Q     string `form:"q,optional"`
+	Limit int    `form:"limit,default=50,range=[1:500]"`
+}
+
+type infoHashReq struct {
+	InfoHash string `path:"infohash"`
+}
+
+type torrentResp struct {
+	*catalog.Torrent
+	Magnet string            `json:"magnet"`
+	Tree   *catalog.FileNode `json:"tree,omitempty"`
+}
+
+type lookupResp struct {
+	InfoHash string   `json:"infohash"`
+	Peers    []string `json:"peers"`
+	Elapsed  string   `json:"elapsed"`
+}
+
+func (s *Server) searchHandler(w http.ResponseWriter, r *http.Request) {
+	var req searchReq
+	if err := httpx.Parse(r, &req); err != nil {
+		httpx.Error(w, err)
+		return
+	}
+	httpx.OkJson(w, s.catalog.Search(req.Q, req.Limit))
+}
+
+func (s *Server) recentHandler(w http.ResponseWriter, r *http.Request) {
+	var req listReq
+	if err := httpx.Parse(r, &req); err != nil {
+		httpx.Error(w, err)
+		return
+	}
+	httpx.OkJson(w, s.catalog.Recent(req.Limit))
+}
+
+func (s *Server) popularHandler(w http.ResponseWriter, r *http.Request) {
+	var req listReq
+	if err := httpx.Parse(r, &req); err != nil {
+		httpx.Error(w, err)
+		return
+	}
+	httpx.OkJson(w, s.catalog.Popular(req.Limit))
+}
+
+func (s *Server) torrentHandler(w http.ResponseWriter, r *http.Request) {
+	var req infoHashReq
+	if err := httpx.Parse(r, &req); err != nil {
+		httpx.Error(w, err)
+		return
+	}
+	if _, err := decodeInfoHash(req.InfoHash); err != nil {
+		httpx.Error(w, err)
+		return
+	}
+	t, ok := s.catalog.Get(req.InfoHash)
+	if !ok {
+		httpx.WriteJson(w, http.StatusNotFound, errorResp(errNotFound))
+		return
+	}
+	resp := &torrentResp{
+		Torrent: t,
+		Magnet:  t.MagnetLink(),
+	}
+	if len(t.Files) > 0 {
+		resp.Tree = t.Tree()
+	}
+	httpx.OkJson(w, resp)
+}
+
+// lookupHandler 实时向dht网络发起get_peers查询
+func (s *Server) lookupHandler(w http.ResponseWriter, r *http.Request) {
+	var req infoHashReq
+	if err := httpx.Parse(r, &req); err != nil {
+		httpx.Error(w, err)
+		return
+	}
+	infoHash, err := decodeInfoHash(req.InfoHash)
+	if err != nil {
+		httpx.Error(w, err)
+		return
+	}
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(r.Context(), lookupTimeout)
+	defer cancel()
+	peers, err := s.client.GetPeers(ctx, infoHash)
+	if err != nil {
+		httpx.WriteJson(w, http.StatusGatewayTimeout, errorResp(err))
+		return
+	}
+	resp := &lookupResp{
+		InfoHash: strings.ToLower(req.InfoHash),
+		Peers:    make([]string, 0, len(peers)),
+		Elapsed:  time.Since(start).String(),
+	}
+	for _, peer := range peers {
+		resp.Peers = append(resp.Peers, peer.String())
+	}
+	httpx.OkJson(w, resp)
+}
+
+type bootstrapResp struct {
+	Host         string    `json:"host"`
+	Addrs        []string  `json:"addrs"`
+	Rounds       int       `json:"rounds"`
+	Responses    int       `json:"responses"`
+	Failures     int       `json:"failures"`
+	LastSent     time.Time `json:"last_sent"`
+	LastResponse time.Time `json:"last_response"`
+	Err          string    `json:"error,omitempty"`
+}
+
+// bootstrapHandler 启动节点的健康状况
+func (s *Server) bootstrapHandler(w http.ResponseWriter, r *http.Request) {
+	hosts := s.client.BootstrapStatus()
+	resp := make([]*bootstrapResp, 0, len(hosts))
+	for _, h := range hosts {
+		item := &bootstrapResp{
+			Host:         h.Host,
+			Addrs:        make([]string, 0, len(h.Addrs)),
+			Rounds:       h.Rounds,
+			Responses:    h.Responses,
+			Failures:     h.Failures,
+			LastSent:     h.LastSent,
+			LastResponse: h.LastResponse,
+			Err:          h.Err,
+		}
+		for _, addr := range h.Addrs {
+			item.Addrs = append(item.Addrs, addr.String())
+		}
+		resp = append(resp, item)
+	}
+	httpx.OkJson(w, map[string]interface{}{
+		"nodes":     s.client.NodeCount(),
+		"bootstrap": resp,
+	})
+}
+
+func decodeInfoHash(s string) (string, error) {
+	data, err := hex.DecodeString(s)
+	if err != nil || len(data) != 20 {
+		return "", errBadInfoHash
+	}
+	return string(data), nil
+}
+
+func errorResp(err error) map[string]string {
+	return map[string]string{"error": err.Error()}
+}
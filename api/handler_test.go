@@ -0,0 +1,123 @@
+package api
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/zeromicro/go-zero/rest/pathvar"
+	"github.com/zxw/ciligo/catalog"
+	"github.com/zxw/ciligo/dht"
+)
+
+func TestMain(m *testing.M) {
+	dht.RemoteIPProbe = nil
+	os.Exit(m.Run())
+}
+
+// get 直接调用处理函数，vars是路由里的路径参数
+func get(handler http.HandlerFunc, target string, vars map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	if vars != nil {
+		r = pathvar.WithVars(r, vars)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestCatalogHandlers(t *testing.T) {
+	cat := catalog.New()
+	cat.SetMetadata(strings.Repeat("a", 20), "Ubuntu", []catalog.File{{Path: []string{"ubuntu.iso"}, Length: 10}})
+	cat.SetMetadata(strings.Repeat("b", 20), "Debian", nil)
+	s := &Server{catalog: cat}
+
+	w := get(s.searchHandler, "/search?q=ubuntu", nil)
+	var torrents []*catalog.Torrent
+	if err := json.Unmarshal(w.Body.Bytes(), &torrents); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("search code = %v, err = %v", w.Code, err)
+	}
+	if len(torrents) != 1 || torrents[0].Name != "Ubuntu" {
+		t.Fatalf("search = %s", w.Body.String())
+	}
+
+	hexHash := strings.Repeat("61", 20)
+	w = get(s.torrentHandler, "/torrent/"+hexHash, map[string]string{"infohash": hexHash})
+	var resp torrentResp
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("torrent code = %v, err = %v", w.Code, err)
+	}
+	if resp.Magnet != "magnet:?xt=urn:btih:"+hexHash+"&dn=Ubuntu" || resp.Tree == nil || resp.Tree.Length != 10 {
+		t.Fatalf("torrent = %s", w.Body.String())
+	}
+	if w := get(s.torrentHandler, "/torrent/xyz", map[string]string{"infohash": "xyz"}); w.Code != http.StatusBadRequest {
+		t.Fatalf("bad infohash code = %v", w.Code)
+	}
+	unknown := strings.Repeat("63", 20)
+	if w := get(s.torrentHandler, "/torrent/"+unknown, map[string]string{"infohash": unknown}); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown infohash code = %v", w.Code)
+	}
+}
+
+func startClient(t *testing.T, bootstrap string) *dht.Client {
+	// id由端口生成，每个节点需要不同的端口
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+	client := dht.NewClient(strconv.Itoa(port), "", "4")
+	client.SetNetworkID("api-test")
+	client.SetBootstrap([]string{bootstrap})
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.PacketConn().Close() })
+	return client
+}
+
+func TestLookupHandler(t *testing.T) {
+	a := startClient(t, "")
+	b := startClient(t, "127.0.0.1:"+strconv.Itoa(a.PacketConn().LocalAddr().(*net.UDPAddr).Port))
+	infoHash := strings.Repeat("l", 20)
+	a.PeerStore().Add(infoHash, &net.TCPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 6881})
+	s := &Server{client: b, catalog: catalog.New()}
+
+	hexHash := strings.Repeat("6c", 20)
+	w := get(s.lookupHandler, "/dht/lookup/"+hexHash, map[string]string{"infohash": hexHash})
+	var resp lookupResp
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("lookup code = %v, err = %v", w.Code, err)
+	}
+	if resp.InfoHash != hexHash || len(resp.Peers) != 1 || resp.Peers[0] != "10.1.2.3:6881" {
+		t.Fatalf("lookup = %s", w.Body.String())
+	}
+	if w := get(s.lookupHandler, "/dht/lookup/zz", map[string]string{"infohash": "zz"}); w.Code != http.StatusBadRequest {
+		t.Fatalf("bad infohash code = %v", w.Code)
+	}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	s := &Server{}
+	// 公开端口上只有只读接口
+	for _, route := range s.publicRoutes() {
+		if route.Method != http.MethodGet || strings.HasPrefix(route.Path, "/admin") {
+			t.Fatalf("%v %v on public server", route.Method, route.Path)
+		}
+	}
+	admin := make(map[string]bool)
+	for _, route := range s.adminRoutes() {
+		admin[route.Method+" "+route.Path] = true
+	}
+	for _, want := range []string{"POST /watch/:infohash", "DELETE /watch/:infohash", "POST /admin/log"} {
+		if !admin[want] {
+			t.Fatalf("%v missing from admin server", want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/zeromicro/go-zero/rest"
+	"github.com/zxw/ciligo/catalog"
+	"github.com/zxw/ciligo/dht"
+	"github.com/zxw/ciligo/watchlist"
+)
+
+// Server 对外提供种子搜索、浏览和实时查询的http接口。
+// 修改运行状态的接口(日志级别、增删关注)由NewAdminServer单独监听，不放在公开的端口上
+type Server struct {
+	client  *dht.Client
+	catalog *catalog.Catalog
+	watches *watchlist.Watchlist
+	server  *rest.Server
+}
+
+func NewServer(c rest.RestConf, client *dht.Client, cat *catalog.Catalog, wl *watchlist.Watchlist) (*Server, error) {
+	s, err := newServer(c, client, cat, wl)
+	if err != nil {
+		return nil, err
+	}
+	s.server.AddRoutes(s.publicRoutes())
+	return s, nil
+}
+
+// NewAdminServer 管理接口，一般只监听127.0.0.1
+func NewAdminServer(c rest.RestConf, client *dht.Client, cat *catalog.Catalog, wl *watchlist.Watchlist) (*Server, error) {
+	s, err := newServer(c, client, cat, wl)
+	if err != nil {
+		return nil, err
+	}
+	s.server.AddRoutes(s.adminRoutes())
+	return s, nil
+}
+
+func newServer(c rest.RestConf, client *dht.Client, cat *catalog.Catalog, wl *watchlist.Watchlist) (*Server, error) {
+	server, err := rest.NewServer(c)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		client:  client,
+		catalog: cat,
+		watches: wl,
+		server:  server,
+	}, nil
+}
+
+// publicRoutes 只读接口
+func (s *Server) publicRoutes() []rest.Route {
+	return []rest.Route{
+		{Method: http.MethodGet, Path: "/search", Handler: s.searchHandler},
+		{Method: http.MethodGet, Path: "/torrent/:infohash", Handler: s.torrentHandler},
+		{Method: http.MethodGet, Path: "/recent", Handler: s.recentHandler},
+		{Method: http.MethodGet, Path: "/popular", Handler: s.popularHandler},
+		{Method: http.MethodGet, Path: "/dht/lookup/:infohash", Handler: s.lookupHandler},
+		{Method: http.MethodGet, Path: "/dht/bootstrap", Handler: s.bootstrapHandler},
+		{Method: http.MethodGet, Path: "/watch", Handler: s.watchListHandler},
+		{Method: http.MethodGet, Path: "/watch/:infohash", Handler: s.watchGetHandler},
+		{Method: http.MethodGet, Path: "/", Handler: s.indexPage},
+		{Method: http.MethodGet, Path: "/ui/search", Handler: s.searchPage},
+		{Method: http.MethodGet, Path: "/ui/torrent/:infohash", Handler: s.torrentPage},
+	}
+}
+
+func (s *Server) adminRoutes() []rest.Route {
+	return []rest.Route{
+		{Method: http.MethodGet, Path: "/watch", Handler: s.watchListHandler},
+		{Method: http.MethodGet, Path: "/watch/:infohash", Handler: s.watchGetHandler},
+		{Method: http.MethodPost, Path: "/watch/:infohash", Handler: s.watchAddHandler},
+		{Method: http.MethodDelete, Path: "/watch/:infohash", Handler: s.watchRemoveHandler},
+		{Method: http.MethodGet, Path: "/admin/log", Handler: s.logHandler},
+		{Method: http.MethodPost, Path: "/admin/log", Handler: s.logHandler},
+	}
+}
+
+// Handle 挂载其他模块的处理函数，例如/metrics，需在Start之前调用
+func (s *Server) Handle(method, path string, handler http.Handler) {
+	s.server.AddRoute(rest.Route{Method: method, Path: path, Handler: handler.ServeHTTP})
+}
+
+func (s *Server) Start() {
+	s.server.Start()
+}
+
+func (s *Server) Stop() {
+	s.server.Stop()
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/zeromicro/go-zero/rest/httpx"
+)
+
+var errNoWatchlist = errors.New("watchlist disabled")
+
+type watchAddReq struct {
+	InfoHash string `path:"infohash"`
+	Label    string `form:"label,optional"`
+}
+
+// watchListHandler 所有关注的infohash的当前状态
+func (s *Server) watchListHandler(w http.ResponseWriter, r *http.Request) {
+	if s.watches == nil {
+		httpx.WriteJson(w, http.StatusNotFound, errorResp(errNoWatchlist))
+		return
+	}
+	httpx.OkJson(w, s.watches.List())
+}
+
+// watchGetHandler 一个关注的infohash，带历史记录
+func (s *Server) watchGetHandler(w http.ResponseWriter, r *http.Request) {
+	var req infoHashReq
+	if err := httpx.Parse(r, &req); err != nil {
+		httpx.Error(w, err)
+		return
+	}
+	if s.watches == nil {
+		httpx.WriteJson(w, http.StatusNotFound, errorResp(errNoWatchlist))
+		return
+	}
+	item, ok := s.watches.Get(req.InfoHash)
+	if !ok {
+		httpx.WriteJson(w, http.StatusNotFound, errorResp(errNotFound))
+		return
+	}
+	httpx.OkJson(w, item)
+}
+
+func (s *Server) watchAddHandler(w http.ResponseWriter, r *http.Request) {
+	var req watchAddReq
+	if err := httpx.Parse(r, &req); err != nil {
+		httpx.Error(w, err)
+		return
+	}
+	if s.watches == nil {
+		httpx.WriteJson(w, http.StatusNotFound, errorResp(errNoWatchlist))
+		return
+	}
+	infoHash, err := decodeInfoHash(req.InfoHash)
+	if err != nil {
+		httpx.Error(w, err)
+		return
+	}
+	if err := s.watches.Add(infoHash, req.Label); err != nil {
+		httpx.Error(w, err)
+		return
+	}
+	item, _ := s.watches.Get(req.InfoHash)
+	httpx.OkJson(w, item)
+}
+
+func (s *Server) watchRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	var req infoHashReq
+	if err := httpx.Parse(r, &req); err != nil {
+		httpx.Error(w, err)
+		return
+	}
+	if s.watches == nil {
+		httpx.WriteJson(w, http.StatusNotFound, errorResp(errNoWatchlist))
+		return
+	}
+	infoHash, err := decodeInfoHash(req.InfoHash)
+	if err != nil {
+		httpx.Error(w, err)
+		return
+	}
+	if err := s.watches.Remove(infoHash); err != nil {
+		httpx.Error(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"net/http"
+
+	"github.com/zeromicro/go-zero/core/logx"
+	"github.com/zeromicro/go-zero/rest/httpx"
+	"github.com/zxw/ciligo/catalog"
+)
+
+// 页面模板打包进二进制，不依赖外部CDN和js框架，内网可离线使用
+//
+//go:embed templates/*.html
+var templateFS embed.FS
+
+var pages = map[string]*template.Template{}
+
+func init() {
+	funcs := template.FuncMap{
+		"size": humanSize,
+	}
+	for _, name := range []string{"index.html", "search.html", "torrent.html"} {
+		pages[name] = template.Must(template.New(name).Funcs(funcs).
+			ParseFS(templateFS, "templates/layout.html", "templates/"+name))
+	}
+}
+
+type pageData struct {
+	Title   string
+	Query   string
+	Recent  []*catalog.Torrent
+	Popular []*catalog.Torrent
+	Results []*catalog.Torrent
+	Torrent *catalog.Torrent
+	Tree    *catalog.FileNode
+}
+
+func (s *Server) indexPage(w http.ResponseWriter, r *http.Request) {
+	render(w, "index.html", &pageData{
+		Recent:  s.catalog.Recent(20),
+		Popular: s.catalog.Popular(20),
+	})
+}
+
+func (s *Server) searchPage(w http.ResponseWriter, r *http.Request) {
+	var req searchReq
+	if err := httpx.Parse(r, &req); err != nil {
+		httpx.Error(w, err)
+		return
+	}
+	render(w, "search.html", &pageData{
+		Title:   req.Q,
+		Query:   req.Q,
+		Results: s.catalog.Search(req.Q, req.Limit),
+	})
+}
+
+func (s *Server) torrentPage(w http.ResponseWriter, r *http.Request) {
+	var req infoHashReq
+	if err := httpx.Parse(r, &req); err != nil {
+		httpx.Error(w, err)
+		return
+	}
+	t, ok := s.catalog.Get(req.InfoHash)
+	if !ok {
+		http.Error(w, errNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	data := &pageData{
+		Title:   t.InfoHash,
+		Torrent: t,
+	}
+	if t.Name != "" {
+		data.Title = t.Name
+	}
+	if len(t.Files) > 0 {
+		data.Tree = t.Tree()
+	}
+	render(w, "torrent.html", data)
+}
+
+// 先渲染到buffer，模板出错时不会输出半个页面
+func render(w http.ResponseWriter, name string, data *pageData) {
+	var buf bytes.Buffer
+	if err := pages[name].Execute(&buf, data); err != nil {
+		logx.Errorf("render %v err:%v", name, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
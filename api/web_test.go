@@ -0,0 +1,53 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/zxw/ciligo/catalog"
+)
+
+func TestPages(t *testing.T) {
+	cat := catalog.New()
+	cat.SetMetadata(strings.Repeat("a", 20), "Ubuntu", []catalog.File{{Path: []string{"iso", "ubuntu.iso"}, Length: 2048}})
+	cat.Touch(strings.Repeat("b", 20), "")
+	s := &Server{catalog: cat}
+
+	w := get(s.indexPage, "/ui", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Ubuntu") ||
+		!strings.Contains(w.Body.String(), strings.Repeat("62", 20)) {
+		t.Fatalf("index code = %v, body = %s", w.Code, w.Body.String())
+	}
+
+	w = get(s.searchPage, "/ui/search?q=ubuntu", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `1 results for "ubuntu"`) {
+		t.Fatalf("search code = %v, body = %s", w.Code, w.Body.String())
+	}
+	// 没有q时显示空结果而不是400
+	w = get(s.searchPage, "/ui/search", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `0 results for ""`) {
+		t.Fatalf("empty search code = %v, body = %s", w.Code, w.Body.String())
+	}
+
+	hexHash := strings.Repeat("61", 20)
+	w = get(s.torrentPage, "/ui/torrent/"+hexHash, map[string]string{"infohash": hexHash})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "ubuntu.iso") ||
+		!strings.Contains(w.Body.String(), "2.0 KiB") {
+		t.Fatalf("torrent code = %v, body = %s", w.Code, w.Body.String())
+	}
+	unknown := strings.Repeat("63", 20)
+	if w := get(s.torrentPage, "/ui/torrent/"+unknown, map[string]string{"infohash": unknown}); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown torrent code = %v", w.Code)
+	}
+}
+
+func TestSearchWithoutQuery(t *testing.T) {
+	s := &Server{catalog: catalog.New()}
+	w := get(s.searchHandler, "/search", nil)
+	var torrents []*catalog.Torrent
+	if err := json.Unmarshal(w.Body.Bytes(), &torrents); err != nil || w.Code != http.StatusOK || len(torrents) != 0 {
+		t.Fatalf("search code = %v, body = %s", w.Code, w.Body.String())
+	}
+}
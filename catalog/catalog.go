@@ -0,0 +1,222 @@
+package catalog
+
+import (
+	"container/list"
+	"encoding/hex"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 每个种子最多记录的peer数，只用于统计
+	maxPeers = 1000
+	// DefaultMaxTorrents 默认最多保存的种子数，超过后淘汰最久没有出现的
+	DefaultMaxTorrents = 100000
+)
+
+type File struct {
+	Path   []string `json:"path"`
+	Length int64    `json:"length"`
+}
+
+// Torrent 收集到的infohash及其元数据，Name为空表示还没拿到元数据
+type Torrent struct {
+	InfoHash  string    `json:"infohash"` // hex
+	Name      string    `json:"name,omitempty"`
+	Length    int64     `json:"length"`
+	Files     []File    `json:"files,omitempty"`
+	Hits      int       `json:"hits"`  // get_peers、announce_peer的次数
+	Peers     int       `json:"peers"` // announce过的不同peer数
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	peers     map[string]bool
+	elem      *list.Element
+}
+
+type Catalog struct {
+	mutex       sync.RWMutex
+	torrents    map[string]*Torrent
+	lru         *list.List // 最近出现或保存元数据的在前面
+	maxTorrents int
+}
+
+func New() *Catalog {
+	return &Catalog{
+		torrents:    make(map[string]*Torrent),
+		lru:         list.New(),
+		maxTorrents: DefaultMaxTorrents,
+	}
+}
+
+// SetMaxTorrents 设置最多保存的种子数，n<=0表示不限制，超出的立即淘汰
+func (c *Catalog) SetMaxTorrents(n int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.maxTorrents = n
+	c.evict()
+}
+
+// get 取出或新建key对应的种子并移到最前面，调用者持有锁
+func (c *Catalog) get(key string, now time.Time) *Torrent {
+	t := c.torrents[key]
+	if t != nil {
+		c.lru.MoveToFront(t.elem)
+		return t
+	}
+	t = &Torrent{
+		InfoHash:  key,
+		FirstSeen: now,
+		LastSeen:  now,
+		peers:     make(map[string]bool),
+	}
+	t.elem = c.lru.PushFront(t)
+	c.torrents[key] = t
+	c.evict()
+	return t
+}
+
+// evict 淘汰最久没有出现的种子直到不超过上限，调用者持有锁
+func (c *Catalog) evict() {
+	for c.maxTorrents > 0 && len(c.torrents) > c.maxTorrents {
+		t := c.lru.Remove(c.lru.Back()).(*Torrent)
+		delete(c.torrents, t.InfoHash)
+	}
+}
+
+// Touch 记录一次infohash的出现，peer为空表示get_peers
+func (c *Catalog) Touch(infoHash string, peer string) {
+	key := hex.EncodeToString([]byte(infoHash))
+	now := time.Now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t := c.get(key, now)
+	t.Hits++
+	t.LastSeen = now
+	if peer != "" && !t.peers[peer] && len(t.peers) < maxPeers {
+		t.peers[peer] = true
+		t.Peers = len(t.peers)
+	}
+}
+
+// SetMetadata 保存解析后的元数据
+func (c *Catalog) SetMetadata(infoHash string, name string, files []File) {
+	key := hex.EncodeToString([]byte(infoHash))
+	now := time.Now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t := c.get(key, now)
+	t.Name = name
+	t.Files = files
+	t.Length = 0
+	for _, f := range files {
+		t.Length += f.Length
+	}
+}
+
+// Get 按hex格式的infohash查询，返回副本
+func (c *Catalog) Get(hexHash string) (*Torrent, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	t, ok := c.torrents[strings.ToLower(hexHash)]
+	if !ok {
+		return nil, false
+	}
+	return t.copy(), true
+}
+
+// HasMetadata infohash是否已经拿到元数据
+func (c *Catalog) HasMetadata(infoHash string) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	t, ok := c.torrents[hex.EncodeToString([]byte(infoHash))]
+	return ok && t.Name != ""
+}
+
+func (c *Catalog) Len() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return len(c.torrents)
+}
+
+// Search 按名字、文件名或infohash前缀匹配，不区分大小写
+func (c *Catalog) Search(q string, limit int) []*Torrent {
+	q = strings.ToLower(strings.TrimSpace(q))
+	if q == "" {
+		return []*Torrent{}
+	}
+	return c.list(limit, func(t *Torrent) bool {
+		return strings.HasPrefix(t.InfoHash, q) || t.match(q)
+	}, func(a, b *Torrent) bool {
+		return a.Hits > b.Hits
+	})
+}
+
+// Recent 最近出现的种子
+func (c *Catalog) Recent(limit int) []*Torrent {
+	return c.list(limit, nil, func(a, b *Torrent) bool {
+		return a.LastSeen.After(b.LastSeen)
+	})
+}
+
+// Popular 出现次数最多的种子
+func (c *Catalog) Popular(limit int) []*Torrent {
+	return c.list(limit, nil, func(a, b *Torrent) bool {
+		if a.Peers != b.Peers {
+			return a.Peers > b.Peers
+		}
+		return a.Hits > b.Hits
+	})
+}
+
+func (c *Catalog) list(limit int, filter func(*Torrent) bool, less func(a, b *Torrent) bool) []*Torrent {
+	c.mutex.RLock()
+	result := make([]*Torrent, 0)
+	for _, t := range c.torrents {
+		if filter == nil || filter(t) {
+			result = append(result, t)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return less(result[i], result[j])
+	})
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	for i, t := range result {
+		result[i] = t.copy()
+	}
+	c.mutex.RUnlock()
+	return result
+}
+
+func (t *Torrent) match(q string) bool {
+	if strings.Contains(strings.ToLower(t.Name), q) {
+		return true
+	}
+	for _, f := range t.Files {
+		if strings.Contains(strings.ToLower(strings.Join(f.Path, "/")), q) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Torrent) copy() *Torrent {
+	cp := *t
+	cp.peers = nil
+	cp.elem = nil
+	cp.Files = append([]File(nil), t.Files...)
+	return &cp
+}
+
+// MagnetLink 生成磁力链接
+func (t *Torrent) MagnetLink() string {
+	link := "magnet:?xt=urn:btih:" + t.InfoHash
+	if t.Name != "" {
+		link += "&dn=" + url.QueryEscape(t.Name)
+	}
+	return link
+}
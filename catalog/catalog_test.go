@@ -0,0 +1,129 @@
+package catalog
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTouch(t *testing.T) {
+	c := New()
+	a := strings.Repeat("a", 20)
+	c.Touch(a, "")
+	c.Touch(a, "1.2.3.4:6881")
+	c.Touch(a, "1.2.3.4:6881")
+	c.Touch(a, "5.6.7.8:6881")
+	if c.Len() != 1 {
+		t.Fatalf("len = %v", c.Len())
+	}
+	torrent, ok := c.Get(strings.Repeat("61", 20))
+	if !ok || torrent.Hits != 4 || torrent.Peers != 2 || torrent.Name != "" {
+		t.Fatalf("torrent = %+v", torrent)
+	}
+	if c.HasMetadata(a) {
+		t.Fatal("no metadata yet")
+	}
+
+	c.SetMetadata(a, "Ubuntu", []File{{Path: []string{"ubuntu.iso"}, Length: 10}, {Path: []string{"SHA256SUMS"}, Length: 1}})
+	// 没有出现过的infohash也可以直接保存元数据
+	c.SetMetadata(strings.Repeat("b", 20), "debian", nil)
+	torrent, _ = c.Get(strings.Repeat("61", 20))
+	if c.Len() != 2 || !c.HasMetadata(a) || torrent.Length != 11 || torrent.Hits != 4 {
+		t.Fatalf("torrent = %+v", torrent)
+	}
+	// 返回的是副本
+	torrent.Files[0].Length = 100
+	if again, _ := c.Get(strings.Repeat("61", 20)); again.Files[0].Length != 10 {
+		t.Fatal("Get should return a copy")
+	}
+}
+
+func TestMaxTorrents(t *testing.T) {
+	c := New()
+	c.SetMaxTorrents(2)
+	a, b, d := strings.Repeat("a", 20), strings.Repeat("b", 20), strings.Repeat("d", 20)
+	c.Touch(a, "")
+	c.Touch(b, "")
+	// a再次出现，淘汰的是最久没出现的b
+	c.Touch(a, "")
+	c.Touch(d, "")
+	if c.Len() != 2 {
+		t.Fatalf("len = %v", c.Len())
+	}
+	if _, ok := c.Get(strings.Repeat("62", 20)); ok {
+		t.Fatal("least recently seen torrent kept")
+	}
+	if torrent, ok := c.Get(strings.Repeat("61", 20)); !ok || torrent.Hits != 2 {
+		t.Fatalf("torrent = %+v", torrent)
+	}
+
+	// 调小上限立即淘汰
+	c.SetMaxTorrents(1)
+	if _, ok := c.Get(strings.Repeat("64", 20)); c.Len() != 1 || !ok {
+		t.Fatalf("len = %v", c.Len())
+	}
+}
+
+func TestSearchAndPopular(t *testing.T) {
+	c := New()
+	hashes := []string{strings.Repeat("a", 20), strings.Repeat("b", 20), strings.Repeat("c", 20)}
+	c.SetMetadata(hashes[0], "Ubuntu Desktop", nil)
+	c.SetMetadata(hashes[1], "Debian", []File{{Path: []string{"debian", "ubuntu-notes.txt"}, Length: 1}})
+	c.SetMetadata(hashes[2], "Arch", nil)
+	for i := 0; i < 3; i++ {
+		c.Touch(hashes[1], "")
+	}
+	c.Touch(hashes[0], "")
+	c.Touch(hashes[2], "1.1.1.1:1")
+
+	// 名字和文件名都能匹配，按出现次数排序
+	result := c.Search(" UBUNTU ", 10)
+	if len(result) != 2 || result[0].Name != "Debian" || result[1].Name != "Ubuntu Desktop" {
+		t.Fatalf("search = %v", names(result))
+	}
+	if result := c.Search(strings.Repeat("63", 3), 10); len(result) != 1 || result[0].Name != "Arch" {
+		t.Fatalf("prefix search = %v", names(result))
+	}
+	if len(c.Search("", 10)) != 0 || len(c.Search("ubuntu", 1)) != 1 {
+		t.Fatal("unexpected empty query or limit")
+	}
+
+	// peer数优先，其次是出现次数
+	if popular := c.Popular(10); strings.Join(names(popular), ",") != "Arch,Debian,Ubuntu Desktop" {
+		t.Fatalf("popular = %v", names(popular))
+	}
+	if recent := c.Recent(1); len(recent) != 1 || recent[0].Name != "Arch" {
+		t.Fatalf("recent = %v", names(recent))
+	}
+}
+
+func TestTree(t *testing.T) {
+	torrent := &Torrent{
+		Name: "album",
+		Files: []File{
+			{Path: []string{"cover.jpg"}, Length: 5},
+			{Path: []string{"cd2", "02.flac"}, Length: 20},
+			{Path: []string{"cd2", "01.flac"}, Length: 10},
+			{Path: []string{"cd1", "01.flac"}, Length: 30},
+		},
+	}
+	root := torrent.Tree()
+	if root.Name != "album" || root.Length != 65 || len(root.Children) != 3 {
+		t.Fatalf("root = %+v", root)
+	}
+	// 目录在前，同类按名字排序
+	cd1, cd2, cover := root.Children[0], root.Children[1], root.Children[2]
+	if cd1.Name != "cd1" || cd2.Name != "cd2" || cover.Name != "cover.jpg" || len(cover.Children) != 0 {
+		t.Fatalf("children = %v %v %v", cd1.Name, cd2.Name, cover.Name)
+	}
+	if cd2.Length != 30 || len(cd2.Children) != 2 || cd2.Children[0].Name != "01.flac" || cd2.Children[0].Length != 10 {
+		t.Fatalf("cd2 = %+v", cd2)
+	}
+}
+
+func names(torrents []*Torrent) []string {
+	var result []string
+	for _, t := range torrents {
+		result = append(result, t.Name)
+	}
+	return result
+}
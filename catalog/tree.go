@@ -0,0 +1,50 @@
+package catalog
+
+import "sort"
+
+// FileNode 文件树节点，目录的Length是子节点之和
+type FileNode struct {
+	Name     string      `json:"name"`
+	Length   int64       `json:"length"`
+	Children []*FileNode `json:"children,omitempty"`
+}
+
+// Tree 把文件列表转换成以种子名为根的文件树
+func (t *Torrent) Tree() *FileNode {
+	root := &FileNode{Name: t.Name}
+	for _, f := range t.Files {
+		node := root
+		for _, name := range f.Path {
+			node.Length += f.Length
+			node = node.child(name)
+		}
+		node.Length += f.Length
+	}
+	root.sort()
+	return root
+}
+
+func (node *FileNode) child(name string) *FileNode {
+	for _, c := range node.Children {
+		if c.Name == name {
+			return c
+		}
+	}
+	c := &FileNode{Name: name}
+	node.Children = append(node.Children, c)
+	return c
+}
+
+// 目录在前，同类按名字排序
+func (node *FileNode) sort() {
+	sort.Slice(node.Children, func(i, j int) bool {
+		a, b := node.Children[i], node.Children[j]
+		if (len(a.Children) > 0) != (len(b.Children) > 0) {
+			return len(a.Children) > 0
+		}
+		return a.Name < b.Name
+	})
+	for _, c := range node.Children {
+		c.sort()
+	}
+}
@@ -0,0 +1,161 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/zeromicro/go-zero/core/logx"
+	"github.com/zxw/ciligo/logging"
+)
+
+// 把我们自己的资源通告到dht(bep-005)：
+// 先对infohash做get_peers查找，取回复过的最近k个节点给的token，再向它们发announce_peer。
+// token一般5到10分钟失效，所以每次通告都重新查找；Seed加入的infohash定期重新通告
+
+const (
+	announceInterval = time.Minute * 15
+	announceTimeout  = time.Second * 30
+)
+
+var ErrNoAnnounceNodes = errors.New("no node returned a token")
+
+type announceEntry struct {
+	port     int
+	implied  bool
+	next     time.Time
+	running  bool
+	last     time.Time // 上次通告成功的时间
+	accepted int       // 上次通告接受的节点数
+}
+
+type announcer struct {
+	mutex   sync.Mutex
+	entries map[string]*announceEntry
+}
+
+func newAnnouncer() *announcer {
+	return &announcer{
+		entries: make(map[string]*announceEntry),
+	}
+}
+
+// Announce 向离infoHash最近的k个节点通告自己在port上提供下载，impliedPort为true时对方使用udp源端口。
+// 返回接受通告的节点数
+func (client *Client) Announce(ctx context.Context, infoHash string, port int, impliedPort bool) (int, error) {
+	if len(infoHash) != 20 {
+		return 0, ErrInvalidInfoHash
+	}
+	st := client.lookup("get_peers", infoHash)
+	if err := st.wait(ctx); err != nil {
+		return 0, err
+	}
+	var nodes []*NodeInfo
+	tokens := make(map[string]string)
+	for _, reply := range st.closest(lookupK) {
+		if reply.token != "" {
+			nodes = append(nodes, reply.node)
+			tokens[reply.node.addr.String()] = reply.token
+		}
+	}
+	if len(nodes) == 0 {
+		return 0, ErrNoAnnounceNodes
+	}
+	replies := client.queryAll(ctx, nodes, func(node *NodeInfo) *structNested {
+		return client.newAnnouncePeer(infoHash, tokens[node.addr.String()], port, impliedPort)
+	})
+	logger.Infow("announce", logging.InfoHash(infoHash), logx.Field("port", port), logx.Field("nodes", len(nodes)), logx.Field("accepted", len(replies)))
+	return len(replies), nil
+}
+
+// announce_peers Query = {"t":"aa", "y":"q", "q":"announce_peer", "a": {"id":"abcdefghij0123456789", "implied_port": 1, "info_hash":"mnopqrstuvwxyz123456", "port": 6881, "token": "aoeusnth"}}
+func (client *Client) newAnnouncePeer(infoHash string, token string, port int, impliedPort bool) *structNested {
+	msg := &structNested{
+		Y: "q",
+		Q: "announce_peer",
+		A: RequestArg{
+			Id:        client.ID(),
+			Token:     token,
+			Info_hash: infoHash,
+			Port:      uint64(port),
+		},
+	}
+	if impliedPort {
+		msg.A.Implied_port = 1
+	}
+	return msg
+}
+
+// Seed 定期通告infoHash，已在通告的更新端口，在下一次通告时生效
+func (client *Client) Seed(infoHash string, port int, impliedPort bool) error {
+	if len(infoHash) != 20 {
+		return ErrInvalidInfoHash
+	}
+	a := client.announces
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if e := a.entries[infoHash]; e != nil {
+		e.port, e.implied = port, impliedPort
+		return nil
+	}
+	a.entries[infoHash] = &announceEntry{port: port, implied: impliedPort, next: time.Now()}
+	return nil
+}
+
+// Unseed 停止通告infoHash，已通告的由对方在过期后删除
+func (client *Client) Unseed(infoHash string) {
+	a := client.announces
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	delete(a.entries, infoHash)
+}
+
+// due 到期需要通告的infohash，取出的标记为正在通告
+func (a *announcer) due(now time.Time) map[string]announceEntry {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	due := make(map[string]announceEntry)
+	for infoHash, e := range a.entries {
+		if !e.running && !e.next.After(now) {
+			e.running = true
+			due[infoHash] = *e
+		}
+	}
+	return due
+}
+
+// finish 通告失败时一分钟后重试
+func (a *announcer) finish(infoHash string, accepted int, now time.Time) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	e := a.entries[infoHash]
+	if e == nil {
+		return
+	}
+	e.running = false
+	if accepted == 0 {
+		e.next = now.Add(time.Minute)
+		return
+	}
+	e.last, e.accepted = now, accepted
+	e.next = now.Add(announceInterval)
+}
+
+func (client *Client) announceLoop() {
+	a := client.announces
+	ticker := time.NewTicker(time.Second * 5)
+	for now := range ticker.C {
+		for infoHash, e := range a.due(now) {
+			go func(infoHash string, e announceEntry) {
+				ctx, cancel := context.WithTimeout(context.Background(), announceTimeout)
+				accepted, err := client.Announce(ctx, infoHash, e.port, e.implied)
+				cancel()
+				if err != nil {
+					logger.Errorw("announce failed", logging.InfoHash(infoHash), logging.Err(err))
+				}
+				a.finish(infoHash, accepted, time.Now())
+			}(infoHash, e)
+		}
+	}
+}
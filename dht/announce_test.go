@@ -0,0 +1,45 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnnounce(t *testing.T) {
+	a := startTestClient(t, "lab", "")
+	b := startTestClient(t, "lab", "127.0.0.1:"+strings.Split(a.connection.LocalAddr().String(), ":")[1])
+	infoHash := strings.Repeat("s", 20)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+	accepted, err := b.Announce(ctx, infoHash, 0, true)
+	if err != nil || accepted != 1 {
+		t.Fatalf("accepted = %v, err = %v", accepted, err)
+	}
+	// implied_port时记录的是b的udp端口
+	peers := a.PeerStore().Get(infoHash, 10)
+	if len(peers) != 1 || peers[0].Port != b.connection.LocalAddr().(*net.UDPAddr).Port {
+		t.Fatalf("peers = %v", peers)
+	}
+}
+
+func TestAnnounceSchedule(t *testing.T) {
+	a := newAnnouncer()
+	now := time.Now()
+	a.entries["x"] = &announceEntry{port: 6881, next: now}
+	due := a.due(now)
+	if len(due) != 1 || due["x"].port != 6881 || len(a.due(now)) != 0 {
+		t.Fatalf("due = %v", due)
+	}
+	a.finish("x", 0, now)
+	if e := a.entries["x"]; e.running || !e.next.Equal(now.Add(time.Minute)) {
+		t.Fatalf("failed announce should retry soon: %+v", e)
+	}
+	a.due(now.Add(time.Minute))
+	a.finish("x", 3, now)
+	if e := a.entries["x"]; e.accepted != 3 || !e.next.Equal(now.Add(announceInterval)) {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+}
@@ -0,0 +1,362 @@
+package dht
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zeromicro/go-zero/core/logx"
+	"github.com/zxw/ciligo/logging"
+)
+
+const (
+	defaultMinNodes     = 32               // 路由表节点数低于这个值时重新bootstrap
+	bootstrapInterval   = time.Second * 30 // 两次bootstrap的最小间隔
+	maxBootstrapBackoff = time.Minute * 30 // 连续无响应的启动节点最长隔这么久再试
+	resolveInterval     = time.Minute * 30 // 重新解析域名的间隔
+	maxSnapshotNodes    = 256
+)
+
+var (
+	PrimeNodes = []string{
+		"router.bittorrent.com:6881",
+		"router.utorrent.com:6881",
+		"dht.transmissionbt.com:6881",
+	}
+)
+
+// BootstrapHost 一个启动节点的健康状况
+type BootstrapHost struct {
+	Host         string
+	Addrs        []*net.UDPAddr // 域名解析出的所有A/AAAA记录
+	Rounds       int            // 发送find_node的轮数
+	Responses    int
+	Failures     int // 连续无响应的轮数
+	LastSent     time.Time
+	LastResponse time.Time
+	Err          string // 最近一次解析错误
+	// 下次解析的时间，解析失败时按连续失败次数退避
+	nextResolve     time.Time
+	resolveFailures int
+	resolving       bool
+}
+
+type bootstrapper struct {
+	mutex    sync.Mutex
+	hosts    []*BootstrapHost
+	byAddr   map[string]*BootstrapHost // ip:port -> host，用于统计响应
+	minNodes int
+	last     time.Time
+}
+
+func newBootstrapper(hosts []string) *bootstrapper {
+	b := &bootstrapper{
+		byAddr:   make(map[string]*BootstrapHost),
+		minNodes: defaultMinNodes,
+	}
+	b.add(hosts)
+	return b
+}
+
+func (b *bootstrapper) add(hosts []string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, host := range hosts {
+		host = strings.TrimSpace(host)
+		if host == "" || b.find(host) != nil {
+			continue
+		}
+		b.hosts = append(b.hosts, &BootstrapHost{Host: host})
+	}
+}
+
+func (b *bootstrapper) remove(hosts []string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	kept := b.hosts[:0]
+	for _, h := range b.hosts {
+		removed := false
+		for _, host := range hosts {
+			if h.Host == host {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			kept = append(kept, h)
+		}
+	}
+	b.hosts = kept
+}
+
+func (b *bootstrapper) find(host string) *BootstrapHost {
+	for _, h := range b.hosts {
+		if h.Host == host {
+			return h
+		}
+	}
+	return nil
+}
+
+// lookupIP 解析域名，测试时替换
+var lookupIP = net.LookupIP
+
+// resolveHost 解析host:port的所有地址，只保留和dht socket同一地址族的
+func resolveHost(hostPort string, network string) ([]*net.UDPAddr, error) {
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, errors.New("invalid port " + portStr)
+	}
+	ips, err := lookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []*net.UDPAddr
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (network == "udp4") {
+			addrs = append(addrs, &net.UDPAddr{IP: ip, Port: port})
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no " + network + " address")
+	}
+	return addrs, nil
+}
+
+// resolve 解析到期的启动节点。dns可能很慢，解析时不持有锁，避免阻塞收包协程里的onResponse。
+// 成功的resolveInterval后重新解析，失败的按指数退避重试
+func (b *bootstrapper) resolve(network string) {
+	now := time.Now()
+	var due []*BootstrapHost
+	b.mutex.Lock()
+	for _, h := range b.hosts {
+		if !h.resolving && !now.Before(h.nextResolve) {
+			h.resolving = true
+			due = append(due, h)
+		}
+	}
+	b.mutex.Unlock()
+	for _, h := range due {
+		addrs, err := resolveHost(h.Host, network)
+		b.mutex.Lock()
+		h.resolving = false
+		if err != nil {
+			h.Err = err.Error()
+			h.resolveFailures++
+			backoff := bootstrapInterval << uint(h.resolveFailures-1)
+			if backoff > resolveInterval || backoff <= 0 {
+				backoff = resolveInterval
+			}
+			h.nextResolve = time.Now().Add(backoff)
+		} else {
+			h.Addrs = addrs
+			h.Err = ""
+			h.resolveFailures = 0
+			h.nextResolve = time.Now().Add(resolveInterval)
+		}
+		b.mutex.Unlock()
+		if err != nil {
+			logger.Errorw("bootstrap resolve failed", logx.Field("host", h.Host), logging.Err(err))
+		}
+	}
+}
+
+// ready 连续无响应的启动节点按指数退避跳过
+func (h *BootstrapHost) ready(now time.Time) bool {
+	if h.Failures == 0 {
+		return true
+	}
+	backoff := bootstrapInterval << uint(h.Failures)
+	if backoff > maxBootstrapBackoff || backoff <= 0 {
+		backoff = maxBootstrapBackoff
+	}
+	return now.Sub(h.LastSent) >= backoff
+}
+
+// targets 本轮要发送find_node的地址，同时更新各启动节点的状态
+func (b *bootstrapper) targets(network string, force bool) []*net.UDPAddr {
+	b.mutex.Lock()
+	if !force && time.Since(b.last) < bootstrapInterval {
+		b.mutex.Unlock()
+		return nil
+	}
+	b.mutex.Unlock()
+	b.resolve(network)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	b.last = now
+	var addrs []*net.UDPAddr
+	for _, h := range b.hosts {
+		// 上一轮发出后没有收到响应
+		if !h.LastSent.IsZero() && h.LastResponse.Before(h.LastSent) && h.ready(now) {
+			h.Failures++
+		}
+		if !h.ready(now) || len(h.Addrs) == 0 {
+			continue
+		}
+		h.Rounds++
+		h.LastSent = now
+		for _, addr := range h.Addrs {
+			b.byAddr[addr.String()] = h
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// addrs 所有启动节点的地址，不更新状态，用于路由表为空时的查询
+func (b *bootstrapper) addrs(network string) []*net.UDPAddr {
+	b.resolve(network)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var addrs []*net.UDPAddr
+	for _, h := range b.hosts {
+		addrs = append(addrs, h.Addrs...)
+	}
+	return addrs
+}
+
+func (b *bootstrapper) onResponse(addr *net.UDPAddr) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	h := b.byAddr[addr.String()]
+	if h == nil {
+		return
+	}
+	h.Responses++
+	h.Failures = 0
+	h.LastResponse = time.Now()
+}
+
+// SetBootstrap 替换启动节点列表，默认为PrimeNodes或-a指定的地址
+func (client *Client) SetBootstrap(hosts []string) {
+	b := client.bootstrap
+	b.mutex.Lock()
+	b.hosts = nil
+	b.byAddr = make(map[string]*BootstrapHost)
+	b.mutex.Unlock()
+	b.add(hosts)
+}
+
+// AddBootstrap 追加启动节点，格式为host:port
+func (client *Client) AddBootstrap(hosts ...string) {
+	client.bootstrap.add(hosts)
+}
+
+// LoadBootstrapFile 从文件读取启动节点，每行一个host:port，#开头为注释
+func (client *Client) LoadBootstrapFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var hosts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hosts = append(hosts, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	client.AddBootstrap(hosts...)
+	return nil
+}
+
+// SetMinNodes 路由表节点数低于n时重新bootstrap
+func (client *Client) SetMinNodes(n int) {
+	client.bootstrap.mutex.Lock()
+	defer client.bootstrap.mutex.Unlock()
+	client.bootstrap.minNodes = n
+}
+
+// BootstrapStatus 各启动节点的健康状况
+func (client *Client) BootstrapStatus() []BootstrapHost {
+	client.bootstrap.mutex.Lock()
+	defer client.bootstrap.mutex.Unlock()
+	hosts := make([]BootstrapHost, 0, len(client.bootstrap.hosts))
+	for _, h := range client.bootstrap.hosts {
+		hosts = append(hosts, *h)
+	}
+	return hosts
+}
+
+// NodeCount 路由表中的节点数
+func (client *Client) NodeCount() int {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+	total := 0
+	for _, buck := range client.table.buckets {
+		total += len(buck)
+	}
+	return total
+}
+
+// rebootstrap 向启动节点发送find_node，force为false时受最小间隔限制
+func (client *Client) rebootstrap(force bool) {
+	addrs := client.bootstrap.targets(client.network, force)
+	if len(addrs) == 0 {
+		return
+	}
+	logger.Infow("bootstrap", logx.Field("nodes", client.NodeCount()), logx.Field("addrs", len(addrs)))
+	for _, addr := range addrs {
+		client.sendFindNode(client.ID(), addr)
+	}
+}
+
+// SaveSnapshot 把路由表中的节点保存到文件，每行"<hex id> <ip:port>"，重启后作为启动节点
+func (client *Client) SaveSnapshot(path string) error {
+	client.mutex.RLock()
+	var lines []string
+	for _, buck := range client.table.buckets {
+		for _, node := range buck {
+			if len(lines) >= maxSnapshotNodes {
+				break
+			}
+			lines = append(lines, fmt.Sprintf("%x %v", node.ID, node.addr))
+		}
+	}
+	client.mutex.RUnlock()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadSnapshot 读取SaveSnapshot保存的节点，加入启动节点
+func (client *Client) LoadSnapshot(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var hosts []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if id, err := hex.DecodeString(fields[0]); err != nil || len(id) != 20 {
+			continue
+		}
+		hosts = append(hosts, fields[1])
+	}
+	logger.Infow("load snapshot", logx.Field("path", path), logx.Field("nodes", len(hosts)))
+	client.AddBootstrap(hosts...)
+	return nil
+}
@@ -0,0 +1,100 @@
+package dht
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBootstrapHealth(t *testing.T) {
+	b := newBootstrapper([]string{"127.0.0.1:6881", "127.0.0.1:6882", "bad"})
+	addrs := b.targets("udp4", true)
+	if len(addrs) != 2 {
+		t.Fatalf("targets = %v", addrs)
+	}
+	// 间隔内不重复发送
+	if addrs := b.targets("udp4", false); len(addrs) != 0 {
+		t.Fatalf("targets within interval = %v", addrs)
+	}
+	b.onResponse(addrs[0])
+	// 模拟过了一轮，第二个没有响应
+	for _, h := range b.hosts {
+		h.LastSent = h.LastSent.Add(-bootstrapInterval)
+	}
+	b.targets("udp4", true)
+	if b.hosts[0].Failures != 0 || b.hosts[0].Responses != 1 || b.hosts[1].Failures != 1 {
+		t.Fatalf("unexpected health %+v %+v", *b.hosts[0], *b.hosts[1])
+	}
+	if b.hosts[2].Err == "" {
+		t.Fatal("expected error for host without port")
+	}
+	// 失败的节点退避，刚发送过不会再发
+	if b.hosts[1].ready(time.Now()) {
+		t.Fatal("failed host should back off")
+	}
+}
+
+func TestBootstrapResolve(t *testing.T) {
+	lookups := make(chan string, 4)
+	block := make(chan struct{})
+	lookupIP = func(host string) ([]net.IP, error) {
+		lookups <- host
+		<-block
+		return nil, errors.New("dns blocked")
+	}
+	defer func() { lookupIP = net.LookupIP }()
+
+	b := newBootstrapper([]string{"router.example:6881"})
+	done := make(chan []*net.UDPAddr)
+	go func() { done <- b.addrs("udp4") }()
+	<-lookups
+	// 解析时不持有锁，收到回包的统计不受影响
+	responded := make(chan struct{})
+	go func() {
+		b.onResponse(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881})
+		close(responded)
+	}()
+	select {
+	case <-responded:
+	case <-time.After(time.Second):
+		t.Fatal("onResponse blocked by resolve")
+	}
+	close(block)
+	if addrs := <-done; len(addrs) != 0 {
+		t.Fatalf("addrs = %v", addrs)
+	}
+	h := b.hosts[0]
+	if h.Err != "dns blocked" || h.resolveFailures != 1 || !h.nextResolve.After(time.Now()) {
+		t.Fatalf("unexpected host %+v", *h)
+	}
+	// 退避期间不再解析
+	b.addrs("udp4")
+	b.targets("udp4", true)
+	select {
+	case host := <-lookups:
+		t.Fatalf("resolved %v again during backoff", host)
+	default:
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	client := NewClient("0", "", "4")
+	client.SetBootstrap(nil)
+	for i := 1; i <= 3; i++ {
+		id := string(append(make([]byte, 19), byte(i)))
+		client.UpdateRecvTable(&NodeInfo{ID: id, addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 6881}})
+	}
+	path := t.TempDir() + "/nodes.txt"
+	if err := client.SaveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	other := NewClient("0", "", "4")
+	other.SetBootstrap(nil)
+	if err := other.LoadSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	if hosts := other.BootstrapStatus(); len(hosts) != 3 {
+		t.Fatalf("loaded hosts = %+v", hosts)
+	}
+}
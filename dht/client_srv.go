@@ -1,36 +1,72 @@
 package dht
 
 import (
-	"bytes"
+	"encoding/hex"
+	"errors"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	bencode "github.com/jackpal/bencode-go"
 	"github.com/zeromicro/go-zero/core/logx"
+	"github.com/zxw/ciligo/logging"
 )
 
+var logger = logging.Get("dht")
+
 type NodeTable struct {
-	//两个路由表用于异步更新。 一发一收
-	//[distance] map[id][ip+port]
-	recvBuckets   map[int][]*NodeInfo
-	sendBuckets   map[int][]*NodeInfo
-	curSendBucket int
-	//更新发包路由表的时间
-	sendTableTs time.Time
+	//[distance] 节点列表，每个桶最多8个
+	buckets map[int][]*NodeInfo
+	// 桶最近一次变化(加入节点或节点直接联系我们)的时间，超过15分钟没有变化的桶需要刷新
+	touched map[int]time.Time
+}
+
+func newNodeTable() *NodeTable {
+	return &NodeTable{
+		buckets: make(map[int][]*NodeInfo, 160),
+		touched: make(map[int]time.Time, 160),
+	}
 }
+
+// HarvestInfo 从get_peers、announce_peer请求中收集到的infohash
+type HarvestInfo struct {
+	InfoHash string
+	From     *net.UDPAddr
+	Announce bool
+	// announce_peer的下载端口，已按implied_port处理
+	Port int
+	// 请求方的客户端版本(v字段)，可能为空
+	Version string
+}
+
 type Client struct {
 	peerInfo   *NodeInfo // 不作为find_node和get_peer的结果返回
 	connection *net.UDPConn
-	// mutex        sync.RWMutex
+	mutex      sync.RWMutex
 	// disconnected bool
-	port          string
-	network       string
-	want          []string
-	targetAddr    string
-	nodeTables    map[string]*NodeTable
-	updateSeconds int
-	// 测试getpeers
-	infoHashs []string
+	port         string
+	network      string
+	want         []string
+	targetAddr   string
+	table        *NodeTable
+	refreshing   int32 // 正在做桶刷新的查找
+	transactions *transactionTable
+	lookups      *lookupGroup
+	watches      *watcher
+	announces    *announcer
+	bootstrap    *bootstrapper
+	limiter      *sendLimiter
+	guard        *guard
+	health       *nodeHealth
+	stats        *stats
+	// 私有网络标识，非空时只处理带相同标识的消息
+	networkID string
+	peers     *PeerStore
+	tokens    *tokenManager
+	// 收集infohash的回调，类型为func(*HarvestInfo)
+	harvest atomic.Value
+	// 非KRPC包的处理函数，类型为func([]byte, *net.UDPAddr)
+	packetHandler atomic.Value
 }
 
 func NewClient(port string, targetAddr string, ipType string) *Client {
@@ -39,20 +75,17 @@ func NewClient(port string, targetAddr string, ipType string) *Client {
 	ipWant := []string{"n6"}
 	if ipType == "4" {
 		resolve = "udp4"
-		ip, err := getRemoteIP()
-		logx.Infof("remote ip:%v,err:%v", ip, err)
-		logx.Infof("local ip:%+v", getLocalIPs())
+		logger.Infow("local ip", logx.Field("ips", getLocalIPs()))
 		myIP = ":" + port
 		ipWant = []string{"n4"}
 	}
 	myAddr, err := net.ResolveUDPAddr(resolve, myIP)
 	if err != nil {
-		logx.Infof("err:%v", err)
+		logger.Errorw("resolve listen addr failed", logging.Err(err))
 		return nil
 	}
-	logx.Infof("NewClient port=%v,addr=%+v", port, myAddr)
 	id := newId(getMacAddrs()[0] + port)
-	logx.Infof("newId len:%v,newId data:%x", len(id), id)
+	logger.Infow("new client", logging.Addr(myAddr), logx.Field("id", hex.EncodeToString(id)))
 	cli := &Client{
 		// disconnected: false,
 		peerInfo: &NodeInfo{
@@ -64,12 +97,21 @@ func NewClient(port string, targetAddr string, ipType string) *Client {
 		targetAddr:    targetAddr,
 		network:       resolve,
 		want:          ipWant,
-		nodeTables:    make(map[string]*NodeTable),
-		updateSeconds: 8,
+		table:         newNodeTable(),
+		transactions:  newTransactionTable(),
+		lookups:       newLookupGroup(),
+		watches:       newWatcher(),
+		announces:     newAnnouncer(),
+		bootstrap:     newBootstrapper(PrimeNodes),
+		limiter:       newSendLimiter(DefaultRateConfig()),
+		guard:         newGuard(DefaultGuardConfig()),
+		health:        newNodeHealth(),
+		stats:         newStats(),
+		peers:         NewPeerStore(),
+		tokens:        newTokenManager(),
 	}
-	cli.nodeTables[cli.peerInfo.ID] = &NodeTable{
-		recvBuckets: make(map[int][]*NodeInfo, 160),
-		sendBuckets: make(map[int][]*NodeInfo, 160),
+	if targetAddr != "" {
+		cli.bootstrap = newBootstrapper([]string{targetAddr})
 	}
 	return cli
 }
@@ -77,22 +119,95 @@ func (client *Client) ID() string {
 	return client.peerInfo.ID
 }
 
+// SetNetworkID 进入私有网络模式：发出的消息都带上id，不带相同id的消息被忽略，
+// 同时去掉公网的PrimeNodes，需要用-a或SetBootstrap指定私有网络的启动节点。需在Start之前调用
+func (client *Client) SetNetworkID(id string) {
+	client.networkID = id
+	if id != "" {
+		client.bootstrap.remove(PrimeNodes)
+	}
+}
+
+// PeerStore announce_peer通告的peer，用于回复get_peers
+func (client *Client) PeerStore() *PeerStore {
+	return client.peers
+}
+
+// OnHarvest 设置收集到infohash时的回调，在收包协程中调用，不能阻塞
+func (client *Client) OnHarvest(fn func(*HarvestInfo)) {
+	client.harvest.Store(fn)
+}
+
+// OnPacket 设置非KRPC包(如uTP)的处理函数。KRPC包是bencode字典，首字节为'd'，据此分流
+func (client *Client) OnPacket(fn func([]byte, *net.UDPAddr)) {
+	client.packetHandler.Store(fn)
+}
+
+// PacketConn 返回dht使用的udp socket，用于和uTP共用端口，ListenUDP或Start之后才有效
+func (client *Client) PacketConn() net.PacketConn {
+	return client.connection
+}
+
+func (client *Client) notifyHarvest(recvmsg *structNested, addr *net.UDPAddr) {
+	if len(recvmsg.A.Info_hash) != 20 {
+		return
+	}
+	client.stats.harvest(recvmsg.Q == "announce_peer")
+	fn, ok := client.harvest.Load().(func(*HarvestInfo))
+	if !ok {
+		return
+	}
+	info := &HarvestInfo{
+		InfoHash: recvmsg.A.Info_hash,
+		From:     addr,
+		Announce: recvmsg.Q == "announce_peer",
+		Version:  recvmsg.V,
+	}
+	if info.Announce {
+		info.Port = announcePort(recvmsg, addr)
+	}
+	fn(info)
+}
+
+// announcePort implied_port不为0时使用收包的源端口
+func announcePort(recvmsg *structNested, addr *net.UDPAddr) int {
+	if recvmsg.A.Implied_port != 0 {
+		return addr.Port
+	}
+	return int(recvmsg.A.Port)
+}
+
+// Start 开始收包和维护路由表，没有调用过ListenUDP时先监听。
+// 需要PacketConn的(如uTP)可以先ListenUDP，注册完回调后再Start，避免漏掉最初的包
 func (client *Client) Start() error {
-	err := client.ListenUDP()
-	if err != nil {
-		logx.Infof("err:%v", err)
-		return err
+	var err error
+	if client.connection == nil {
+		err = client.ListenUDP()
+		if err != nil {
+			return err
+		}
+	}
+	if probe := RemoteIPProbe; probe != nil && client.network == "udp4" {
+		go func() {
+			ip, err := probe()
+			logger.Infow("remote ip", logx.Field("ip", ip), logging.Err(err))
+		}()
 	}
 	go client.recv()
-	go client.send(client.nodeTables[client.peerInfo.ID])
+	go client.maintain()
+	go client.expirePeers()
+	go client.expireGuard()
+	go client.expireHealth()
+	go client.watchLoop()
+	go client.announceLoop()
 	return err
 }
 
 func (client *Client) ListenUDP() error {
-	logx.Infof("ListenUDP addr:%v ", client.peerInfo.addr.String())
+	logger.Infow("listen", logging.Addr(client.peerInfo.addr))
 	connection, err := net.ListenUDP(client.network, client.peerInfo.addr)
 	if err != nil {
-		logx.Infof("ListenUDP err:%v", err)
+		logger.Errorw("listen failed", logging.Addr(client.peerInfo.addr), logging.Err(err))
 		return err
 	}
 	client.connection = connection
@@ -108,27 +223,61 @@ func (client *Client) recv() {
 		// }
 		n, addr, err := client.connection.ReadFromUDP(buffer)
 		if err != nil {
-			logx.Infof("err:%v", err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if logger.Packet() {
+				logger.Packetw("recv failed", logging.Err(err))
+			}
+			continue
+		}
+		// 黑名单和封禁对uTP同样有效
+		if !client.guard.allowPacket(addr.IP) {
 			continue
 		}
-		// logx.Infof("recv data:%v", string(buffer[:n]))
-		buff := bytes.NewBuffer(buffer[:n])
-		var recvmsg structNested
-		err = bencode.Unmarshal(buff, &recvmsg)
+		if n > 0 && buffer[0] != 'd' {
+			if fn, ok := client.packetHandler.Load().(func([]byte, *net.UDPAddr)); ok {
+				fn(buffer[:n], addr)
+				continue
+			}
+		}
+		recvmsg, err := decodeMsg(buffer[:n])
 		if err != nil {
-			logx.Infof("recv from %v Unmarshal fail", addr.String())
+			atomic.AddUint64(&client.stats.decodeErrors, 1)
+			if logger.Packet() {
+				logger.Packetw("decode failed", logging.Addr(addr), logging.Err(err))
+			}
+			client.guard.violation(addr.IP)
+			// 能确定是请求的才回复，避免和对方互相回复错误
+			if recvmsg != nil && recvmsg.Y == "q" && recvmsg.N == client.networkID {
+				client.sendError(recvmsg.T, newKRPCError(ErrCodeProtocol, err.Error()), addr)
+			}
 			continue
 		}
-		client.processMsg(&recvmsg, addr)
+		client.stats.recv.add(recvmsg)
+		client.processMsg(recvmsg, addr)
 	}
 }
 func (client *Client) processMsg(recvmsg *structNested, addr *net.UDPAddr) error {
+	if recvmsg.N != client.networkID {
+		if logger.Packet() {
+			logger.Packetw("drop other network", logging.Addr(addr), logx.Field("network", recvmsg.N))
+		}
+		return nil
+	}
 	switch recvmsg.Y {
 	// 发来的是请求
 	case "q":
 		{
-			if recvmsg.A.Id != "" {
-				client.UpdateRecvTable(&NodeInfo{ID: recvmsg.A.Id, addr: addr})
+			if !client.guard.allowQuery(addr.IP) {
+				return nil
+			}
+			// bep-043只读节点不回复请求，不加入路由表
+			if recvmsg.A.Id != "" && !recvmsg.ReadOnly() {
+				client.UpdateRecvTable(&NodeInfo{ID: recvmsg.A.Id, addr: addr, seen: time.Now()})
+			}
+			if logger.Packet() {
+				logger.Packetw("recv query", logging.Addr(addr), logging.Tx(recvmsg.T), logging.Query(recvmsg.Q), logging.InfoHash(recvmsg.A.Info_hash))
 			}
 			resp := &structNested{
 				T: recvmsg.T,
@@ -138,46 +287,62 @@ func (client *Client) processMsg(recvmsg *structNested, addr *net.UDPAddr) error
 			case "ping":
 				client.sendPingResp(resp, addr)
 			case "find_node":
-				logx.Infof("find_node from:%+v", addr.String())
-				resp.R.Nodes = CompactNodesInfo(client.GetClosest(recvmsg.A.Target))
+				client.fillNodes(resp, recvmsg.A.Target, recvmsg.A.Want, addr)
 				client.sendFindNodeResp(resp, addr)
 			case "get_peers":
-				logx.Infof("get_peers from:%+v,infoHash:%x", addr.String(), recvmsg.A.Info_hash)
-				resp.R.Token = recvmsg.A.Token
-				resp.R.Values = EncodeValues(client.GetClosest(recvmsg.A.Target))
+				resp.R.Token = client.tokens.token(addr.IP)
+				if peers := client.peers.Get(recvmsg.A.Info_hash, maxValues); len(peers) > 0 {
+					resp.R.Values = encodePeers(peers)
+				} else {
+					client.fillNodes(resp, recvmsg.A.Info_hash, recvmsg.A.Want, addr)
+				}
 				client.sendGetPeerResp(resp, addr)
+				client.notifyHarvest(recvmsg, addr)
 			case "announce_peer":
-				logx.Infof("announce_peer from:%+v,infoHash:%x", addr.String(), recvmsg.A.Info_hash)
-				client.sendAnnouncePeerResp(resp, addr)
+				if client.tokens.valid(recvmsg.A.Token, addr.IP) {
+					client.sendAnnouncePeerResp(resp, addr)
+					client.peers.Add(recvmsg.A.Info_hash, &net.TCPAddr{IP: addr.IP, Port: announcePort(recvmsg, addr)})
+				} else {
+					client.sendError(recvmsg.T, newKRPCError(ErrCodeProtocol, "bad token"), addr)
+				}
+				client.notifyHarvest(recvmsg, addr)
+			default:
+				client.sendError(recvmsg.T, newKRPCError(ErrCodeMethod, recvmsg.Q), addr)
 			}
 		}
 	// 发来的是响应
 	case "r":
 		{
-			logx.Infof("response from:%v,t:%+v", addr.String(), recvmsg.T)
+			if logger.Packet() {
+				logger.Packetw("recv response", logging.Addr(addr), logging.Tx(recvmsg.T), logx.Field("nodes", len(recvmsg.R.Nodes)/26),
+					logx.Field("nodes6", len(recvmsg.R.Nodes6)/38), logx.Field("values", len(recvmsg.R.Values)))
+			}
+			client.bootstrap.onResponse(addr)
+			client.health.onResponse(addr, recvmsg.V, time.Now())
+			if len(recvmsg.R.Id) == 20 {
+				client.UpdateRecvTable(&NodeInfo{ID: recvmsg.R.Id, addr: addr, seen: time.Now()})
+			}
 			if len(recvmsg.R.Nodes) > 0 {
 				nodes := DecodeCompactNodesInfo(recvmsg.R.Nodes)
-				logx.Infof("response NodeInfo len:%v", len(nodes))
 				for _, node := range nodes {
 					client.UpdateRecvTable(node)
 				}
 			}
 			if len(recvmsg.R.Nodes6) > 0 {
 				nodes6 := DecodeCompactNodesInfo(recvmsg.R.Nodes6)
-				logx.Infof("response NodeInfo6 len:%v", len(nodes6))
 				for _, node := range nodes6 {
 					client.UpdateRecvTable(node)
 				}
 			}
-			if len(recvmsg.R.Values) > 0 {
-				for i, addr := range DecodeCompactValues(recvmsg.R.Values) {
-					logx.Infof("response values(%v/%v):%v", i+1, len(recvmsg.R.Values), addr.String())
-				}
-			}
+			client.finishTransaction(recvmsg, addr)
 		}
 	case "e":
 		{
-			logx.Infof("processMsg error %v", recvmsg.E)
+			client.health.onError(addr, time.Now())
+			// 投递给等待中的请求，由调用方通过Err()拿到错误
+			if !client.finishTransaction(recvmsg, addr) && logger.Packet() {
+				logger.Packetw("recv unmatched error", logging.Addr(addr), logging.Tx(recvmsg.T), logging.Err(recvmsg.Err()))
+			}
 		}
 	}
 	return nil
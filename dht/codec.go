@@ -0,0 +1,249 @@
+package dht
+
+import (
+	"fmt"
+)
+
+// KRPC消息解码：先解析成bnode，再按消息类型校验并填到structNested，原始报文保留在msg里
+
+// clientVersion 发出的消息带上的v字段，CL为ciligo，版本0.1
+const clientVersion = "CL\x00\x01"
+
+// ProtocolError 消息格式错误，对请求应回复203
+type ProtocolError struct {
+	Field  string // 出错的字段，如a.info_hash
+	Reason string
+}
+
+func (e *ProtocolError) Error() string {
+	return "krpc: invalid " + e.Field + ": " + e.Reason
+}
+
+func protocolErrorf(field string, format string, args ...interface{}) *ProtocolError {
+	return &ProtocolError{Field: field, Reason: fmt.Sprintf(format, args...)}
+}
+
+// decodeMsg 解码并校验一个KRPC消息。出错时如果已经解出t和y，返回的消息不为nil，用于回复错误
+func decodeMsg(data []byte) (*structNested, error) {
+	d := getDecoder()
+	defer d.release()
+	raw := string(data)
+	if err := d.parse(raw); err != nil {
+		return nil, protocolErrorf("message", "%v", err)
+	}
+	if d.nodes[0].kind != 'd' {
+		return nil, protocolErrorf("message", "not a dict")
+	}
+	return d.decodeMsg(0, raw)
+}
+
+func (d *krpcDecoder) decodeMsg(dict int, raw string) (*structNested, error) {
+	var err error
+	msg := &structNested{raw: raw}
+	if ro := d.lookup(dict, "ro"); ro >= 0 {
+		msg.ro = d.nodes[ro].kind == 'i' && d.nodes[ro].num == 1
+	}
+	if msg.T, err = d.dictString(dict, "t", "t", true); err != nil {
+		return nil, err
+	}
+	if msg.Y, err = d.dictString(dict, "y", "y", true); err != nil {
+		return nil, err
+	}
+	if msg.V, err = d.dictString(dict, "v", "v", false); err != nil {
+		return msg, err
+	}
+	if msg.N, err = d.dictString(dict, "n", "n", false); err != nil {
+		return msg, err
+	}
+	switch msg.Y {
+	case "q":
+		err = d.decodeQuery(dict, msg)
+	case "r":
+		err = d.decodeResponse(dict, msg)
+	case "e":
+		err = d.decodeError(dict, msg)
+	default:
+		err = protocolErrorf("y", "unknown type %q", msg.Y)
+	}
+	return msg, err
+}
+
+func (d *krpcDecoder) decodeQuery(dict int, msg *structNested) error {
+	var err error
+	if msg.Q, err = d.dictString(dict, "q", "q", true); err != nil {
+		return err
+	}
+	a, err := d.dictDict(dict, "a", "a")
+	if err != nil {
+		return err
+	}
+	if msg.A.Id, err = d.dictID(a, "id", "a.id", true); err != nil {
+		return err
+	}
+	announce := msg.Q == "announce_peer"
+	if msg.A.Target, err = d.dictID(a, "target", "a.target", msg.Q == "find_node"); err != nil {
+		return err
+	}
+	if msg.A.Info_hash, err = d.dictID(a, "info_hash", "a.info_hash", msg.Q == "get_peers" || announce); err != nil {
+		return err
+	}
+	if msg.A.Token, err = d.dictString(a, "token", "a.token", announce); err != nil {
+		return err
+	}
+	implied, err := d.dictInt(a, "implied_port", "a.implied_port", false)
+	if err != nil {
+		return err
+	}
+	msg.A.Implied_port = uint64(implied)
+	port, err := d.dictInt(a, "port", "a.port", announce && implied == 0)
+	if err != nil {
+		return err
+	}
+	if port < 0 || port > 65535 {
+		return protocolErrorf("a.port", "out of range %d", port)
+	}
+	msg.A.Port = uint64(port)
+	if msg.A.Want, err = d.dictStrings(a, "want", "a.want"); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (d *krpcDecoder) decodeResponse(dict int, msg *structNested) error {
+	r, err := d.dictDict(dict, "r", "r")
+	if err != nil {
+		return err
+	}
+	if msg.R.Id, err = d.dictID(r, "id", "r.id", true); err != nil {
+		return err
+	}
+	if msg.R.Token, err = d.dictString(r, "token", "r.token", false); err != nil {
+		return err
+	}
+	if msg.R.Nodes, err = d.dictString(r, "nodes", "r.nodes", false); err != nil {
+		return err
+	}
+	if len(msg.R.Nodes)%26 != 0 {
+		return protocolErrorf("r.nodes", "length %d not a multiple of 26", len(msg.R.Nodes))
+	}
+	if msg.R.Nodes6, err = d.dictString(r, "nodes6", "r.nodes6", false); err != nil {
+		return err
+	}
+	if len(msg.R.Nodes6)%38 != 0 {
+		return protocolErrorf("r.nodes6", "length %d not a multiple of 38", len(msg.R.Nodes6))
+	}
+	if msg.R.Values, err = d.dictStrings(r, "values", "r.values"); err != nil {
+		return err
+	}
+	for _, value := range msg.R.Values {
+		if len(value) != 6 && len(value) != 18 {
+			return protocolErrorf("r.values", "peer length %d", len(value))
+		}
+	}
+	return nil
+}
+
+func (d *krpcDecoder) decodeError(dict int, msg *structNested) error {
+	e := d.lookup(dict, "e")
+	if e < 0 || d.nodes[e].kind != 'l' || d.nodes[e].end-e < 3 {
+		return protocolErrorf("e", "expected [code, message]")
+	}
+	code := e + 1
+	if d.nodes[code].kind != 'i' {
+		return protocolErrorf("e", "code is not an integer")
+	}
+	text := d.nodes[code].end
+	if d.nodes[text].kind != 's' {
+		return protocolErrorf("e", "message is not a string")
+	}
+	msg.E = []interface{}{d.nodes[code].num, d.nodes[text].str}
+	return nil
+}
+
+func (d *krpcDecoder) dictString(dict int, key string, field string, required bool) (string, error) {
+	v := d.lookup(dict, key)
+	if v < 0 {
+		if required {
+			return "", protocolErrorf(field, "missing")
+		}
+		return "", nil
+	}
+	if d.nodes[v].kind != 's' {
+		return "", protocolErrorf(field, "expected string, got %s", d.typeName(v))
+	}
+	return d.nodes[v].str, nil
+}
+
+// dictID 20字节的id、target、info_hash
+func (d *krpcDecoder) dictID(dict int, key string, field string, required bool) (string, error) {
+	s, err := d.dictString(dict, key, field, required)
+	if err == nil && s != "" && len(s) != 20 {
+		err = protocolErrorf(field, "length %d, expected 20", len(s))
+	}
+	if err == nil && required && s == "" {
+		err = protocolErrorf(field, "empty")
+	}
+	return s, err
+}
+
+func (d *krpcDecoder) dictInt(dict int, key string, field string, required bool) (int64, error) {
+	v := d.lookup(dict, key)
+	if v < 0 {
+		if required {
+			return 0, protocolErrorf(field, "missing")
+		}
+		return 0, nil
+	}
+	if d.nodes[v].kind != 'i' {
+		return 0, protocolErrorf(field, "expected integer, got %s", d.typeName(v))
+	}
+	return d.nodes[v].num, nil
+}
+
+func (d *krpcDecoder) dictDict(dict int, key string, field string) (int, error) {
+	v := d.lookup(dict, key)
+	if v < 0 {
+		return 0, protocolErrorf(field, "missing")
+	}
+	if d.nodes[v].kind != 'd' {
+		return 0, protocolErrorf(field, "expected dict, got %s", d.typeName(v))
+	}
+	return v, nil
+}
+
+func (d *krpcDecoder) dictStrings(dict int, key string, field string) ([]string, error) {
+	v := d.lookup(dict, key)
+	if v < 0 {
+		return nil, nil
+	}
+	if d.nodes[v].kind != 'l' {
+		return nil, protocolErrorf(field, "expected list, got %s", d.typeName(v))
+	}
+	strs := make([]string, 0, 4)
+	for i := v + 1; i < d.nodes[v].end; i = d.nodes[i].end {
+		if d.nodes[i].kind != 's' {
+			return nil, protocolErrorf(field, "expected list of strings")
+		}
+		strs = append(strs, d.nodes[i].str)
+	}
+	return strs, nil
+}
+
+// Raw 解码时的原始字典，包含structNested里没有的字段(ip、ro、samples等)，发送的消息为nil
+func (msg *structNested) Raw() map[string]interface{} {
+	if msg.raw == "" {
+		return nil
+	}
+	d := getDecoder()
+	defer d.release()
+	if d.parse(msg.raw) != nil || d.nodes[0].kind != 'd' {
+		return nil
+	}
+	raw, _ := d.toInterface(0).(map[string]interface{})
+	return raw
+}
+
+// ReadOnly bep-043只读节点，不应加入路由表
+func (msg *structNested) ReadOnly() bool {
+	return msg.ro
+}
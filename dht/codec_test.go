@@ -0,0 +1,87 @@
+package dht
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+func encodeTestMsg(t *testing.T, v interface{}) []byte {
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, v); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeMsg(t *testing.T) {
+	id := strings.Repeat("i", 20)
+	data := encodeTestMsg(t, map[string]interface{}{
+		"t":  "aa",
+		"y":  "q",
+		"q":  "get_peers",
+		"v":  "LT\x01\x02",
+		"ro": 1,
+		"ip": "\x01\x02\x03\x04\x1a\xe1",
+		"a": map[string]interface{}{
+			"id":        id,
+			"info_hash": strings.Repeat("h", 20),
+			"want":      []interface{}{"n4", "n6"},
+		},
+	})
+	msg, err := decodeMsg(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.T != "aa" || msg.Q != "get_peers" || msg.A.Id != id || msg.V != "LT\x01\x02" || len(msg.A.Want) != 2 {
+		t.Fatalf("unexpected msg %+v", msg)
+	}
+	if !msg.ReadOnly() || msg.Raw()["ip"] != "\x01\x02\x03\x04\x1a\xe1" {
+		t.Fatalf("raw fields lost: %v", msg.Raw())
+	}
+
+	// 和sendMsg编码出来的消息一致
+	sent := &structNested{T: "bb", Y: "r", R: ResponseInfo{Id: id, Nodes: strings.Repeat("n", 26), Values: []string{"123456"}}}
+	msg, err = decodeMsg(encodeTestMsg(t, *sent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.R.Id != id || msg.R.Nodes != sent.R.Nodes || len(msg.R.Values) != 1 {
+		t.Fatalf("unexpected response %+v", msg.R)
+	}
+}
+
+func TestDecodeMsgErrors(t *testing.T) {
+	id := strings.Repeat("i", 20)
+	for _, c := range []struct {
+		msg   interface{}
+		field string
+		query bool // 出错时能否得到t和y用于回复
+	}{
+		{"not a dict", "message", false},
+		{map[string]interface{}{"y": "q"}, "t", false},
+		{map[string]interface{}{"t": "aa", "y": "x"}, "y", true},
+		{map[string]interface{}{"t": "aa", "y": "q", "q": "ping"}, "a", true},
+		{map[string]interface{}{"t": "aa", "y": "q", "q": "ping", "a": map[string]interface{}{"id": "short"}}, "a.id", true},
+		{map[string]interface{}{"t": "aa", "y": "q", "q": "get_peers", "a": map[string]interface{}{"id": id}}, "a.info_hash", true},
+		{map[string]interface{}{"t": "aa", "y": "q", "q": "announce_peer", "a": map[string]interface{}{"id": id, "info_hash": id, "token": "x"}}, "a.port", true},
+		{map[string]interface{}{"t": "aa", "y": "q", "q": "announce_peer", "a": map[string]interface{}{"id": id, "info_hash": id, "token": "x", "port": 70000}}, "a.port", true},
+		{map[string]interface{}{"t": "aa", "y": "q", "q": "find_node", "a": map[string]interface{}{"id": id, "target": 1}}, "a.target", true},
+		{map[string]interface{}{"t": "aa", "y": "r", "r": map[string]interface{}{"id": id, "nodes": "abc"}}, "r.nodes", true},
+		{map[string]interface{}{"t": "aa", "y": "r", "r": map[string]interface{}{"id": id, "values": []interface{}{"abc"}}}, "r.values", true},
+		{map[string]interface{}{"t": "aa", "y": "e", "e": []interface{}{"201", "x"}}, "e", true},
+	} {
+		msg, err := decodeMsg(encodeTestMsg(t, c.msg))
+		var perr *ProtocolError
+		if !errors.As(err, &perr) || perr.Field != c.field {
+			t.Errorf("decode %v: err = %v, want field %v", c.msg, err, c.field)
+			continue
+		}
+		if (msg != nil) != c.query {
+			t.Errorf("decode %v: msg = %+v", c.msg, msg)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package dht
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zeromicro/go-zero/core/logx"
+)
+
+// 入站防护：按ip限速、临时封禁、静态黑名单、过滤非法节点
+
+const (
+	guardExpire     = time.Minute * 5
+	maxGuardEntries = 65536 // 记录的ip数上限，伪造源地址的洪水不能让它无限增长
+)
+
+// GuardConfig 入站限制
+type GuardConfig struct {
+	QueryRate      float64       // 每个ip每秒的请求数
+	QueryBurst     int           // 每个ip允许的突发请求数
+	BanThreshold   int           // 一个统计窗口内违规次数达到这个值就封禁
+	BanWindow      time.Duration // 违规次数的统计窗口
+	BanDuration    time.Duration
+	RejectLowPorts bool // 拒绝端口小于1024的节点
+}
+
+func DefaultGuardConfig() GuardConfig {
+	return GuardConfig{
+		QueryRate:    5,
+		QueryBurst:   20,
+		BanThreshold: 50,
+		BanWindow:    time.Minute,
+		BanDuration:  time.Minute * 10,
+	}
+}
+
+// GuardStats 入站防护统计
+type GuardStats struct {
+	Limited  uint64 // 超过ip速率被丢弃的请求
+	Blocked  uint64 // 来自黑名单或被封禁ip的包
+	Rejected uint64 // 不允许加入路由表的节点
+	Bans     uint64
+	Banned   int // 当前封禁的ip数
+}
+
+type ipState struct {
+	bucket      *tokenBucket
+	violations  int
+	windowStart time.Time
+	bannedUntil time.Time
+	seen        time.Time
+}
+
+type guard struct {
+	mutex     sync.Mutex
+	conf      GuardConfig
+	ips       map[string]*ipState
+	blocklist *Blocklist
+	stats     GuardStats
+}
+
+func newGuard(conf GuardConfig) *guard {
+	return &guard{
+		conf: conf,
+		ips:  make(map[string]*ipState),
+	}
+}
+
+// state 取ip的状态，不存在时新建。记录已满时返回nil，这些ip不按ip限速，
+// 回复仍然受发包限速的reply预算限制
+func (g *guard) state(ip net.IP, now time.Time) *ipState {
+	key := string(ip.To16())
+	s := g.ips[key]
+	if s == nil {
+		if len(g.ips) >= maxGuardEntries {
+			return nil
+		}
+		burst := time.Duration(float64(g.conf.QueryBurst) / g.conf.QueryRate * float64(time.Second))
+		s = &ipState{
+			bucket:      newTokenBucket(g.conf.QueryRate, burst),
+			windowStart: now,
+		}
+		g.ips[key] = s
+	}
+	s.seen = now
+	return s
+}
+
+// allowPacket 黑名单和被封禁的ip直接丢弃
+func (g *guard) allowPacket(ip net.IP) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.blocklist.Contains(ip) {
+		g.stats.Blocked++
+		return false
+	}
+	if s := g.ips[string(ip.To16())]; s != nil && time.Now().Before(s.bannedUntil) {
+		g.stats.Blocked++
+		return false
+	}
+	return true
+}
+
+// allowQuery 按ip限速，超过速率记一次违规
+func (g *guard) allowQuery(ip net.IP) bool {
+	if g.conf.QueryRate <= 0 {
+		return true
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	now := time.Now()
+	s := g.state(ip, now)
+	if s == nil {
+		return true
+	}
+	if s.bucket.reserve(now, 1) > 0 {
+		s.bucket.cancel()
+		g.stats.Limited++
+		g.violate(ip, s, now)
+		return false
+	}
+	return true
+}
+
+// violation 格式错误等违规行为
+func (g *guard) violation(ip net.IP) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	now := time.Now()
+	if s := g.state(ip, now); s != nil {
+		g.violate(ip, s, now)
+	}
+}
+
+func (g *guard) violate(ip net.IP, s *ipState, now time.Time) {
+	if g.conf.BanThreshold <= 0 {
+		return
+	}
+	if now.Sub(s.windowStart) > g.conf.BanWindow {
+		s.windowStart = now
+		s.violations = 0
+	}
+	s.violations++
+	if s.violations >= g.conf.BanThreshold && now.After(s.bannedUntil) {
+		s.bannedUntil = now.Add(g.conf.BanDuration)
+		s.violations = 0
+		g.stats.Bans++
+		logger.Infow("ban ip", logx.Field("ip", ip.String()), logx.Field("until", s.bannedUntil))
+	}
+}
+
+// validNode 加入路由表和查询候选前检查：黑名单、冒用我们的id、非法端口
+func (g *guard) validNode(node *NodeInfo, self string) bool {
+	ok := node.addr != nil && node.ID != self && node.addr.Port != 0 &&
+		!(g.conf.RejectLowPorts && node.addr.Port < 1024)
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if ok && g.blocklist.Contains(node.addr.IP) {
+		ok = false
+	}
+	if !ok {
+		g.stats.Rejected++
+	}
+	return ok
+}
+
+func (g *guard) expire() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	now := time.Now()
+	banned := 0
+	for key, s := range g.ips {
+		if now.Before(s.bannedUntil) {
+			banned++
+			continue
+		}
+		if now.Sub(s.seen) > guardExpire {
+			delete(g.ips, key)
+		}
+	}
+	g.stats.Banned = banned
+}
+
+// filterNodes 去掉不允许的节点
+func (client *Client) filterNodes(nodes []*NodeInfo) []*NodeInfo {
+	kept := nodes[:0]
+	for _, node := range nodes {
+		if client.guard.validNode(node, client.ID()) {
+			kept = append(kept, node)
+		}
+	}
+	return kept
+}
+
+func (client *Client) expireGuard() {
+	ticker := time.NewTicker(time.Minute)
+	for range ticker.C {
+		client.guard.expire()
+	}
+}
+
+// SetGuard 设置入站限制，需在Start之前调用
+func (client *Client) SetGuard(conf GuardConfig) {
+	blocklist := client.guard.blocklist
+	client.guard = newGuard(conf)
+	client.guard.blocklist = blocklist
+}
+
+// SetBlocklist 替换静态黑名单，可以在运行中调用
+func (client *Client) SetBlocklist(b *Blocklist) {
+	client.guard.mutex.Lock()
+	defer client.guard.mutex.Unlock()
+	client.guard.blocklist = b
+}
+
+func (client *Client) GuardStats() GuardStats {
+	client.guard.mutex.Lock()
+	defer client.guard.mutex.Unlock()
+	return client.guard.stats
+}
+
+type ipRange struct {
+	start, end net.IP // 16字节
+}
+
+// Blocklist 静态ip黑名单，区间合并后二分查找
+type Blocklist struct {
+	ranges []ipRange
+}
+
+var ErrBadBlocklist = errors.New("bad blocklist line")
+
+// LoadBlocklist 每行一个CIDR、单个ip、"起始ip-结束ip"，或者P2P格式的"描述:起始ip-结束ip"，#开头为注释
+func LoadBlocklist(path string) (*Blocklist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var ranges []ipRange
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseBlocklistLine(line)
+		if err != nil {
+			logger.Infow("blocklist skip line", logx.Field("path", path), logx.Field("line", line))
+			continue
+		}
+		ranges = append(ranges, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	b := newBlocklist(ranges)
+	logger.Infow("load blocklist", logx.Field("path", path), logx.Field("ranges", len(b.ranges)))
+	return b, nil
+}
+
+func parseBlocklistLine(line string) (ipRange, error) {
+	if _, ipnet, err := net.ParseCIDR(line); err == nil {
+		start := ipnet.IP.To16()
+		end := make(net.IP, 16)
+		mask := ipnet.Mask
+		if len(mask) == 4 {
+			mask = append(net.CIDRMask(96, 128)[:12], mask...)
+		}
+		for i := range end {
+			end[i] = start[i] | ^mask[i]
+		}
+		return ipRange{start: start, end: end}, nil
+	}
+	if ip := net.ParseIP(line); ip != nil {
+		return ipRange{start: ip.To16(), end: ip.To16()}, nil
+	}
+	// P2P格式只有ipv4，描述里可能有冒号，取最后一个冒号之后的部分
+	if i := strings.LastIndex(line, ":"); i >= 0 {
+		line = line[i+1:]
+	}
+	parts := strings.SplitN(line, "-", 2)
+	if len(parts) == 2 {
+		start := net.ParseIP(strings.TrimSpace(parts[0]))
+		end := net.ParseIP(strings.TrimSpace(parts[1]))
+		if start != nil && end != nil && bytes.Compare(start.To16(), end.To16()) <= 0 {
+			return ipRange{start: start.To16(), end: end.To16()}, nil
+		}
+	}
+	return ipRange{}, ErrBadBlocklist
+}
+
+func newBlocklist(ranges []ipRange) *Blocklist {
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].start, ranges[j].start) < 0
+	})
+	var merged []ipRange
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && bytes.Compare(r.start, merged[n-1].end) <= 0 {
+			if bytes.Compare(r.end, merged[n-1].end) > 0 {
+				merged[n-1].end = r.end
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return &Blocklist{ranges: merged}
+}
+
+func (b *Blocklist) Contains(ip net.IP) bool {
+	if b == nil || len(b.ranges) == 0 {
+		return false
+	}
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+	// 第一个start大于ip的区间的前一个
+	i := sort.Search(len(b.ranges), func(i int) bool {
+		return bytes.Compare(b.ranges[i].start, ip) > 0
+	})
+	return i > 0 && bytes.Compare(ip, b.ranges[i-1].end) <= 0
+}
+
+func (b *Blocklist) Len() int {
+	if b == nil {
+		return 0
+	}
+	return len(b.ranges)
+}
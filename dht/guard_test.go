@@ -0,0 +1,139 @@
+package dht
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBlocklist(t *testing.T) {
+	path := t.TempDir() + "/blocklist.txt"
+	data := "# comment\n" +
+		"10.0.0.0/8\n" +
+		"Some Org: bad range:192.168.1.10-192.168.1.20\n" +
+		"192.168.1.15-192.168.1.30\n" +
+		"2001:db8::/32\n" +
+		"1.2.3.4\n" +
+		"garbage\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b, err := LoadBlocklist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 192.168.1.10-20和192.168.1.15-30合并
+	if b.Len() != 4 {
+		t.Fatalf("ranges = %v, want 4", b.Len())
+	}
+	for ip, want := range map[string]bool{
+		"10.1.2.3":        true,
+		"11.0.0.0":        false,
+		"192.168.1.9":     false,
+		"192.168.1.25":    true,
+		"192.168.1.31":    false,
+		"1.2.3.4":         true,
+		"1.2.3.5":         false,
+		"2001:db8::1":     true,
+		"2001:db9::1":     false,
+		"::ffff:10.0.0.1": true,
+	} {
+		if got := b.Contains(net.ParseIP(ip)); got != want {
+			t.Errorf("Contains(%v) = %v, want %v", ip, got, want)
+		}
+	}
+}
+
+func TestGuardBansFlood(t *testing.T) {
+	g := newGuard(GuardConfig{
+		QueryRate:    1,
+		QueryBurst:   5,
+		BanThreshold: 10,
+		BanWindow:    time.Minute,
+		BanDuration:  time.Minute,
+	})
+	ip := net.IPv4(1, 1, 1, 1)
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		if g.allowQuery(ip) {
+			allowed++
+		}
+	}
+	if allowed != 5 {
+		t.Fatalf("allowed = %v, want 5", allowed)
+	}
+	if g.allowPacket(ip) || g.stats.Bans != 1 {
+		t.Fatalf("expected ban, stats %+v", g.stats)
+	}
+	if !g.allowPacket(net.IPv4(1, 1, 1, 2)) {
+		t.Fatal("other ip should not be banned")
+	}
+}
+
+func TestGuardValidNode(t *testing.T) {
+	g := newGuard(GuardConfig{RejectLowPorts: true})
+	g.blocklist = newBlocklist([]ipRange{{start: net.IPv4(5, 5, 5, 0).To16(), end: net.IPv4(5, 5, 5, 255).To16()}})
+	self := string(make([]byte, 20))
+	other := "abcdefghij0123456789"
+	for _, c := range []struct {
+		node *NodeInfo
+		want bool
+	}{
+		{&NodeInfo{ID: other, addr: &net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 6881}}, true},
+		{&NodeInfo{ID: self, addr: &net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 6881}}, false},
+		{&NodeInfo{ID: other, addr: &net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 0}}, false},
+		{&NodeInfo{ID: other, addr: &net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 80}}, false},
+		{&NodeInfo{ID: other, addr: &net.UDPAddr{IP: net.IPv4(5, 5, 5, 5), Port: 6881}}, false},
+	} {
+		if got := g.validNode(c.node, self); got != c.want {
+			t.Errorf("validNode(%v) = %v, want %v", c.node.addr, got, c.want)
+		}
+	}
+}
+
+func TestGuardMaxEntries(t *testing.T) {
+	g := newGuard(DefaultGuardConfig())
+	for i := 0; i < maxGuardEntries; i++ {
+		g.ips[string([]byte{byte(i >> 8), byte(i)})] = &ipState{}
+	}
+	// 记录已满时不再新建，新的ip不按ip限速
+	ip := net.IPv4(1, 1, 1, 1)
+	for i := 0; i < 100; i++ {
+		if !g.allowQuery(ip) {
+			t.Fatal("untracked ip limited")
+		}
+	}
+	g.violation(ip)
+	if len(g.ips) != maxGuardEntries {
+		t.Fatalf("ips = %v", len(g.ips))
+	}
+}
+
+func TestGuardBlocksUTP(t *testing.T) {
+	a := startTestClient(t, "", "")
+	received := make(chan struct{}, 1)
+	a.OnPacket(func(b []byte, addr *net.UDPAddr) {
+		received <- struct{}{}
+	})
+	a.SetBlocklist(newBlocklist([]ipRange{{start: net.IPv4(127, 0, 0, 1).To16(), end: net.IPv4(127, 0, 0, 1).To16()}}))
+	conn, err := net.DialUDP("udp4", nil, a.connection.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// 非bencode的包交给uTP之前也要检查黑名单
+	conn.Write([]byte{0x41, 0})
+	select {
+	case <-received:
+		t.Fatal("blocked packet reached the packet handler")
+	case <-time.After(time.Millisecond * 200):
+	}
+	a.SetBlocklist(nil)
+	conn.Write([]byte{0x41, 0})
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("packet not delivered")
+	}
+}
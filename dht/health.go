@@ -0,0 +1,243 @@
+package dht
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 节点健康度：按地址统计发出的请求、回复、超时和rtt，
+// 查询时优先选择得分高的节点，连续超时的节点从路由表删除
+
+const (
+	healthTimeout    = time.Second * 5 // 请求超过这个时间没有回复算一次超时
+	healthExpire     = time.Minute * 30
+	maxHealthEntries = 65536
+	maxNodeFailures  = 4   // 连续超时达到这个次数后从路由表删除
+	rttAlpha         = 0.2 // rtt的EWMA系数
+	unknownScore     = 0.5 // 没有统计的节点的得分
+)
+
+// NodeStats 一个节点的统计
+type NodeStats struct {
+	Addr         string
+	Queries      int
+	Responses    int
+	Timeouts     int
+	Errors       int
+	Failures     int           // 连续超时的次数，收到回复时清零
+	RTT          time.Duration // 回复时间的EWMA
+	Version      string        // 回复里的v字段
+	LastQuery    time.Time
+	LastResponse time.Time
+	// 未回复的请求数和其中最早的发送时间
+	outstanding  int
+	pendingSince time.Time
+}
+
+// Score 0到1之间，没有统计的节点为0.5。回复率越高、rtt越小得分越高，连续超时会快速降低得分
+func (s *NodeStats) Score() float64 {
+	if s == nil {
+		return unknownScore
+	}
+	resp := float64(s.Responses+s.Errors+1) / float64(s.Responses+s.Errors+s.Timeouts+2)
+	speed := 1.0
+	if s.RTT > 0 {
+		speed = 1 / (1 + s.RTT.Seconds()/0.5)
+	}
+	return resp * (0.5 + 0.5*speed) / float64(1+s.Failures)
+}
+
+// checkTimeout 未回复的请求超时后记一次超时，返回是否应从路由表删除
+func (s *NodeStats) checkTimeout(now time.Time) bool {
+	if s.outstanding == 0 || now.Sub(s.pendingSince) < healthTimeout {
+		return false
+	}
+	s.outstanding = 0
+	s.Timeouts++
+	s.Failures++
+	return s.Failures >= maxNodeFailures
+}
+
+type nodeHealth struct {
+	mutex sync.Mutex
+	nodes map[string]*NodeStats
+}
+
+func newNodeHealth() *nodeHealth {
+	return &nodeHealth{
+		nodes: make(map[string]*NodeStats),
+	}
+}
+
+func (h *nodeHealth) get(key string, create bool) *NodeStats {
+	s := h.nodes[key]
+	if s == nil && create && len(h.nodes) < maxHealthEntries {
+		s = &NodeStats{Addr: key}
+		h.nodes[key] = s
+	}
+	return s
+}
+
+// onQuery 发出请求，返回节点是否因为连续超时应被删除
+func (h *nodeHealth) onQuery(addr *net.UDPAddr, now time.Time) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	s := h.get(addr.String(), true)
+	if s == nil {
+		return false
+	}
+	evict := s.checkTimeout(now)
+	s.Queries++
+	s.LastQuery = now
+	if s.outstanding == 0 {
+		s.pendingSince = now
+	}
+	s.outstanding++
+	return evict
+}
+
+func (h *nodeHealth) onResponse(addr *net.UDPAddr, version string, now time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	s := h.get(addr.String(), true)
+	if s == nil {
+		return
+	}
+	if s.outstanding > 0 {
+		if rtt := now.Sub(s.pendingSince); rtt < healthTimeout {
+			if s.RTT == 0 {
+				s.RTT = rtt
+			} else {
+				s.RTT += time.Duration(rttAlpha * float64(rtt-s.RTT))
+			}
+		}
+	}
+	s.outstanding = 0
+	s.Responses++
+	s.Failures = 0
+	s.LastResponse = now
+	if version != "" {
+		s.Version = version
+	}
+}
+
+// onError 回复了错误，说明节点在线，不计算rtt
+func (h *nodeHealth) onError(addr *net.UDPAddr, now time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if s := h.get(addr.String(), false); s != nil {
+		s.outstanding = 0
+		s.Errors++
+		s.Failures = 0
+		s.LastResponse = now
+	}
+}
+
+// failing 最近的请求超时后还没有再回复过
+func (h *nodeHealth) failing(addr *net.UDPAddr) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	s := h.nodes[addr.String()]
+	return s != nil && s.Failures > 0
+}
+
+func (h *nodeHealth) score(addr *net.UDPAddr) float64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.nodes[addr.String()].Score()
+}
+
+// replaceable 桶满时可以被新节点替换的节点(bep-005)：只替换坏节点(正在超时)和可疑节点(15分钟内没有联系过)，
+// 回复慢但一直在回复的好节点不替换。有多个时取得分最低的，得分相同时取最早加入的。没有时返回-1
+func (h *nodeHealth) replaceable(nodes []*NodeInfo, now time.Time) int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	worst, worstScore := -1, 0.0
+	for i, node := range nodes {
+		s := h.nodes[node.addr.String()]
+		bad := s != nil && s.Failures > 0
+		if !bad && now.Sub(node.seen) <= questionableAge {
+			continue
+		}
+		score := s.Score()
+		if worst < 0 || score < worstScore {
+			worst, worstScore = i, score
+		}
+	}
+	return worst
+}
+
+// sortByScore 按得分从高到低排序，得分相同时保持原来的顺序
+func (h *nodeHealth) sortByScore(nodes []*NodeInfo) {
+	scores := make(map[*NodeInfo]float64, len(nodes))
+	h.mutex.Lock()
+	for _, node := range nodes {
+		scores[node] = h.nodes[node.addr.String()].Score()
+	}
+	h.mutex.Unlock()
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return scores[nodes[i]] > scores[nodes[j]]
+	})
+}
+
+// expire 检查超时并删除长时间没有活动的统计，返回应从路由表删除的地址
+func (h *nodeHealth) expire(now time.Time) []string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var evict []string
+	for key, s := range h.nodes {
+		if s.checkTimeout(now) {
+			evict = append(evict, key)
+		}
+		if now.Sub(s.LastQuery) > healthExpire && now.Sub(s.LastResponse) > healthExpire {
+			delete(h.nodes, key)
+		}
+	}
+	return evict
+}
+
+func (h *nodeHealth) snapshot() []NodeStats {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	stats := make([]NodeStats, 0, len(h.nodes))
+	for _, s := range h.nodes {
+		stats = append(stats, *s)
+	}
+	return stats
+}
+
+// NodeStats 所有节点的统计，按得分从高到低排序
+func (client *Client) NodeStats() []NodeStats {
+	stats := client.health.snapshot()
+	sort.SliceStable(stats, func(i, j int) bool {
+		return stats[i].Score() > stats[j].Score()
+	})
+	return stats
+}
+
+// removeNode 从路由表删除地址为addr的节点
+func (client *Client) removeNode(addr string) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	table := client.table
+	for dis, buck := range table.buckets {
+		for i, node := range buck {
+			if node.addr.String() == addr {
+				table.buckets[dis] = append(buck[:i:i], buck[i+1:]...)
+				table.touched[dis] = time.Now()
+				break
+			}
+		}
+	}
+}
+
+func (client *Client) expireHealth() {
+	ticker := time.NewTicker(time.Minute)
+	for now := range ticker.C {
+		for _, addr := range client.health.expire(now) {
+			client.removeNode(addr)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNodeHealth(t *testing.T) {
+	h := newNodeHealth()
+	fast := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 6881}
+	slow := &net.UDPAddr{IP: net.IPv4(2, 2, 2, 2), Port: 6881}
+	dead := &net.UDPAddr{IP: net.IPv4(3, 3, 3, 3), Port: 6881}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		h.onQuery(fast, now)
+		h.onQuery(slow, now)
+		h.onQuery(dead, now)
+		h.onResponse(fast, "LT\x01\x02", now.Add(time.Millisecond*30))
+		h.onResponse(slow, "", now.Add(time.Second))
+		now = now.Add(healthTimeout)
+	}
+	nodes := []*NodeInfo{{addr: dead}, {addr: slow}, {addr: fast}}
+	h.sortByScore(nodes)
+	if nodes[0].addr != fast || nodes[1].addr != slow || nodes[2].addr != dead {
+		t.Fatalf("unexpected order %v %v %v", nodes[0].addr, nodes[1].addr, nodes[2].addr)
+	}
+	s := h.nodes[fast.String()]
+	if s.RTT != time.Millisecond*30 || s.Version != "LT\x01\x02" || s.Responses != 3 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+	// 未知节点排在有超时的节点前面
+	if h.score(dead) >= h.score(&net.UDPAddr{IP: net.IPv4(4, 4, 4, 4), Port: 1}) {
+		t.Fatal("failing node should score below unknown node")
+	}
+
+	// dead已经有2次超时，再超时2次后应被删除
+	if h.onQuery(dead, now) {
+		t.Fatal("evicted too early")
+	}
+	now = now.Add(healthTimeout)
+	if !h.onQuery(dead, now) {
+		t.Fatal("expected eviction")
+	}
+	if evict := h.expire(now.Add(healthTimeout)); len(evict) != 1 || evict[0] != dead.String() {
+		t.Fatalf("expire evict = %v", evict)
+	}
+	if len(h.expire(now.Add(healthExpire*2))) != 0 || len(h.nodes) != 0 {
+		t.Fatalf("stats not expired: %v", len(h.nodes))
+	}
+}
@@ -0,0 +1,287 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 收发包路径上的bencode编解码，只处理KRPC用到的类型，不经过反射。
+// 解码结果和bencode.Decode一致(包括重复key取最后一个、忽略尾部数据)，
+// 编码结果和bencode.Marshal(structNested)逐字节相同
+
+const (
+	maxPooledNodes = 4096
+	maxPooledBuf   = 64 << 10
+)
+
+var (
+	errUnexpectedEnd  = errors.New("unexpected end of data")
+	errNonStringKey   = errors.New("non-string dictionary key")
+	errStringTooLong  = errors.New("string length exceeds data")
+	errNegativeLength = errors.New("negative string length")
+)
+
+// bnode 解码后的一个值，list和dict的子节点按先序紧跟在后面，end为下一个兄弟节点的位置
+type bnode struct {
+	kind byte // i、s、l、d
+	str  string
+	num  int64
+	end  int
+}
+
+type krpcDecoder struct {
+	data  string
+	nodes []bnode
+}
+
+var decoderPool = sync.Pool{
+	New: func() interface{} {
+		return &krpcDecoder{nodes: make([]bnode, 0, 64)}
+	},
+}
+
+var encodeBufPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 1500)
+		return &buf
+	},
+}
+
+func getDecoder() *krpcDecoder {
+	return decoderPool.Get().(*krpcDecoder)
+}
+
+func (d *krpcDecoder) release() {
+	if cap(d.nodes) > maxPooledNodes {
+		return
+	}
+	d.data = ""
+	d.nodes = d.nodes[:0]
+	decoderPool.Put(d)
+}
+
+// parse 解析data里的第一个值，字符串都是data的子串
+func (d *krpcDecoder) parse(data string) error {
+	d.data = data
+	d.nodes = d.nodes[:0]
+	_, err := d.value(0)
+	return err
+}
+
+func (d *krpcDecoder) value(pos int) (int, error) {
+	if pos >= len(d.data) {
+		return 0, errUnexpectedEnd
+	}
+	idx := len(d.nodes)
+	switch kind := d.data[pos]; kind {
+	case 'i':
+		end := strings.IndexByte(d.data[pos+1:], 'e')
+		if end < 0 {
+			return 0, errUnexpectedEnd
+		}
+		num, err := strconv.ParseInt(d.data[pos+1:pos+1+end], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		d.nodes = append(d.nodes, bnode{kind: 'i', num: num, end: idx + 1})
+		return pos + end + 2, nil
+	case 'l', 'd':
+		d.nodes = append(d.nodes, bnode{kind: kind})
+		pos++
+		for {
+			// 和bencode-go一样，dict只在key的位置检查结束符
+			if pos < len(d.data) && d.data[pos] == 'e' {
+				pos++
+				break
+			}
+			key := len(d.nodes)
+			next, err := d.value(pos)
+			if err != nil {
+				return 0, err
+			}
+			pos = next
+			if kind == 'l' {
+				continue
+			}
+			if d.nodes[key].kind != 's' {
+				return 0, errNonStringKey
+			}
+			if pos, err = d.value(pos); err != nil {
+				return 0, err
+			}
+		}
+		d.nodes[idx].end = len(d.nodes)
+		return pos, nil
+	default:
+		colon := strings.IndexByte(d.data[pos:], ':')
+		if colon < 0 {
+			return 0, errUnexpectedEnd
+		}
+		length, err := strconv.ParseInt(d.data[pos:pos+colon], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		start := pos + colon + 1
+		if length < 0 {
+			return 0, errNegativeLength
+		}
+		if length > int64(len(d.data)-start) {
+			return 0, errStringTooLong
+		}
+		end := start + int(length)
+		d.nodes = append(d.nodes, bnode{kind: 's', str: d.data[start:end], end: idx + 1})
+		return end, nil
+	}
+}
+
+// lookup 在dict里查找key，重复的key以最后一个为准，没有时返回-1
+func (d *krpcDecoder) lookup(dict int, key string) int {
+	found := -1
+	for i := dict + 1; i < d.nodes[dict].end; {
+		value := d.nodes[i].end
+		if d.nodes[i].str == key {
+			found = value
+		}
+		i = d.nodes[value].end
+	}
+	return found
+}
+
+// typeName 和bencode.Decode返回值的%T一致，用于错误信息
+func (d *krpcDecoder) typeName(i int) string {
+	switch d.nodes[i].kind {
+	case 'i':
+		return "int64"
+	case 's':
+		return "string"
+	case 'l':
+		return "[]interface {}"
+	}
+	return "map[string]interface {}"
+}
+
+// toInterface 转成bencode.Decode的返回格式
+func (d *krpcDecoder) toInterface(i int) interface{} {
+	node := &d.nodes[i]
+	switch node.kind {
+	case 'i':
+		return node.num
+	case 's':
+		return node.str
+	case 'l':
+		list := []interface{}{}
+		for j := i + 1; j < node.end; j = d.nodes[j].end {
+			list = append(list, d.toInterface(j))
+		}
+		return list
+	}
+	dict := make(map[string]interface{})
+	for j := i + 1; j < node.end; {
+		value := d.nodes[j].end
+		dict[d.nodes[j].str] = d.toInterface(value)
+		j = d.nodes[value].end
+	}
+	return dict
+}
+
+// appendMsg 把msg编码追加到b，key按bencode-go的顺序排序，a和r总是编码
+func appendMsg(b []byte, msg *structNested) ([]byte, error) {
+	b = append(b, 'd')
+	b = appendString(b, "a")
+	b = appendRequestArg(b, &msg.A)
+	if len(msg.E) > 0 {
+		b = appendString(b, "e")
+		b = append(b, 'l')
+		for _, item := range msg.E {
+			switch v := item.(type) {
+			case int:
+				b = appendInt(b, int64(v))
+			case int64:
+				b = appendInt(b, v)
+			case uint64:
+				b = append(b, 'i')
+				b = strconv.AppendUint(b, v, 10)
+				b = append(b, 'e')
+			case string:
+				b = appendString(b, v)
+			default:
+				return b, fmt.Errorf("krpc: can't encode %T in e", item)
+			}
+		}
+		b = append(b, 'e')
+	}
+	b = appendOptString(b, "n", msg.N)
+	b = appendOptString(b, "q", msg.Q)
+	b = appendString(b, "r")
+	b = appendResponseInfo(b, &msg.R)
+	b = appendOptString(b, "t", msg.T)
+	b = appendOptString(b, "v", msg.V)
+	b = appendOptString(b, "y", msg.Y)
+	return append(b, 'e'), nil
+}
+
+func appendRequestArg(b []byte, a *RequestArg) []byte {
+	b = append(b, 'd')
+	b = appendOptString(b, "id", a.Id)
+	b = appendOptUint(b, "implied_port", a.Implied_port)
+	b = appendOptString(b, "info_hash", a.Info_hash)
+	b = appendOptUint(b, "port", a.Port)
+	b = appendOptString(b, "target", a.Target)
+	b = appendOptString(b, "token", a.Token)
+	b = appendOptStrings(b, "want", a.Want)
+	return append(b, 'e')
+}
+
+func appendResponseInfo(b []byte, r *ResponseInfo) []byte {
+	b = append(b, 'd')
+	b = appendOptString(b, "id", r.Id)
+	b = appendOptString(b, "nodes", r.Nodes)
+	b = appendOptString(b, "nodes6", r.Nodes6)
+	b = appendOptString(b, "token", r.Token)
+	b = appendOptStrings(b, "values", r.Values)
+	return append(b, 'e')
+}
+
+func appendString(b []byte, s string) []byte {
+	b = strconv.AppendInt(b, int64(len(s)), 10)
+	b = append(b, ':')
+	return append(b, s...)
+}
+
+func appendInt(b []byte, v int64) []byte {
+	b = append(b, 'i')
+	b = strconv.AppendInt(b, v, 10)
+	return append(b, 'e')
+}
+
+func appendOptString(b []byte, key string, s string) []byte {
+	if s == "" {
+		return b
+	}
+	return appendString(appendString(b, key), s)
+}
+
+func appendOptUint(b []byte, key string, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendString(b, key)
+	b = append(b, 'i')
+	b = strconv.AppendUint(b, v, 10)
+	return append(b, 'e')
+}
+
+func appendOptStrings(b []byte, key string, list []string) []byte {
+	if len(list) == 0 {
+		return b
+	}
+	b = appendString(b, key)
+	b = append(b, 'l')
+	for _, s := range list {
+		b = appendString(b, s)
+	}
+	return append(b, 'e')
+}
@@ -0,0 +1,76 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// bep-005定义的错误码
+const (
+	ErrCodeGeneric  = 201
+	ErrCodeServer   = 202
+	ErrCodeProtocol = 203
+	ErrCodeMethod   = 204
+)
+
+var errCodeText = map[int]string{
+	ErrCodeGeneric:  "Generic Error",
+	ErrCodeServer:   "Server Error",
+	ErrCodeProtocol: "Protocol Error",
+	ErrCodeMethod:   "Method Unknown",
+}
+
+// KRPCError y为e的消息，对方回复的错误或者要回复给对方的错误
+type KRPCError struct {
+	Code    int
+	Message string
+}
+
+func (e *KRPCError) Error() string {
+	return fmt.Sprintf("krpc error %d: %s", e.Code, e.Message)
+}
+
+// newKRPCError message为空时使用错误码的默认说明
+func newKRPCError(code int, message string) *KRPCError {
+	text := errCodeText[code]
+	if text == "" {
+		text = errCodeText[ErrCodeGeneric]
+	}
+	if message != "" {
+		text += ": " + message
+	}
+	return &KRPCError{Code: code, Message: text}
+}
+
+// Err 错误消息转成*KRPCError，其他消息返回nil
+func (msg *structNested) Err() error {
+	if msg.Y != "e" || len(msg.E) < 2 {
+		return nil
+	}
+	code, _ := msg.E[0].(int64)
+	text, _ := msg.E[1].(string)
+	return &KRPCError{Code: int(code), Message: text}
+}
+
+// call 发送请求并等待回复，对方回复错误时返回*KRPCError
+func (client *Client) call(ctx context.Context, msg *structNested, addr *net.UDPAddr) (*structNested, error) {
+	ch := make(chan *structNested, 1)
+	cancel, err := client.query(msg, addr, ch)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	select {
+	case reply := <-ch:
+		if err := reply.Err(); err != nil {
+			return nil, err
+		}
+		return reply, nil
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, ErrTransactionTimeout
+		}
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,49 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCallErrors(t *testing.T) {
+	a := startTestClient(t, "lab", "")
+	b := startTestClient(t, "lab", "")
+	addr := b.connection.LocalAddr().(*net.UDPAddr)
+	addr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: addr.Port}
+	infoHash := strings.Repeat("h", 20)
+
+	for _, c := range []struct {
+		msg  *structNested
+		code int
+	}{
+		{&structNested{Y: "q", Q: "vote", A: RequestArg{Id: a.ID()}}, ErrCodeMethod},
+		{&structNested{Y: "q", Q: "get_peers", A: RequestArg{Id: a.ID()}}, ErrCodeProtocol},
+		{&structNested{Y: "q", Q: "announce_peer", A: RequestArg{Id: a.ID(), Info_hash: infoHash, Token: "bad", Port: 6881}}, ErrCodeProtocol},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+		_, err := a.call(ctx, c.msg, addr)
+		cancel()
+		var kerr *KRPCError
+		if !errors.As(err, &kerr) || kerr.Code != c.code {
+			t.Errorf("%v: err = %v, want code %v", c.msg.Q, err, c.code)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	reply, err := a.call(ctx, &structNested{Y: "q", Q: "ping", A: RequestArg{Id: a.ID()}}, addr)
+	if err != nil || reply.R.Id != b.ID() {
+		t.Fatalf("ping: %+v, %v", reply, err)
+	}
+
+	b.connection.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	if _, err := a.call(ctx, &structNested{Y: "q", Q: "ping", A: RequestArg{Id: a.ID()}}, addr); err != ErrTransactionTimeout {
+		t.Fatalf("err = %v, want timeout", err)
+	}
+}
@@ -0,0 +1,195 @@
+package dht
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+var krpcSamples = []*structNested{
+	{T: "aa", Y: "q", Q: "ping", A: RequestArg{Id: strings.Repeat("i", 20)}},
+	{T: "ab", Y: "q", Q: "get_peers", V: clientVersion, A: RequestArg{Id: strings.Repeat("i", 20), Info_hash: strings.Repeat("h", 20), Want: []string{"n4", "n6"}}},
+	{T: "ac", Y: "q", Q: "announce_peer", N: "net", A: RequestArg{Id: strings.Repeat("i", 20), Info_hash: strings.Repeat("h", 20), Token: "tok", Port: 6881, Implied_port: 1}},
+	{T: "ad", Y: "r", R: ResponseInfo{Id: strings.Repeat("i", 20), Token: "tok", Nodes: strings.Repeat("n", 26*8), Values: []string{"123456", "abcdef"}}},
+	{T: "ae", Y: "r", R: ResponseInfo{Id: strings.Repeat("i", 20), Nodes6: strings.Repeat("m", 38*2)}},
+	{T: "af", Y: "e", E: []interface{}{201, "A Generic Error Ocurred"}},
+}
+
+func TestAppendMsg(t *testing.T) {
+	for _, msg := range krpcSamples {
+		want := encodeTestMsg(t, *msg)
+		got, err := appendMsg(nil, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("appendMsg = %q, want %q", got, want)
+		}
+		decoded, err := decodeMsg(got)
+		if err != nil {
+			t.Fatalf("decode %q: %v", got, err)
+		}
+		decoded.raw = ""
+		if msg.E == nil && !reflect.DeepEqual(decoded, msg) {
+			t.Errorf("round trip %+v, want %+v", decoded, msg)
+		}
+	}
+	if _, err := appendMsg(nil, &structNested{T: "aa", Y: "e", E: []interface{}{nil}}); err == nil {
+		t.Error("expected error for nil in e")
+	}
+}
+
+func TestParseMatchesDecode(t *testing.T) {
+	for _, data := range []string{
+		"d1:ai1e1:ai2ee",        // 重复key取最后一个
+		"d1:ald1:bleeee",        // 嵌套
+		"i-0e",                  // bencode-go接受的整数写法
+		"d+1:a0:ejunk",          // 尾部数据忽略
+		"d1:a1:b1:c",            // 缺少结尾
+		"di1e1:ae",              // 非字符串key
+		"d1:ai1e2:xxe",          // dict里value位置的e不是结束符
+		"99999999999999:abc",    // 长度超过数据
+		"-1:",                   // bencode-go会panic
+		"i9223372036854775808e", // 溢出
+	} {
+		compareParse(t, []byte(data))
+	}
+}
+
+// compareParse 检查krpcDecoder和bencode.Decode的结果一致
+func compareParse(t *testing.T, data []byte) {
+	d := getDecoder()
+	defer d.release()
+	err := d.parse(string(data))
+	if err == errStringTooLong || err == errNegativeLength {
+		// bencode-go会按声明的长度分配内存或者panic，只能确认我们拒绝了它
+		return
+	}
+	want, wantErr := bencode.Decode(bytes.NewReader(data))
+	if (err != nil) != (wantErr != nil) {
+		t.Fatalf("parse %q: err = %v, bencode err = %v", data, err, wantErr)
+	}
+	if err != nil {
+		return
+	}
+	if got := d.toInterface(0); !reflect.DeepEqual(got, want) {
+		t.Fatalf("parse %q = %#v, bencode = %#v", data, got, want)
+	}
+}
+
+func FuzzDecodeMsg(f *testing.F) {
+	for _, msg := range krpcSamples {
+		data, _ := appendMsg(nil, msg)
+		f.Add(data)
+	}
+	f.Add([]byte("d1:ad2:id20:iiiiiiiiiiiiiiiiiiiie1:q4:ping2:roi1e1:t2:aa1:y1:qe"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		compareParse(t, data)
+		msg, err := decodeMsg(data)
+		if err == nil {
+			// 校验通过的消息重新编码后应该解出同样的字段
+			again, _ := appendMsg(nil, msg)
+			msg2, err := decodeMsg(again)
+			if err != nil {
+				t.Fatalf("re-decode %q: %v", again, err)
+			}
+			msg.raw, msg2.raw = "", ""
+			msg2.ro = msg.ro
+			if !reflect.DeepEqual(msg, msg2) {
+				t.Fatalf("re-decode %+v, want %+v", msg2, msg)
+			}
+		}
+	})
+}
+
+func FuzzAppendMsg(f *testing.F) {
+	f.Add("aa", "q", "get_peers", strings.Repeat("i", 20), "tok", uint64(6881), uint64(0), "n4", "123456", int64(201), "err")
+	f.Add("", "r", "", "", "", uint64(0), uint64(1), "", "", int64(0), "")
+	f.Fuzz(func(t *testing.T, tid, y, q, id, token string, port, implied uint64, want, value string, code int64, text string) {
+		msg := &structNested{
+			T: tid,
+			Y: y,
+			Q: q,
+			N: token,
+			A: RequestArg{Id: id, Info_hash: id, Token: token, Port: port, Implied_port: implied, Target: q},
+			R: ResponseInfo{Id: id, Token: token, Nodes: value, Nodes6: want},
+		}
+		if want != "" {
+			msg.A.Want = []string{want, value}
+		}
+		if value != "" {
+			msg.R.Values = []string{value}
+		}
+		if code != 0 {
+			msg.E = []interface{}{code, text, uint64(port)}
+		}
+		var buf bytes.Buffer
+		if err := bencode.Marshal(&buf, *msg); err != nil {
+			t.Fatal(err)
+		}
+		got, err := appendMsg(nil, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, buf.Bytes()) {
+			t.Fatalf("appendMsg = %q, bencode = %q", got, buf.Bytes())
+		}
+	})
+}
+
+func BenchmarkDecodeMsg(b *testing.B) {
+	data, _ := appendMsg(nil, krpcSamples[3])
+	b.Run("unmarshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var msg structNested
+			if err := bencode.Unmarshal(bytes.NewReader(data), &msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("decode", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := bencode.Decode(bytes.NewReader(data)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("krpc", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := decodeMsg(data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkEncodeMsg(b *testing.B) {
+	msg := krpcSamples[3]
+	b.Run("marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf := new(bytes.Buffer)
+			if err := bencode.Marshal(buf, *msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("krpc", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			bufp := encodeBufPool.Get().(*[]byte)
+			buf, err := appendMsg((*bufp)[:0], msg)
+			if err != nil {
+				b.Fatal(err)
+			}
+			*bufp = buf[:0]
+			encodeBufPool.Put(bufp)
+		}
+	})
+}
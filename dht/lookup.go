@@ -0,0 +1,266 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zxw/ciligo/logging"
+)
+
+const (
+	lookupAlpha   = 8               // 每轮并发查询的节点数
+	lookupK       = 8               // 最近的k个节点都已查询过则结束
+	lookupTimeout = time.Second * 2 // 每轮等待回包的时间
+	lookupRounds  = 8
+)
+
+var ErrInvalidInfoHash = errors.New("infohash must be 20 bytes")
+
+// lookupState 一次迭代查找的状态，从主路由表取起点，查找结束后丢弃。
+// 同一个target同时只有一个查找在进行，并发的调用方共享它的结果
+type lookupState struct {
+	target  string
+	q       string
+	done    chan struct{}
+	mutex   sync.Mutex
+	peers   map[string]*net.UDPAddr
+	replied []*lookupReply // 回复过的节点，按离target的距离排序
+}
+
+// lookupReply 回复过的节点和它给的token，用于announce_peer
+type lookupReply struct {
+	node  *NodeInfo
+	token string
+}
+
+type lookupGroup struct {
+	mutex   sync.Mutex
+	running map[string]*lookupState
+}
+
+func newLookupGroup() *lookupGroup {
+	return &lookupGroup{
+		running: make(map[string]*lookupState),
+	}
+}
+
+// lookup 发起对target的q查找，已有相同的查找在进行时直接返回它。查找在后台进行，用wait等待结束
+func (client *Client) lookup(q string, target string) *lookupState {
+	key := q + target
+	g := client.lookups
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if st := g.running[key]; st != nil {
+		return st
+	}
+	st := &lookupState{
+		target: target,
+		q:      q,
+		done:   make(chan struct{}),
+		peers:  make(map[string]*net.UDPAddr),
+	}
+	g.running[key] = st
+	go func() {
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout*lookupRounds)
+		client.iterate(ctx, st)
+		cancel()
+		client.stats.observeLookup(q, time.Since(start))
+		g.mutex.Lock()
+		delete(g.running, key)
+		g.mutex.Unlock()
+		close(st.done)
+	}()
+	return st
+}
+
+// wait 等待查找结束，ctx先结束时返回ctx的错误，已查到的结果仍然可用
+func (st *lookupState) wait(ctx context.Context) error {
+	select {
+	case <-st.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// result 已查到的peer
+func (st *lookupState) result() []*net.UDPAddr {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	peers := make([]*net.UDPAddr, 0, len(st.peers))
+	for _, peer := range st.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// closest 回复过的节点中离target最近的k个
+func (st *lookupState) closest(k int) []*lookupReply {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if len(st.replied) > k {
+		return append([]*lookupReply(nil), st.replied[:k]...)
+	}
+	return append([]*lookupReply(nil), st.replied...)
+}
+
+func (st *lookupState) add(node *NodeInfo, reply *structNested) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	for _, peer := range DecodeCompactValues(reply.R.Values) {
+		st.peers[peer.String()] = peer
+	}
+	st.replied = append(st.replied, &lookupReply{
+		node:  &NodeInfo{ID: reply.R.Id, addr: node.addr},
+		token: reply.R.Token,
+	})
+	sort.SliceStable(st.replied, func(i, j int) bool {
+		return xorLess(st.target, st.replied[i].node.ID, st.replied[j].node.ID)
+	})
+}
+
+// GetPeers 对infoHash做一次迭代的get_peers查询，返回查到的peer地址
+func (client *Client) GetPeers(ctx context.Context, infoHash string) ([]*net.UDPAddr, error) {
+	if len(infoHash) != 20 {
+		return nil, ErrInvalidInfoHash
+	}
+	st := client.lookup("get_peers", infoHash)
+	err := st.wait(ctx)
+	peers := st.result()
+	if len(peers) == 0 && err != nil {
+		return nil, err
+	}
+	return peers, nil
+}
+
+// findNode 对target做一次迭代的find_node查询，回复里的节点由processMsg加入路由表
+func (client *Client) findNode(ctx context.Context, target string) {
+	client.lookup("find_node", target).wait(ctx)
+}
+
+// iterate 从离target最近的节点开始迭代查询，每轮用回复里的节点更新候选
+func (client *Client) iterate(ctx context.Context, st *lookupState) {
+	candidates := client.lookupSeeds(st.target)
+	queried := make(map[string]bool)
+	for round := 0; round < lookupRounds && ctx.Err() == nil; round++ {
+		// 在最近的2k个节点里按健康度挑选本轮查询的节点
+		var batch []*NodeInfo
+		for i := 0; i < len(candidates) && i < lookupK*2; i++ {
+			key := candidates[i].addr.String()
+			if !queried[key] {
+				queried[key] = true
+				batch = append(batch, candidates[i])
+			}
+		}
+		client.health.sortByScore(batch)
+		if len(batch) > lookupAlpha {
+			for _, node := range batch[lookupAlpha:] {
+				delete(queried, node.addr.String())
+			}
+			batch = batch[:lookupAlpha]
+		}
+		if len(batch) == 0 {
+			break
+		}
+		replies := client.queryAll(ctx, batch, func(*NodeInfo) *structNested {
+			msg := &structNested{
+				Y: "q",
+				Q: st.q,
+				A: RequestArg{
+					Id:   client.ID(),
+					Want: client.want,
+				},
+			}
+			if st.q == "find_node" {
+				msg.A.Target = st.target
+			} else {
+				msg.A.Info_hash = st.target
+			}
+			return msg
+		})
+		for _, reply := range replies {
+			st.add(reply.node, reply.msg)
+			candidates = append(candidates, client.filterNodes(DecodeCompactNodesInfo(reply.msg.R.Nodes))...)
+			candidates = append(candidates, client.filterNodes(DecodeCompactNodesInfo(reply.msg.R.Nodes6))...)
+		}
+		sortByDistance(st.target, candidates)
+	}
+}
+
+type queryReply struct {
+	node *NodeInfo
+	msg  *structNested
+}
+
+// queryAll 并发向nodes发请求，等待回包直到全部返回或本轮超时
+func (client *Client) queryAll(ctx context.Context, nodes []*NodeInfo, newMsg func(*NodeInfo) *structNested) []queryReply {
+	replies := make(chan *structNested, len(nodes))
+	sent := make(map[string]*NodeInfo, len(nodes))
+	var cancels []func()
+	for _, node := range nodes {
+		msg := newMsg(node)
+		cancel, err := client.query(msg, node.addr, replies)
+		if err != nil {
+			continue
+		}
+		sent[msg.T] = node
+		cancels = append(cancels, cancel)
+	}
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}()
+	timer := time.NewTimer(lookupTimeout)
+	defer timer.Stop()
+	// 每个回包都算一次返回，错误和对不上的回包不计入结果，但不能让本轮一直等到超时
+	var result []queryReply
+	for waiting := len(sent); waiting > 0; {
+		select {
+		case msg := <-replies:
+			waiting--
+			node := sent[msg.T]
+			if err := msg.Err(); err != nil {
+				if logger.Packet() {
+					logger.Packetw("lookup query failed", logging.Tx(msg.T), logging.Err(err))
+				}
+			} else if node != nil {
+				delete(sent, msg.T)
+				result = append(result, queryReply{node: node, msg: msg})
+			}
+		case <-timer.C:
+			return result
+		case <-ctx.Done():
+			return result
+		}
+	}
+	return result
+}
+
+// lookupSeeds 从路由表里取离target最近的节点作为查询起点，路由表为空时用启动节点
+func (client *Client) lookupSeeds(target string) []*NodeInfo {
+	client.mutex.RLock()
+	var nodes []*NodeInfo
+	for _, buck := range client.table.buckets {
+		nodes = append(nodes, buck...)
+	}
+	client.mutex.RUnlock()
+	if len(nodes) == 0 {
+		for _, addr := range client.bootstrap.addrs(client.network) {
+			nodes = append(nodes, &NodeInfo{addr: addr})
+		}
+	}
+	sortByDistance(target, nodes)
+	return nodes
+}
+
+func sortByDistance(target string, nodes []*NodeInfo) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return xorLess(target, nodes[i].ID, nodes[j].ID)
+	})
+}
@@ -0,0 +1,59 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSharedLookup(t *testing.T) {
+	a := startTestClient(t, "lab", "")
+	b := startTestClient(t, "lab", "127.0.0.1:"+strings.Split(a.connection.LocalAddr().String(), ":")[1])
+	infoHash := strings.Repeat("h", 20)
+	peer := &net.TCPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 6881}
+	a.PeerStore().Add(infoHash, peer)
+
+	// 同时发起的查找共享同一个状态
+	st := b.lookup("get_peers", infoHash)
+	if b.lookup("get_peers", infoHash) != st {
+		t.Fatal("concurrent lookups should share state")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	peers, err := b.GetPeers(ctx, infoHash)
+	if err != nil || len(peers) != 1 || peers[0].String() != peer.String() {
+		t.Fatalf("peers = %v, err = %v", peers, err)
+	}
+	if closest := st.closest(lookupK); len(closest) != 1 || closest[0].node.ID != a.ID() || closest[0].token == "" {
+		t.Fatalf("replied = %+v", closest)
+	}
+	<-st.done
+	if b.lookup("get_peers", infoHash) == st {
+		t.Fatal("finished lookup should be discarded")
+	}
+}
+
+func TestQueryAll(t *testing.T) {
+	a := startTestClient(t, "lab", "")
+	b := startTestClient(t, "lab", "")
+	nodes := []*NodeInfo{
+		{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: a.connection.LocalAddr().(*net.UDPAddr).Port}},
+		{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: a.connection.LocalAddr().(*net.UDPAddr).Port}},
+	}
+	// 一个正常回复，一个回复错误，全部返回后不等到本轮超时
+	start := time.Now()
+	replies := b.queryAll(context.Background(), nodes, func(node *NodeInfo) *structNested {
+		if node == nodes[1] {
+			return &structNested{Y: "q", Q: "bogus", A: RequestArg{Id: b.ID()}}
+		}
+		return &structNested{Y: "q", Q: "ping", A: RequestArg{Id: b.ID()}}
+	})
+	if len(replies) != 1 || replies[0].node != nodes[0] {
+		t.Fatalf("replies = %+v", replies)
+	}
+	if elapsed := time.Since(start); elapsed >= lookupTimeout {
+		t.Fatalf("queryAll waited %v", elapsed)
+	}
+}
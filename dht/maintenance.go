@@ -0,0 +1,126 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/zeromicro/go-zero/core/logx"
+)
+
+// 路由表维护(bep-005)：
+// 1、节点数不足时重新bootstrap并查找自己的id
+// 2、超过15分钟没有变化的桶，查找桶范围内的随机id
+// 3、超过15分钟没有直接联系过的节点是可疑节点，ping一次，连续不回复的由nodeHealth删除
+
+const (
+	bucketRefresh    = time.Minute * 15
+	questionableAge  = time.Minute * 15
+	pingInterval     = time.Minute // 同一个可疑节点两次ping的最小间隔
+	maintainInterval = time.Second * 5
+	maxPingsPerRound = 32
+	refreshTimeout   = time.Second * 30
+)
+
+func (client *Client) maintain() {
+	ticker := time.NewTicker(maintainInterval)
+	for {
+		client.maintainOnce(time.Now())
+		<-ticker.C
+	}
+}
+
+func (client *Client) maintainOnce(now time.Time) {
+	total := client.NodeCount()
+	if total < client.bootstrap.minNodes {
+		client.rebootstrap(false)
+	}
+	addrs := client.questionable(now)
+	for _, addr := range addrs {
+		client.sendPing(addr)
+	}
+	// 同时只做一个刷新查找，避免占满发包预算
+	if !atomic.CompareAndSwapInt32(&client.refreshing, 0, 1) {
+		return
+	}
+	target, dis := client.ID(), 0
+	if total >= client.bootstrap.minNodes {
+		var ok bool
+		if dis, ok = client.staleBucket(now); !ok {
+			atomic.StoreInt32(&client.refreshing, 0)
+			return
+		}
+		target = randomIDInBucket(client.ID(), dis)
+	}
+	logger.Debugw("maintain", logx.Field("nodes", total), logx.Field("pings", len(addrs)), logx.Field("bucket", dis))
+	go func() {
+		defer atomic.StoreInt32(&client.refreshing, 0)
+		ctx, cancel := context.WithTimeout(context.Background(), refreshTimeout)
+		defer cancel()
+		client.findNode(ctx, target)
+		if dis > 0 {
+			client.touchBucket(dis, time.Now())
+		}
+	}()
+}
+
+// questionable 需要ping的节点，同时记录ping的时间
+func (client *Client) questionable(now time.Time) []*net.UDPAddr {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	var addrs []*net.UDPAddr
+	for _, buck := range client.table.buckets {
+		for _, node := range buck {
+			if len(addrs) >= maxPingsPerRound {
+				return addrs
+			}
+			if now.Sub(node.seen) > questionableAge && now.Sub(node.pinged) > pingInterval {
+				node.pinged = now
+				addrs = append(addrs, node.addr)
+			}
+		}
+	}
+	return addrs
+}
+
+// staleBucket 最久没有变化且超过刷新时间的桶。只考虑最近的非空桶以外的桶，更近的桶由查找自己覆盖
+func (client *Client) staleBucket(now time.Time) (int, bool) {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+	table := client.table
+	nearest := 0
+	for dis, buck := range table.buckets {
+		if len(buck) > 0 && (nearest == 0 || dis < nearest) {
+			nearest = dis
+		}
+	}
+	if nearest == 0 {
+		return 0, false
+	}
+	stale, oldest := 0, now
+	for dis := nearest; dis <= 160; dis++ {
+		if touched := table.touched[dis]; now.Sub(touched) > bucketRefresh && touched.Before(oldest) {
+			stale, oldest = dis, touched
+		}
+	}
+	return stale, stale > 0
+}
+
+func (client *Client) touchBucket(dis int, now time.Time) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.table.touched[dis] = now
+}
+
+// randomIDInBucket 生成和id距离为dis的随机id：前160-dis位相同，下一位相反，其余随机
+func randomIDInBucket(id string, dis int) string {
+	target := []byte(randomString(20))
+	bit := 160 - dis
+	copy(target, id[:bit/8])
+	i, shift := bit/8, uint(bit%8)
+	keep := byte(0xff) << (8 - shift)
+	flip := byte(0x80) >> shift
+	target[i] = id[i]&keep | (id[i]^flip)&flip | target[i]&^(keep|flip)
+	return string(target)
+}
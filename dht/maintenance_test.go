@@ -0,0 +1,57 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRandomIDInBucket(t *testing.T) {
+	id := randomString(20)
+	for dis := 1; dis <= 160; dis++ {
+		for i := 0; i < 8; i++ {
+			if got := calcDistance(id, randomIDInBucket(id, dis)); got != dis {
+				t.Fatalf("distance = %v, want %v", got, dis)
+			}
+		}
+	}
+}
+
+func TestMaintainSchedule(t *testing.T) {
+	client := NewClient("0", "", "4")
+	now := time.Now()
+	if _, ok := client.staleBucket(now); ok {
+		t.Fatal("empty table should not refresh buckets")
+	}
+	near := randomIDInBucket(client.ID(), 150)
+	far := randomIDInBucket(client.ID(), 160)
+	client.UpdateRecvTable(&NodeInfo{ID: far, addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}, seen: now})
+	client.UpdateRecvTable(&NodeInfo{ID: near, addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6881}})
+
+	// 150以外从未变化过的桶需要刷新，最先选到的是150和160之间最久没变化的
+	dis, ok := client.staleBucket(now)
+	if !ok || dis <= 150 || dis >= 160 {
+		t.Fatalf("stale bucket = %v, %v", dis, ok)
+	}
+	for d := 150; d <= 160; d++ {
+		client.touchBucket(d, now)
+	}
+	if _, ok := client.staleBucket(now.Add(time.Minute)); ok {
+		t.Fatal("recently touched buckets should not refresh")
+	}
+	if dis, _ := client.staleBucket(now.Add(bucketRefresh + time.Second)); dis < 150 {
+		t.Fatalf("stale bucket = %v", dis)
+	}
+
+	// 只有没直接联系过的near需要ping，一分钟内不重复
+	addrs := client.questionable(now)
+	if len(addrs) != 1 || addrs[0].IP.String() != "10.0.0.2" {
+		t.Fatalf("questionable = %v", addrs)
+	}
+	if len(client.questionable(now.Add(time.Second))) != 0 {
+		t.Fatal("pinged too often")
+	}
+	if len(client.questionable(now.Add(questionableAge+time.Second))) != 2 {
+		t.Fatal("stale nodes should be pinged")
+	}
+}
@@ -0,0 +1,61 @@
+package dht
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// 测试不访问外网
+	RemoteIPProbe = nil
+	os.Exit(m.Run())
+}
+
+func startTestClient(t *testing.T, networkID string, bootstrap string) *Client {
+	// id由端口生成，每个节点需要不同的端口
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+	client := NewClient(strconv.Itoa(port), "", "4")
+	client.SetNetworkID(networkID)
+	client.SetBootstrap([]string{bootstrap})
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.connection.Close() })
+	return client
+}
+
+func TestPrivateNetwork(t *testing.T) {
+	a := startTestClient(t, "lab", "")
+	addr := a.connection.LocalAddr().String()
+	b := startTestClient(t, "lab", addr)
+	startTestClient(t, "", addr)
+	startTestClient(t, "other", addr)
+
+	deadline := time.Now().Add(time.Second * 3)
+	for b.NodeCount() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 20)
+	}
+	time.Sleep(time.Millisecond * 200)
+	// 只有同一网络的b进入a的路由表，b也只认识a
+	if n := a.NodeCount(); n != 1 {
+		t.Fatalf("a nodes = %v, want 1", n)
+	}
+	if n := b.NodeCount(); n != 1 {
+		t.Fatalf("b nodes = %v, want 1", n)
+	}
+	for _, h := range a.BootstrapStatus() {
+		for _, prime := range PrimeNodes {
+			if h.Host == prime {
+				t.Fatalf("private network should not use %v", prime)
+			}
+		}
+	}
+}
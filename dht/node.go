@@ -3,13 +3,18 @@ package dht
 import (
 	"net"
 	"strings"
+	"time"
 
-	"github.com/zeromicro/go-zero/core/logx"
+	"github.com/zxw/ciligo/logging"
 )
 
 type NodeInfo struct {
 	ID   string
 	addr *net.UDPAddr
+	// 节点最近一次直接联系我们(请求或回复)的时间，从nodes里得知的节点为零值
+	seen time.Time
+	// 最近一次ping的时间
+	pinged time.Time
 }
 
 // DHT IPV6 格式
@@ -53,7 +58,9 @@ func DecodeCompactNodeInfo(compactNodeInfo string) (*NodeInfo, error) {
 	}
 	addr, err := net.ResolveUDPAddr(ipType, genAddress(ip, port))
 	if err != nil {
-		logx.Infof("DecodeCompactNodeInfo ipType=%v err=%v", ipType, err)
+		if logger.Packet() {
+			logger.Packetw("decode compact node failed", logging.Err(err))
+		}
 		return nil, err
 	}
 	return &NodeInfo{ID: id, addr: addr}, nil
@@ -77,7 +84,9 @@ func DecodeCompactValues(nodes []string) []*net.UDPAddr {
 		}
 		addr, err := net.ResolveUDPAddr(ipType, genAddress(ip, port))
 		if err != nil {
-			logx.Infof("DecodeCompactNodeInfo ipType=%v err=%v", ipType, err)
+			if logger.Packet() {
+				logger.Packetw("decode compact peer failed", logging.Err(err))
+			}
 			continue
 		}
 		nodesInfo = append(nodesInfo, addr)
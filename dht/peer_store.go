@@ -0,0 +1,225 @@
+package dht
+
+import (
+	"crypto/sha1"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	peerTTL        = time.Minute * 30 // announce超过这个时间没有更新就过期
+	maxPeersPerKey = 500
+	maxValues      = 50 // get_peers回复里最多的peer数，避免超过udp包大小
+	tokenRotate    = time.Minute * 5
+)
+
+// PeerStore 保存announce_peer和tracker announce通告的peer，用于回复get_peers和tracker请求
+type PeerStore struct {
+	mutex     sync.RWMutex
+	peers     map[string]map[string]*peerEntry // infohash -> ip:port
+	completed map[string]int                   // tracker上报完成下载的次数
+}
+
+type peerEntry struct {
+	addr *net.TCPAddr
+	seen time.Time
+	seed bool
+}
+
+func NewPeerStore() *PeerStore {
+	return &PeerStore{
+		peers:     make(map[string]map[string]*peerEntry),
+		completed: make(map[string]int),
+	}
+}
+
+// Add 记录peer，已有的peer只更新时间，不改变是否做种
+func (s *PeerStore) Add(infoHash string, addr *net.TCPAddr) {
+	s.add(infoHash, addr, nil)
+}
+
+// Announce tracker的announce，left为0的是做种者
+func (s *PeerStore) Announce(infoHash string, addr *net.TCPAddr, seed bool) {
+	s.add(infoHash, addr, &seed)
+}
+
+func (s *PeerStore) add(infoHash string, addr *net.TCPAddr, seed *bool) {
+	if len(infoHash) != 20 || addr == nil || addr.Port == 0 {
+		return
+	}
+	key := addr.String()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entries := s.peers[infoHash]
+	if entries == nil {
+		entries = make(map[string]*peerEntry)
+		s.peers[infoHash] = entries
+	}
+	e := entries[key]
+	if e == nil {
+		if len(entries) >= maxPeersPerKey {
+			return
+		}
+		e = &peerEntry{addr: addr}
+		entries[key] = e
+	}
+	e.seen = time.Now()
+	if seed != nil {
+		e.seed = *seed
+	}
+}
+
+// Remove tracker收到stopped时删除peer
+func (s *PeerStore) Remove(infoHash string, addr *net.TCPAddr) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if entries := s.peers[infoHash]; entries != nil {
+		delete(entries, addr.String())
+	}
+}
+
+// Completed tracker收到completed时计数
+func (s *PeerStore) Completed(infoHash string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.peers[infoHash] != nil {
+		s.completed[infoHash]++
+	}
+}
+
+// Stats 未过期的做种数、下载数和完成次数
+func (s *PeerStore) Stats(infoHash string) (seeders, leechers, completed int) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, e := range s.peers[infoHash] {
+		if time.Since(e.seen) >= peerTTL {
+			continue
+		}
+		if e.seed {
+			seeders++
+		} else {
+			leechers++
+		}
+	}
+	return seeders, leechers, s.completed[infoHash]
+}
+
+// Get 返回最多max个未过期的peer
+func (s *PeerStore) Get(infoHash string, max int) []*net.TCPAddr {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var peers []*net.TCPAddr
+	for _, e := range s.peers[infoHash] {
+		if len(peers) >= max {
+			break
+		}
+		if time.Since(e.seen) < peerTTL {
+			peers = append(peers, e.addr)
+		}
+	}
+	return peers
+}
+
+// Count 未过期的peer数
+func (s *PeerStore) Count(infoHash string) int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	n := 0
+	for _, e := range s.peers[infoHash] {
+		if time.Since(e.seen) < peerTTL {
+			n++
+		}
+	}
+	return n
+}
+
+// Len 保存的infohash数
+func (s *PeerStore) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.peers)
+}
+
+// Expire 删除过期的peer
+func (s *PeerStore) Expire() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for infoHash, entries := range s.peers {
+		for key, e := range entries {
+			if time.Since(e.seen) >= peerTTL {
+				delete(entries, key)
+			}
+		}
+		if len(entries) == 0 {
+			delete(s.peers, infoHash)
+			delete(s.completed, infoHash)
+		}
+	}
+}
+
+// token由ip和定期轮换的secret生成，上一个secret生成的token仍然有效
+type tokenManager struct {
+	mutex   sync.Mutex
+	secret  string
+	prev    string
+	rotated time.Time
+}
+
+func newTokenManager() *tokenManager {
+	return &tokenManager{
+		secret:  randomString(20),
+		prev:    randomString(20),
+		rotated: time.Now(),
+	}
+}
+
+func (m *tokenManager) rotate() {
+	if time.Since(m.rotated) > tokenRotate {
+		m.prev = m.secret
+		m.secret = randomString(20)
+		m.rotated = time.Now()
+	}
+}
+
+func (m *tokenManager) token(ip net.IP) string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.rotate()
+	return makeToken(m.secret, ip)
+}
+
+func (m *tokenManager) valid(token string, ip net.IP) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.rotate()
+	return token == makeToken(m.secret, ip) || token == makeToken(m.prev, ip)
+}
+
+func makeToken(secret string, ip net.IP) string {
+	h := sha1.Sum(append([]byte(secret), ip...))
+	return string(h[:8])
+}
+
+// encodePeers 把peer编码成get_peers回复的values，ipv4为6字节，ipv6为18字节
+func encodePeers(peers []*net.TCPAddr) []string {
+	values := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		ip := peer.IP.To4()
+		if ip == nil {
+			ip = peer.IP.To16()
+		}
+		if ip == nil {
+			continue
+		}
+		values = append(values, string(append(append([]byte(nil), ip...), byte(peer.Port>>8), byte(peer.Port))))
+	}
+	return values
+}
+
+func (client *Client) expirePeers() {
+	ticker := time.NewTicker(tokenRotate)
+	for range ticker.C {
+		client.peers.Expire()
+	}
+}
@@ -1,11 +1,11 @@
 package dht
 
 import (
-	"bytes"
 	"net"
+	"time"
 
-	bencode "github.com/jackpal/bencode-go"
 	"github.com/zeromicro/go-zero/core/logx"
+	"github.com/zxw/ciligo/logging"
 )
 
 // bencode有4种数据类型:string,integer,list和dictionary。
@@ -142,6 +142,14 @@ type structNested struct {
 	R ResponseInfo  `bencode:"r,omitempty"`
 	E []interface{} `bencode:"e,omitempty"`
 	//当一个请求不能解析或出错时，错误包将被发送。
+	N string `bencode:"n,omitempty"`
+	// 私有网络标识，不在mainline协议中，公网节点会忽略它
+	V string `bencode:"v,omitempty"`
+	// 客户端版本，2字节客户端标识+2字节版本号
+	raw string `bencode:"-"`
+	// 解码时的原始报文
+	ro bool `bencode:"-"`
+	// bep-043只读标记
 }
 
 // ping Query = {"t":"aa", "y":"q", "q":"ping", "a":{"id":"abcdefghij0123456789"}}
@@ -154,10 +162,14 @@ func (client *Client) sendPing(addr *net.UDPAddr) error {
 			Id: client.ID(),
 		},
 	}
-	logx.Infof("sendPing:%v,t:%v", addr, msg.T)
 	return client.sendMsg(msg, addr)
 }
 
+// Ping 探测一个可能的dht节点，有回复时加入路由表，用于LSD等途径发现的地址
+func (client *Client) Ping(addr *net.UDPAddr) error {
+	return client.sendPing(addr)
+}
+
 // Response = {"t":"aa", "y":"r", "r": {"id":"mnopqrstuvwxyz123456"}}
 func (client *Client) sendPingResp(resp *structNested, addr *net.UDPAddr) error {
 	resp.R.Id = client.ID()
@@ -177,7 +189,6 @@ func (client *Client) sendFindNode(Target string, addr *net.UDPAddr) error {
 			Want:   client.want,
 		},
 	}
-	logx.Infof("sendFindNode:%v,t:%v", addr, msg.T)
 	return client.sendMsg(msg, addr)
 }
 
@@ -199,36 +210,16 @@ func (client *Client) sendGetPeer(Info_hash string, addr *net.UDPAddr) error {
 			Want:      client.want,
 		},
 	}
-	logx.Infof("sendGetPeer:%v,t:%v", addr, msg.T)
 	return client.sendMsg(msg, addr)
 }
 
 // Response with peers = {"t":"aa", "y":"r", "r": {"id":"abcdefghij0123456789", "token":"aoeusnth", "values": ["axje.u", "idhtnm"]}}
 // Response with nodes = {"t":"aa", "y":"r", "r": {"id":"abcdefghij0123456789", "token":"aoeusnth", "nodes": "def456..."}}
 func (client *Client) sendGetPeerResp(resp *structNested, addr *net.UDPAddr) error {
-	logx.Infof("get_peers reply my addr:%+v", client.peerInfo.addr.String())
 	resp.R.Id = client.ID()
 	return client.sendMsg(resp, addr)
 }
 
-// announce_peers Query = {"t":"aa", "y":"q", "q":"announce_peer", "a": {"id":"abcdefghij0123456789", "implied_port": 1, "info_hash":"mnopqrstuvwxyz123456", "port": 6881, "token": "aoeusnth"}}
-func (client *Client) sendAnnouncePeer(addr *net.UDPAddr) error {
-	msg := &structNested{
-		T: randomTranssionId(),
-		Y: "q",
-		Q: "announce_peer",
-		A: RequestArg{
-			Id:           client.ID(),
-			Token:        randomString(20),
-			Info_hash:    randomString(20),
-			Port:         8080,
-			Implied_port: 1,
-		},
-	}
-	logx.Infof("sendAnnouncePeer:%v,t:%v", addr, msg.T)
-	return client.sendMsg(msg, addr)
-}
-
 // Response = {"t":"aa", "y":"r", "r": {"id":"mnopqrstuvwxyz123456"}}
 func (client *Client) sendAnnouncePeerResp(resp *structNested, addr *net.UDPAddr) error {
 	resp.R.Id = client.ID()
@@ -236,13 +227,13 @@ func (client *Client) sendAnnouncePeerResp(resp *structNested, addr *net.UDPAddr
 }
 
 // generic error = {"t":"aa", "y":"e", "e":[201, "A Generic Error Ocurred"]}
-func (client *Client) sendError(addr *net.UDPAddr) error {
+// sendError 用请求原来的t回复错误
+func (client *Client) sendError(t string, kerr *KRPCError, addr *net.UDPAddr) error {
 	msg := &structNested{
-		T: randomTranssionId(),
+		T: t,
 		Y: "e",
-		E: []interface{}{201, "A Generic Error Ocurred"},
+		E: []interface{}{kerr.Code, kerr.Message},
 	}
-	logx.Infof("sendError:%v,t:%v", addr, msg.T)
 	return client.sendMsg(msg, addr)
 }
 
@@ -260,15 +251,38 @@ func (client *Client) sendMsg(msg *structNested, addr *net.UDPAddr) error {
 	// key := tag.Get("bencode")
 	// logx.Infof("key:%v", key)
 	// logx.Infof("tag:%v", tag)
-	buf := new(bytes.Buffer)
-	err := bencode.Marshal(buf, *msg)
+	msg.N = client.networkID
+	msg.V = clientVersion
+	bufp := encodeBufPool.Get().(*[]byte)
+	buf, err := appendMsg((*bufp)[:0], msg)
+	defer func() {
+		if cap(buf) <= maxPooledBuf {
+			*bufp = buf[:0]
+			encodeBufPool.Put(bufp)
+		}
+	}()
 	if err != nil {
-		logx.Infof("Marshal err:%v", err)
+		logger.Errorw("encode failed", logging.Query(msg.Q), logging.Err(err))
+		return err
+	}
+	if err := client.limiter.wait(msg); err != nil {
 		return err
 	}
-	n, err := client.connection.WriteToUDP(buf.Bytes(), addr)
+	if msg.Y == "q" && client.health.onQuery(addr, time.Now()) {
+		logger.Debugw("evict node", logging.Addr(addr), logx.Field("timeouts", maxNodeFailures))
+		client.removeNode(addr.String())
+	}
+	n, err := client.connection.WriteToUDP(buf, addr)
 	if err != nil {
-		logx.Infof("WriteToUDP n:%v,err:%v", n, err)
+		client.limiter.onError()
+		if logger.Packet() {
+			logger.Packetw("send failed", logging.Addr(addr), logging.Err(err))
+		}
+		return err
+	}
+	if logger.Packet() {
+		logger.Packetw("send", logging.Addr(addr), logging.Tx(msg.T), logx.Field("y", msg.Y), logging.Query(msg.Q), logx.Field("bytes", n))
 	}
-	return err
+	client.stats.sent.add(msg)
+	return nil
 }
@@ -0,0 +1,235 @@
+package dht
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/zeromicro/go-zero/core/logx"
+)
+
+const (
+	maxSendWait    = time.Second * 2 // 请求排队超过这个时间就丢弃
+	adjustInterval = time.Second
+	maxSlowdown    = 16
+	// 超时率：dht里不回复的节点本来就多，只有明显高于平常时才认为是本地网络拥塞
+	timeoutSlowRatio    = 0.85
+	timeoutRecoverRatio = 0.6
+	minTimeoutSamples   = 20      // 一个窗口内有回复或超时的请求少于这个数时不按超时率调整
+	replyKey            = "reply" // 回复和错误包共用一个预算
+)
+
+var ErrRateLimited = errors.New("send rate limited")
+
+// RateConfig 发包速率，单位为每秒包数，0表示不限
+type RateConfig struct {
+	Global   float64            // 所有包
+	PerQuery map[string]float64 // 按请求类型，回复使用reply
+	// 突发时间窗口，桶容量 = 速率*Burst，越小发包越平滑
+	Burst time.Duration
+}
+
+func DefaultRateConfig() RateConfig {
+	return RateConfig{
+		Global: 300,
+		PerQuery: map[string]float64{
+			"ping":          20,
+			"find_node":     60,
+			"get_peers":     150,
+			"announce_peer": 20,
+			replyKey:        200,
+		},
+		Burst: time.Millisecond * 100,
+	}
+}
+
+// RateStats 发包统计
+type RateStats struct {
+	Sent     uint64
+	Dropped  uint64
+	Errors   uint64  // 发送失败
+	Replies  uint64  // 请求收到回复
+	Timeouts uint64  // 请求到调用方放弃时还没有回复
+	Slowdown float64 // 当前降速倍数，1为不降速
+}
+
+// tokenBucket 令牌可以预支，预支的部分就是需要等待的时间
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, window time.Duration) *tokenBucket {
+	burst := rate * window.Seconds()
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve 取一个令牌，返回需要等待的时间。slowdown>1时按比例降低速率
+func (b *tokenBucket) reserve(now time.Time, slowdown float64) time.Duration {
+	rate := b.rate / slowdown
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+func (b *tokenBucket) cancel() {
+	b.tokens++
+}
+
+// sendLimiter 在sendMsg之前排队，按发送错误率和请求超时率自动降速。
+// 没有打开IP_RECVERR时linux不会把icmp不可达报告给udp socket，所以不依赖icmp
+type sendLimiter struct {
+	mutex    sync.Mutex
+	global   *tokenBucket
+	perQuery map[string]*tokenBucket
+	stats    RateStats
+	// 当前统计窗口
+	windowStart    time.Time
+	windowSent     int
+	windowErrs     int
+	windowReplies  int
+	windowTimeouts int
+}
+
+func newSendLimiter(conf RateConfig) *sendLimiter {
+	l := &sendLimiter{
+		perQuery:    make(map[string]*tokenBucket),
+		windowStart: time.Now(),
+	}
+	l.stats.Slowdown = 1
+	if conf.Global > 0 {
+		l.global = newTokenBucket(conf.Global, conf.Burst)
+	}
+	for key, rate := range conf.PerQuery {
+		if rate > 0 {
+			l.perQuery[key] = newTokenBucket(rate, conf.Burst)
+		}
+	}
+	return l
+}
+
+// wait 请求最多排队maxSendWait，回复不排队，超过预算直接丢弃
+func (l *sendLimiter) wait(msg *structNested) error {
+	key := replyKey
+	if msg.Y == "q" {
+		key = msg.Q
+	}
+	l.mutex.Lock()
+	now := time.Now()
+	l.adjust(now)
+	var delay time.Duration
+	buckets := make([]*tokenBucket, 0, 2)
+	for _, b := range []*tokenBucket{l.perQuery[key], l.global} {
+		if b == nil {
+			continue
+		}
+		buckets = append(buckets, b)
+		if d := b.reserve(now, l.stats.Slowdown); d > delay {
+			delay = d
+		}
+	}
+	if delay > maxSendWait || (delay > 0 && key == replyKey) {
+		for _, b := range buckets {
+			b.cancel()
+		}
+		l.stats.Dropped++
+		l.mutex.Unlock()
+		return ErrRateLimited
+	}
+	l.stats.Sent++
+	l.windowSent++
+	l.mutex.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	return nil
+}
+
+// onError 发送失败
+func (l *sendLimiter) onError() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.stats.Errors++
+	l.windowErrs++
+}
+
+// onReply 请求收到回复
+func (l *sendLimiter) onReply() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.stats.Replies++
+	l.windowReplies++
+}
+
+// onTimeout 请求没有等到回复
+func (l *sendLimiter) onTimeout() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.stats.Timeouts++
+	l.windowTimeouts++
+}
+
+// adjust 每秒调整降速倍数：发送错误率超过5%或超时率超过timeoutSlowRatio时加倍，
+// 两者都恢复正常后逐步恢复
+func (l *sendLimiter) adjust(now time.Time) {
+	if now.Sub(l.windowStart) < adjustInterval {
+		return
+	}
+	slow, speedUp := false, true
+	if l.windowSent > 0 {
+		ratio := float64(l.windowErrs) / float64(l.windowSent)
+		slow = ratio > 0.05
+		speedUp = ratio < 0.01
+	}
+	if resolved := l.windowReplies + l.windowTimeouts; resolved >= minTimeoutSamples {
+		ratio := float64(l.windowTimeouts) / float64(resolved)
+		slow = slow || ratio > timeoutSlowRatio
+		speedUp = speedUp && ratio < timeoutRecoverRatio
+	}
+	slowdown := l.stats.Slowdown
+	if slow {
+		slowdown *= 2
+	} else if speedUp && l.windowSent > 0 {
+		slowdown *= 0.8
+	}
+	if slowdown > maxSlowdown {
+		slowdown = maxSlowdown
+	}
+	if slowdown < 1 {
+		slowdown = 1
+	}
+	if slowdown != l.stats.Slowdown {
+		logger.Infow("send slowdown", logx.Field("from", l.stats.Slowdown), logx.Field("to", slowdown),
+			logx.Field("sent", l.windowSent), logx.Field("errors", l.windowErrs),
+			logx.Field("replies", l.windowReplies), logx.Field("timeouts", l.windowTimeouts))
+		l.stats.Slowdown = slowdown
+	}
+	l.windowStart = now
+	l.windowSent = 0
+	l.windowErrs = 0
+	l.windowReplies = 0
+	l.windowTimeouts = 0
+}
+
+// SetRateLimit 设置发包速率，需在Start之前调用
+func (client *Client) SetRateLimit(conf RateConfig) {
+	client.limiter = newSendLimiter(conf)
+}
+
+func (client *Client) RateStats() RateStats {
+	client.limiter.mutex.Lock()
+	defer client.limiter.mutex.Unlock()
+	return client.limiter.stats
+}
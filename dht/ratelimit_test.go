@@ -0,0 +1,95 @@
+package dht
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSendLimiterPacing(t *testing.T) {
+	l := newSendLimiter(RateConfig{
+		PerQuery: map[string]float64{"ping": 100},
+		Burst:    time.Millisecond * 10,
+	})
+	start := time.Now()
+	for i := 0; i < 21; i++ {
+		if err := l.wait(&structNested{Y: "q", Q: "ping"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 桶容量为1，其余20个按10ms间隔发出
+	if elapsed := time.Since(start); elapsed < time.Millisecond*180 {
+		t.Fatalf("elapsed %v, expected pacing", elapsed)
+	}
+	// 其他类型不受ping的预算影响
+	start = time.Now()
+	l.wait(&structNested{Y: "q", Q: "find_node"})
+	if time.Since(start) > time.Millisecond*5 {
+		t.Fatal("find_node should not wait")
+	}
+}
+
+func TestSendLimiterDropsReplies(t *testing.T) {
+	l := newSendLimiter(RateConfig{Global: 10, Burst: time.Millisecond * 100})
+	reply := &structNested{Y: "r"}
+	if err := l.wait(reply); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.wait(reply); err != ErrRateLimited {
+		t.Fatalf("err = %v, want ErrRateLimited", err)
+	}
+	if l.stats.Dropped != 1 || l.stats.Sent != 1 {
+		t.Fatalf("unexpected stats %+v", l.stats)
+	}
+}
+
+func TestSendLimiterSlowdown(t *testing.T) {
+	l := newSendLimiter(RateConfig{})
+	l.windowSent = 10
+	l.windowErrs = 5
+	l.adjust(time.Now().Add(adjustInterval))
+	if l.stats.Slowdown != 2 {
+		t.Fatalf("slowdown = %v, want 2", l.stats.Slowdown)
+	}
+	l.windowSent = 100
+	l.adjust(time.Now().Add(adjustInterval * 2))
+	if l.stats.Slowdown >= 2 {
+		t.Fatalf("slowdown = %v, expected recovery", l.stats.Slowdown)
+	}
+}
+
+func TestSendLimiterTimeouts(t *testing.T) {
+	l := newSendLimiter(RateConfig{})
+	now := time.Now()
+	window := func(replies, timeouts int) float64 {
+		l.windowSent = replies + timeouts
+		for i := 0; i < replies; i++ {
+			l.onReply()
+		}
+		for i := 0; i < timeouts; i++ {
+			l.onTimeout()
+		}
+		now = now.Add(adjustInterval)
+		l.adjust(now)
+		return l.stats.Slowdown
+	}
+	// 样本太少不调整，正常的超时率不降速
+	if s := window(0, 10); s != 1 {
+		t.Fatalf("slowdown = %v with few samples", s)
+	}
+	if s := window(40, 60); s != 1 {
+		t.Fatalf("slowdown = %v at normal timeout ratio", s)
+	}
+	if s := window(5, 95); s != 2 {
+		t.Fatalf("slowdown = %v, want 2", s)
+	}
+	// 介于两个阈值之间保持不变，低于恢复阈值后逐步恢复
+	if s := window(30, 70); s != 2 {
+		t.Fatalf("slowdown = %v, want unchanged", s)
+	}
+	if s := window(60, 40); s >= 2 {
+		t.Fatalf("slowdown = %v, expected recovery", s)
+	}
+	if st := l.stats; st.Replies != 135 || st.Timeouts != 275 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
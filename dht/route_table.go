@@ -1,52 +1,111 @@
 package dht
 
 import (
+	"net"
 	"time"
 
-	"github.com/zeromicro/go-zero/core/logx"
+	"github.com/zxw/ciligo/logging"
 )
 
-func (client *Client) IsTableOld(table *NodeTable) bool {
-	return time.Since(table.sendTableTs) > time.Duration(client.updateSeconds)*time.Second
-}
-
-func (client *Client) UpdateSendTable(table *NodeTable) {
-	if client.IsTableOld(table) {
-		sendBuckets := make(map[int][]*NodeInfo, 160)
-		total := 0
-		for dis, buck := range table.recvBuckets {
-			sendBuckets[dis] = make([]*NodeInfo, len(buck))
-			total += len(buck)
-			copy(sendBuckets[dis], buck)
+// UpdateRecvTable 把节点加入路由表。node.seen不为零表示节点直接联系了我们，已有的节点只更新时间
+func (client *Client) UpdateRecvTable(node *NodeInfo) {
+	if !client.guard.validNode(node, client.ID()) {
+		return
+	}
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	table := client.table
+	dis := calcDistance(client.ID(), node.ID)
+	if dis == 0 {
+		logger.Debugw("skip own id", logging.Addr(node.addr))
+		return
+	}
+	for _, nod := range table.buckets[dis] {
+		if nod.ID == node.ID {
+			if !node.seen.IsZero() {
+				nod.seen = node.seen
+				table.touched[dis] = node.seen
+			}
+			return
 		}
-		logx.Infof("UpdateSendTable nodes total=%v", total)
-		table.sendBuckets = sendBuckets
-		table.sendTableTs = time.Now()
 	}
-}
-
-func (client *Client) UpdateRecvTable(node *NodeInfo) {
-	for id, buck := range client.nodeTables {
-		dis := calcDistance(id, node.ID)
-		if dis == 0 {
-			logx.Infof("not Update myID addr=%v,ID=%x", node.addr.String(), node.ID)
+	// 桶满时只替换坏节点和可疑节点，都正常时丢弃新节点，保留长期在线的老节点
+	if nodes := table.buckets[dis]; len(nodes) >= 8 {
+		worst := client.health.replaceable(nodes, time.Now())
+		if worst < 0 {
 			return
 		}
-		for _, nod := range buck.recvBuckets[dis] {
-			if nod.ID == node.ID {
-				return
+		table.buckets[dis] = append(nodes[:worst:worst], nodes[worst+1:]...)
+	}
+	table.buckets[dis] = append(table.buckets[dis], node)
+	table.touched[dis] = time.Now()
+}
+
+// GetClosest 路由表里按xor距离离target最近的8个节点，不区分地址族
+func (client *Client) GetClosest(target string) []*NodeInfo {
+	return client.closest(target, func(*NodeInfo) bool { return true })
+}
+
+// closestFamily 只返回ipv4或ipv6的节点，用于回复的nodes和nodes6
+func (client *Client) closestFamily(target string, ipv6 bool) []*NodeInfo {
+	return client.closest(target, func(node *NodeInfo) bool {
+		return (node.addr.IP.To4() == nil) == ipv6
+	})
+}
+
+// closest 在整个路由表里按160位xor距离取最近的k个节点。
+// 优先返回好节点(15分钟内直接联系过且没有未恢复的超时)，不足k个时用其他节点补足
+func (client *Client) closest(target string, match func(*NodeInfo) bool) []*NodeInfo {
+	now := time.Now()
+	var good, other []*NodeInfo
+	client.mutex.RLock()
+	for _, buck := range client.table.buckets {
+		for _, node := range buck {
+			if !match(node) {
+				continue
+			}
+			if now.Sub(node.seen) <= questionableAge && !client.health.failing(node.addr) {
+				good = append(good, node)
+			} else {
+				other = append(other, node)
 			}
 		}
-		buck.recvBuckets[dis] = append(buck.recvBuckets[dis], node)
-		bucketLen := len(buck.recvBuckets[dis])
-		if bucketLen > 8 {
-			buck.recvBuckets[dis] = buck.recvBuckets[dis][bucketLen-8 : bucketLen]
+	}
+	client.mutex.RUnlock()
+	sortByDistance(target, good)
+	if len(good) < lookupK {
+		sortByDistance(target, other)
+		if len(other) > lookupK-len(good) {
+			other = other[:lookupK-len(good)]
 		}
-		client.UpdateSendTable(buck)
+		good = append(good, other...)
+		sortByDistance(target, good)
 	}
+	if len(good) > lookupK {
+		good = good[:lookupK]
+	}
+	return good
 }
 
-func (client *Client) GetClosest(hashInfo string) []*NodeInfo {
-	dis := calcDistance(client.peerInfo.ID, hashInfo)
-	return client.nodeTables[client.peerInfo.ID].recvBuckets[dis]
+// fillNodes 按want填回复的nodes和nodes6，没有want时按请求方的地址族
+func (client *Client) fillNodes(resp *structNested, target string, want []string, addr *net.UDPAddr) {
+	n4, n6 := false, false
+	for _, w := range want {
+		switch w {
+		case "n4":
+			n4 = true
+		case "n6":
+			n6 = true
+		}
+	}
+	if !n4 && !n6 {
+		n4 = addr.IP.To4() != nil
+		n6 = !n4
+	}
+	if n4 {
+		resp.R.Nodes = CompactNodesInfo(client.closestFamily(target, false))
+	}
+	if n6 {
+		resp.R.Nodes6 = CompactNodesInfo(client.closestFamily(target, true))
+	}
 }
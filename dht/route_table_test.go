@@ -0,0 +1,136 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClosest(t *testing.T) {
+	client := NewClient("0", "", "4")
+	target := randomString(20)
+	now := time.Now()
+	// 每个桶放几个节点，其中一半是ipv6
+	for dis := 100; dis <= 160; dis++ {
+		for i := 0; i < 3; i++ {
+			ip := net.IPv4(10, byte(dis), byte(i), 1)
+			if i == 2 {
+				ip = net.ParseIP("2001:db8::1")
+				ip[14], ip[15] = byte(dis), byte(i)
+			}
+			client.UpdateRecvTable(&NodeInfo{ID: randomIDInBucket(client.ID(), dis), addr: &net.UDPAddr{IP: ip, Port: 6881}, seen: now})
+		}
+	}
+	var all []*NodeInfo
+	for _, buck := range client.table.buckets {
+		all = append(all, buck...)
+	}
+	sortByDistance(target, all)
+
+	got := client.GetClosest(target)
+	if len(got) != 8 {
+		t.Fatalf("closest = %v nodes", len(got))
+	}
+	for i := range got {
+		if got[i] != all[i] {
+			t.Fatalf("closest[%v] = %x, want %x", i, got[i].ID, all[i].ID)
+		}
+	}
+
+	v4 := client.closestFamily(target, false)
+	v6 := client.closestFamily(target, true)
+	if len(v4) != 8 || len(v6) != 8 {
+		t.Fatalf("v4 = %v, v6 = %v", len(v4), len(v6))
+	}
+	for i := range v6 {
+		if v6[i].addr.IP.To4() != nil || v4[i].addr.IP.To4() == nil {
+			t.Fatal("wrong address family")
+		}
+		if i > 0 && xorLess(target, v6[i].ID, v6[i-1].ID) {
+			t.Fatal("nodes6 not sorted by distance")
+		}
+	}
+
+	// 超时的节点让位给更远的好节点
+	client.health.onQuery(got[0].addr, now.Add(-healthTimeout))
+	client.health.onQuery(got[0].addr, now)
+	for _, node := range client.GetClosest(target) {
+		if node == got[0] {
+			t.Fatal("failing node returned")
+		}
+	}
+
+	resp := &structNested{}
+	client.fillNodes(resp, target, []string{"n4", "n6"}, &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1})
+	if len(resp.R.Nodes) != 8*26 || len(resp.R.Nodes6) != 8*38 {
+		t.Fatalf("nodes = %v, nodes6 = %v", len(resp.R.Nodes), len(resp.R.Nodes6))
+	}
+	v6 = client.closestFamily(target, true)
+	if nodes := DecodeCompactNodesInfo(resp.R.Nodes6); len(nodes) != 8 || !nodes[0].addr.IP.Equal(v6[0].addr.IP) || nodes[0].ID != v6[0].ID {
+		t.Fatalf("nodes6 round trip %v", nodes)
+	}
+	resp = &structNested{}
+	client.fillNodes(resp, target, nil, &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 1})
+	if resp.R.Nodes != "" || len(resp.R.Nodes6) != 8*38 {
+		t.Fatal("ipv6 requester without want should get nodes6 only")
+	}
+}
+
+func TestFullBucket(t *testing.T) {
+	client := NewClient("0", "", "4")
+	now := time.Now()
+	dis := 150
+	var nodes []*NodeInfo
+	for i := 0; i < 8; i++ {
+		node := &NodeInfo{ID: randomIDInBucket(client.ID(), dis), addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 6881}, seen: now}
+		nodes = append(nodes, node)
+		client.UpdateRecvTable(node)
+		// 都回复过，nodes[5]回复很慢，得分低于未知节点
+		rtt := time.Millisecond * 20
+		if i == 5 {
+			rtt = time.Second
+		}
+		client.health.onQuery(node.addr, now)
+		client.health.onResponse(node.addr, "", now.Add(rtt))
+	}
+	if client.health.score(nodes[5].addr) >= unknownScore {
+		t.Fatal("slow node should score below unknown node")
+	}
+	newcomer := func(i byte) *NodeInfo {
+		return &NodeInfo{ID: randomIDInBucket(client.ID(), dis), addr: &net.UDPAddr{IP: net.IPv4(10, 0, 1, i), Port: 6881}, seen: now}
+	}
+	contains := func(node *NodeInfo) bool {
+		for _, nod := range client.table.buckets[dis] {
+			if nod == node {
+				return true
+			}
+		}
+		return false
+	}
+
+	// 桶里都是好节点时丢弃新节点
+	first := newcomer(1)
+	client.UpdateRecvTable(first)
+	if contains(first) || !contains(nodes[5]) || len(client.table.buckets[dis]) != 8 {
+		t.Fatal("good node replaced by unknown node")
+	}
+
+	// 正在超时的节点被替换
+	client.health.onQuery(nodes[3].addr, now)
+	client.health.onQuery(nodes[3].addr, now.Add(healthTimeout))
+	second := newcomer(2)
+	client.UpdateRecvTable(second)
+	if !contains(second) || contains(nodes[3]) || len(client.table.buckets[dis]) != 8 {
+		t.Fatal("failing node not replaced")
+	}
+
+	// 15分钟没有联系过的可疑节点被替换
+	client.mutex.Lock()
+	nodes[6].seen = now.Add(-questionableAge - time.Minute)
+	client.mutex.Unlock()
+	third := newcomer(3)
+	client.UpdateRecvTable(third)
+	if !contains(third) || contains(nodes[6]) || !contains(nodes[5]) {
+		t.Fatal("questionable node not replaced")
+	}
+}
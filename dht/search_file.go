@@ -1,41 +1,164 @@
 package dht
 
 import (
+	"context"
 	"encoding/hex"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/zeromicro/go-zero/core/logx"
+	"github.com/zxw/ciligo/logging"
 )
 
+// 关注的infohash定期重新做get_peers查找，每次查找都从主路由表开始，不再为每个infohash维护路由表
+
+const (
+	defaultWatchInterval = time.Minute * 15
+	defaultWatchWorkers  = 4
+)
+
+// WatchResult 关注的infohash一次查找的结果
+type WatchResult struct {
+	InfoHash string
+	Peers    []*net.UDPAddr
+	Time     time.Time
+}
+
+type watchEntry struct {
+	infoHash   string
+	next       time.Time // 下一次查找的时间
+	running    bool
+	lastLookup time.Time
+	peers      int
+}
+
+type watcher struct {
+	mutex    sync.Mutex
+	entries  map[string]*watchEntry
+	interval time.Duration
+	workers  int
+	// 查找结果的回调，类型为func(*WatchResult)
+	result atomic.Value
+}
+
+func newWatcher() *watcher {
+	return &watcher{
+		entries:  make(map[string]*watchEntry),
+		interval: defaultWatchInterval,
+		workers:  defaultWatchWorkers,
+	}
+}
+
+// jitter 在interval上加减10%，避免同时加入的infohash一直同时查找
+func (w *watcher) jitter() time.Duration {
+	return w.interval*9/10 + time.Duration(rand.Int63n(int64(w.interval/5)+1))
+}
+
+// due 到期的infohash，最早到期的在前，最多n个，取出的标记为正在查找
+func (w *watcher) due(now time.Time, n int) []*watchEntry {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	var due []*watchEntry
+	for _, e := range w.entries {
+		if !e.running && !e.next.After(now) {
+			due = append(due, e)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].next.Before(due[j].next)
+	})
+	if len(due) > n {
+		due = due[:n]
+	}
+	for _, e := range due {
+		e.running = true
+	}
+	return due
+}
+
+func (w *watcher) finish(e *watchEntry, peers int, now time.Time) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	e.running = false
+	e.lastLookup = now
+	e.peers = peers
+	e.next = now.Add(w.jitter())
+}
+
+// Watch 定期查找infoHash的peer，刚加入的在第一个周期内随机时间开始
+func (client *Client) Watch(infoHash string) error {
+	if len(infoHash) != 20 {
+		return ErrInvalidInfoHash
+	}
+	w := client.watches
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.entries[infoHash] == nil {
+		w.entries[infoHash] = &watchEntry{
+			infoHash: infoHash,
+			next:     time.Now().Add(time.Duration(rand.Int63n(int64(w.interval/10) + 1))),
+		}
+	}
+	return nil
+}
+
+// Unwatch 停止查找infoHash，正在进行的查找不受影响
+func (client *Client) Unwatch(infoHash string) {
+	w := client.watches
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	delete(w.entries, infoHash)
+}
+
+// SetWatchInterval 设置重新查找的间隔和同时进行的查找数，需在Start之前调用
+func (client *Client) SetWatchInterval(interval time.Duration, workers int) {
+	if interval > 0 {
+		client.watches.interval = interval
+	}
+	if workers > 0 {
+		client.watches.workers = workers
+	}
+}
+
+// OnWatch 设置关注的infohash每次查找完成时的回调，在查找协程中调用
+func (client *Client) OnWatch(fn func(*WatchResult)) {
+	client.watches.result.Store(fn)
+}
+
+// SearchFileInfo 按hex格式的infohash加入关注列表
 func (client *Client) SearchFileInfo(infoHashs []string) {
 	for _, search := range infoHashs {
 		data, _ := hex.DecodeString(search)
-		client.nodeTables[string(data)] = &NodeTable{
-			recvBuckets: make(map[int][]*NodeInfo, 160),
-			sendBuckets: make(map[int][]*NodeInfo, 160),
+		if err := client.Watch(string(data)); err != nil {
+			logger.Errorw("watch failed", logx.Field("infohash", search), logging.Err(err))
 		}
-		client.infoHashs = append(client.infoHashs, string(data))
-	}
-	go client.Search()
-}
-func (client *Client) Search() {
-	ticker := time.NewTicker(time.Second * 4)
-	for {
-		for info, infoHash := range client.infoHashs {
-			total := 0
-			for i := 0; i < 160; i++ {
-				buck := client.nodeTables[infoHash].sendBuckets[i]
-				total += len(buck)
-				for _, node := range buck {
-					client.sendGetPeer(infoHash, node.addr)
-				}
-				if total > 8 {
-					break
+	}
+}
+
+func (client *Client) watchLoop() {
+	w := client.watches
+	slots := make(chan struct{}, w.workers)
+	ticker := time.NewTicker(time.Second)
+	for now := range ticker.C {
+		for _, e := range w.due(now, w.workers-len(slots)) {
+			slots <- struct{}{}
+			go func(e *watchEntry) {
+				defer func() { <-slots }()
+				ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout*lookupRounds)
+				peers, _ := client.GetPeers(ctx, e.infoHash)
+				cancel()
+				now := time.Now()
+				logger.Infow("watch lookup", logging.InfoHash(e.infoHash), logx.Field("peers", len(peers)))
+				w.finish(e, len(peers), now)
+				if fn, ok := w.result.Load().(func(*WatchResult)); ok {
+					fn(&WatchResult{InfoHash: e.infoHash, Peers: peers, Time: now})
 				}
-			}
-			logx.Infof("Search info:%v,total:%v,infoHash:%x", info, total, infoHash)
+			}(e)
 		}
-		<-ticker.C
 	}
 }
 
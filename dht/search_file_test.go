@@ -0,0 +1,29 @@
+package dht
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWatchSchedule(t *testing.T) {
+	w := newWatcher()
+	w.interval = time.Minute
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		w.entries[string(rune('a'+i))] = &watchEntry{infoHash: string(rune('a' + i)), next: now.Add(time.Duration(i) * time.Second)}
+	}
+	due := w.due(now.Add(time.Second), 4)
+	if len(due) != 2 || due[0].infoHash != "a" || due[1].infoHash != "b" {
+		t.Fatalf("due = %v", len(due))
+	}
+	if len(w.due(now.Add(time.Second), 4)) != 0 {
+		t.Fatal("running entries should not be due again")
+	}
+	w.finish(due[0], 5, now)
+	if e := w.entries["a"]; e.peers != 5 || e.next.Before(now.Add(w.interval*9/10)) || e.next.After(now.Add(w.interval*11/10)) {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+	if due := w.due(now.Add(time.Hour), 1); len(due) != 1 || due[0].infoHash != "c" {
+		t.Fatal("earliest entry should come first")
+	}
+}
@@ -0,0 +1,172 @@
+package dht
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 运行统计，供metrics采集。计数只增不减，路由表、事务等大小在读取时计算
+
+// msgKinds 按消息类型计数，请求按q区分，其他请求计为"other"
+var msgKinds = []string{"ping", "find_node", "get_peers", "announce_peer", "other", "response", "error"}
+
+const (
+	kindOther    = 4
+	kindResponse = 5
+	kindError    = 6
+)
+
+// lookupBuckets 查找耗时直方图的上界，单位秒
+var lookupBuckets = []float64{0.5, 1, 2, 4, 8, 16}
+
+type msgCounter [7]uint64
+
+func (c *msgCounter) add(msg *structNested) {
+	atomic.AddUint64(&c[msgKind(msg)], 1)
+}
+
+func (c *msgCounter) snapshot() map[string]uint64 {
+	counts := make(map[string]uint64, len(msgKinds))
+	for i, kind := range msgKinds {
+		counts[kind] = atomic.LoadUint64(&c[i])
+	}
+	return counts
+}
+
+func msgKind(msg *structNested) int {
+	switch msg.Y {
+	case "r":
+		return kindResponse
+	case "e":
+		return kindError
+	}
+	for i, kind := range msgKinds[:kindOther] {
+		if msg.Q == kind {
+			return i
+		}
+	}
+	return kindOther
+}
+
+// Histogram 累计直方图，Counts[i]是不超过Bounds[i]的次数，超过所有上界的只计入Count
+type Histogram struct {
+	Bounds []float64
+	Counts []uint64
+	Count  uint64
+	Sum    float64
+}
+
+type histogram struct {
+	mutex sync.Mutex
+	h     Histogram
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{h: Histogram{Bounds: bounds, Counts: make([]uint64, len(bounds))}}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, bound := range h.h.Bounds {
+		if v <= bound {
+			h.h.Counts[i]++
+		}
+	}
+	h.h.Count++
+	h.h.Sum += v
+}
+
+func (h *histogram) snapshot() Histogram {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	s := h.h
+	s.Counts = append([]uint64(nil), h.h.Counts...)
+	return s
+}
+
+type stats struct {
+	recv         msgCounter
+	sent         msgCounter
+	decodeErrors uint64
+	harvested    [2]uint64 // get_peers、announce_peer收集到的infohash
+	lookups      map[string]*histogram
+}
+
+func newStats() *stats {
+	return &stats{
+		lookups: map[string]*histogram{
+			"get_peers": newHistogram(lookupBuckets),
+			"find_node": newHistogram(lookupBuckets),
+		},
+	}
+}
+
+func (s *stats) observeLookup(q string, d time.Duration) {
+	if h := s.lookups[q]; h != nil {
+		h.observe(d.Seconds())
+	}
+}
+
+func (s *stats) harvest(announce bool) {
+	if announce {
+		atomic.AddUint64(&s.harvested[1], 1)
+	} else {
+		atomic.AddUint64(&s.harvested[0], 1)
+	}
+}
+
+// Stats dht运行统计
+type Stats struct {
+	Received     map[string]uint64 // 按消息类型
+	Sent         map[string]uint64
+	DecodeErrors uint64
+	Harvested    map[string]uint64 // 按来源get_peers/announce_peer
+	Buckets      map[int]int       // 路由表每个桶(距离)的节点数
+	Pending      int               // 等待回复的事务数
+	Lookups      map[string]Histogram
+	Watching     int
+	Seeding      int
+	Peers        int // PeerStore记录的peer数
+	Tracked      int // 有回复统计的节点数
+}
+
+func (client *Client) Stats() Stats {
+	s := client.stats
+	st := Stats{
+		Received:     s.recv.snapshot(),
+		Sent:         s.sent.snapshot(),
+		DecodeErrors: atomic.LoadUint64(&s.decodeErrors),
+		Harvested: map[string]uint64{
+			"get_peers":     atomic.LoadUint64(&s.harvested[0]),
+			"announce_peer": atomic.LoadUint64(&s.harvested[1]),
+		},
+		Buckets: make(map[int]int),
+		Lookups: make(map[string]Histogram, len(s.lookups)),
+		Peers:   client.peers.Len(),
+	}
+	for q, h := range s.lookups {
+		st.Lookups[q] = h.snapshot()
+	}
+	client.mutex.RLock()
+	for dis, buck := range client.table.buckets {
+		if len(buck) > 0 {
+			st.Buckets[dis] = len(buck)
+		}
+	}
+	client.mutex.RUnlock()
+	client.transactions.mutex.Lock()
+	st.Pending = len(client.transactions.pending)
+	client.transactions.mutex.Unlock()
+	client.watches.mutex.Lock()
+	st.Watching = len(client.watches.entries)
+	client.watches.mutex.Unlock()
+	client.announces.mutex.Lock()
+	st.Seeding = len(client.announces.entries)
+	client.announces.mutex.Unlock()
+	client.health.mutex.Lock()
+	st.Tracked = len(client.health.nodes)
+	client.health.mutex.Unlock()
+	return st
+}
@@ -0,0 +1,42 @@
+package dht
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	a := startTestClient(t, "lab", "")
+	b := startTestClient(t, "lab", "127.0.0.1:"+strings.Split(a.connection.LocalAddr().String(), ":")[1])
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+	if _, err := b.Announce(ctx, strings.Repeat("m", 20), 6881, false); err != nil {
+		t.Fatal(err)
+	}
+	sa, sb := a.Stats(), b.Stats()
+	if sa.Received["get_peers"] != 1 || sa.Received["announce_peer"] != 1 || sb.Sent["announce_peer"] != 1 {
+		t.Fatalf("received = %v, sent = %v", sa.Received, sb.Sent)
+	}
+	if sa.Harvested["announce_peer"] != 1 || sa.Peers != 1 {
+		t.Fatalf("harvested = %v, peers = %v", sa.Harvested, sa.Peers)
+	}
+	if h := sb.Lookups["get_peers"]; h.Count != 1 || h.Counts[len(h.Counts)-1] != 1 {
+		t.Fatalf("lookups = %+v", h)
+	}
+	if len(sb.Buckets) == 0 || sb.Pending != 0 {
+		t.Fatalf("buckets = %v, pending = %v", sb.Buckets, sb.Pending)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{1, 2})
+	for _, v := range []float64{0.5, 1.5, 3} {
+		h.observe(v)
+	}
+	s := h.snapshot()
+	if s.Count != 3 || s.Sum != 5 || s.Counts[0] != 1 || s.Counts[1] != 2 {
+		t.Fatalf("histogram = %+v", s)
+	}
+}
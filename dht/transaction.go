@@ -0,0 +1,93 @@
+package dht
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+var ErrTransactionTimeout = errors.New("transaction timeout")
+
+// 请求的事务，收到t相同的回包后投递到ch
+type transaction struct {
+	addr *net.UDPAddr
+	ch   chan *structNested
+}
+
+type transactionTable struct {
+	mutex   sync.Mutex
+	pending map[string]*transaction
+}
+
+func newTransactionTable() *transactionTable {
+	return &transactionTable{
+		pending: make(map[string]*transaction),
+	}
+}
+
+// 分配一个未使用的transactionID
+func (table *transactionTable) add(addr *net.UDPAddr, ch chan *structNested) string {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	t := randomTranssionId()
+	for table.pending[t] != nil {
+		t = randomTranssionId()
+	}
+	table.pending[t] = &transaction{
+		addr: addr,
+		ch:   ch,
+	}
+	return t
+}
+
+// remove 返回事务是否还在等待回包
+func (table *transactionTable) remove(t string) bool {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	_, ok := table.pending[t]
+	delete(table.pending, t)
+	return ok
+}
+
+// 回包的t和来源地址都匹配才算完成
+func (table *transactionTable) finish(msg *structNested, addr *net.UDPAddr) bool {
+	table.mutex.Lock()
+	trans := table.pending[msg.T]
+	if trans == nil || !trans.addr.IP.Equal(addr.IP) || trans.addr.Port != addr.Port {
+		table.mutex.Unlock()
+		return false
+	}
+	delete(table.pending, msg.T)
+	table.mutex.Unlock()
+	select {
+	case trans.ch <- msg:
+	default:
+	}
+	return true
+}
+
+// query 发送请求，回包投递到ch。ch需要有足够的缓冲，调用方不再等待时需调用cancel，
+// 这时还没有回包的计为一次超时，用于发包降速
+func (client *Client) query(msg *structNested, addr *net.UDPAddr, ch chan *structNested) (func(), error) {
+	t := client.transactions.add(addr, ch)
+	msg.T = t
+	if err := client.sendMsg(msg, addr); err != nil {
+		client.transactions.remove(t)
+		return nil, err
+	}
+	cancel := func() {
+		if client.transactions.remove(t) {
+			client.limiter.onTimeout()
+		}
+	}
+	return cancel, nil
+}
+
+// finishTransaction 回包投递给等待中的请求
+func (client *Client) finishTransaction(msg *structNested, addr *net.UDPAddr) bool {
+	if !client.transactions.finish(msg, addr) {
+		return false
+	}
+	client.limiter.onReply()
+	return true
+}
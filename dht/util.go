@@ -88,7 +88,11 @@ func encodeCompactIPPortInfo(ip net.IP, port int) (info string, err error) {
 	}
 
 	p := int2bytes(uint16(port))
-	info = string(append(ip[len(ip)-4:], p...))
+	// ipv4为4字节，ipv6为16字节(bep-032)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	info = string(append(append([]byte(nil), ip...), p...))
 	// logx.Infof("encodeCompactIPPortInfo %x ip=%v p=%x info=%x", ip[0:4], ip.String(), p, []byte(info))
 	return
 }
@@ -134,6 +138,9 @@ func genAddress(ip net.IP, port uint16) string {
 	return strings.Join([]string{"[", ip.String(), "]:", strconv.Itoa(int(port))}, "")
 }
 
+// RemoteIPProbe 查询公网ip，只用于Start时的日志，在后台进行。为nil时不查询，测试和离线环境使用
+var RemoteIPProbe = getRemoteIP
+
 // getRemoteIP returns the wlan ip.
 func getRemoteIP() (ip string, err error) {
 	client := &http.Client{
@@ -175,3 +182,20 @@ func calcDistance(ID string, ToID string) int {
 	}
 	return 0
 }
+
+// xorLess 比较a、b到target的异或距离，a更近返回true。非法ID视为最远
+func xorLess(target string, a string, b string) bool {
+	if len(b) != 20 || len(target) != 20 {
+		return len(a) == 20 && len(target) == 20
+	}
+	if len(a) != 20 {
+		return false
+	}
+	for i := 0; i < 20; i++ {
+		da, db := a[i]^target[i], b[i]^target[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
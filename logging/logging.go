@@ -0,0 +1,234 @@
+package logging
+
+import (
+	"encoding/hex"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/zeromicro/go-zero/core/logx"
+)
+
+// 按模块分级的结构化日志，输出仍然走logx。
+// 收发每个包(packet)的日志量很大，默认不输出：debug级别时按1/N采样，
+// 打开trace后全部输出，trace可以在运行时通过管理接口或信号切换
+
+type Level int32
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	ErrorLevel
+	OffLevel
+)
+
+var levelNames = []string{"debug", "info", "error", "off"}
+
+var ErrBadLevel = errors.New("bad log level")
+
+func (l Level) String() string {
+	if l < DebugLevel || l > OffLevel {
+		return "unknown"
+	}
+	return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return InfoLevel, ErrBadLevel
+}
+
+var (
+	mutex   sync.Mutex
+	loggers = make(map[string]*Logger)
+	// 新建logger的默认级别和采样
+	defaultLevel  = InfoLevel
+	defaultSample = uint64(100)
+	trace         int32
+)
+
+// Logger 一个模块的日志，所有输出都带subsystem字段
+type Logger struct {
+	name   string
+	level  int32
+	sample uint64 // 包日志每sample条输出一条
+	count  uint64
+}
+
+// Get 取名为name的logger，不存在时按默认级别新建
+func Get(name string) *Logger {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if l := loggers[name]; l != nil {
+		return l
+	}
+	l := &Logger{name: name, level: int32(defaultLevel), sample: defaultSample}
+	loggers[name] = l
+	return l
+}
+
+// SetLevels 格式为"info"或"info,dht=error,metadata=debug"，不带模块名的设置默认级别和所有模块
+func SetLevels(spec string) error {
+	type setting struct {
+		name  string
+		level Level
+	}
+	var settings []setting
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value := "", part
+		if i := strings.Index(part, "="); i >= 0 {
+			name, value = part[:i], part[i+1:]
+		}
+		level, err := ParseLevel(value)
+		if err != nil {
+			return err
+		}
+		settings = append(settings, setting{name, level})
+	}
+	for _, s := range settings {
+		if s.name == "" {
+			mutex.Lock()
+			defaultLevel = s.level
+			for _, l := range loggers {
+				l.SetLevel(s.level)
+			}
+			mutex.Unlock()
+		} else {
+			Get(s.name).SetLevel(s.level)
+		}
+	}
+	return nil
+}
+
+// Levels 所有模块当前的级别，按模块名排序，格式同SetLevels
+func Levels() string {
+	mutex.Lock()
+	defer mutex.Unlock()
+	parts := make([]string, 0, len(loggers)+1)
+	parts = append(parts, defaultLevel.String())
+	for name, l := range loggers {
+		parts = append(parts, name+"="+l.Level().String())
+	}
+	sort.Strings(parts[1:])
+	return strings.Join(parts, ",")
+}
+
+// SetSample 所有模块的包日志每n条输出一条
+func SetSample(n int) {
+	if n < 1 {
+		n = 1
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	defaultSample = uint64(n)
+	for _, l := range loggers {
+		atomic.StoreUint64(&l.sample, uint64(n))
+	}
+}
+
+// SetTrace 打开后输出所有包日志，不受级别和采样限制
+func SetTrace(on bool) {
+	v := int32(0)
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&trace, v)
+}
+
+func Tracing() bool {
+	return atomic.LoadInt32(&trace) == 1
+}
+
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+func (l *Logger) Level() Level {
+	return Level(atomic.LoadInt32(&l.level))
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.Level() && level != OffLevel
+}
+
+func (l *Logger) Debugw(msg string, fields ...logx.LogField) {
+	if l.Enabled(DebugLevel) {
+		logx.Infow(msg, l.fields("debug", fields)...)
+	}
+}
+
+func (l *Logger) Infow(msg string, fields ...logx.LogField) {
+	if l.Enabled(InfoLevel) {
+		logx.Infow(msg, l.fields("info", fields)...)
+	}
+}
+
+func (l *Logger) Errorw(msg string, fields ...logx.LogField) {
+	if l.Enabled(ErrorLevel) {
+		logx.Errorw(msg, l.fields("error", fields)...)
+	}
+}
+
+// Packet 这一条包日志是否需要输出。调用方先判断再构造字段，不输出时没有额外开销：
+//
+//	if logger.Packet() {
+//		logger.Packetw("send ping", logging.Addr(addr), logging.Tx(t))
+//	}
+func (l *Logger) Packet() bool {
+	if Tracing() {
+		return true
+	}
+	if !l.Enabled(DebugLevel) {
+		return false
+	}
+	return atomic.AddUint64(&l.count, 1)%atomic.LoadUint64(&l.sample) == 0
+}
+
+// Packetw 输出包日志，只在Packet返回true后调用
+func (l *Logger) Packetw(msg string, fields ...logx.LogField) {
+	logx.Infow(msg, l.fields("trace", fields)...)
+}
+
+func (l *Logger) fields(level string, fields []logx.LogField) []logx.LogField {
+	return append(fields, logx.Field("subsystem", l.name), logx.Field("lvl", level))
+}
+
+// 常用字段
+
+func Addr(addr net.Addr) logx.LogField {
+	if addr == nil {
+		return logx.Field("addr", "")
+	}
+	return logx.Field("addr", addr.String())
+}
+
+// Tx 事务id一般是二进制，按hex输出
+func Tx(t string) logx.LogField {
+	return logx.Field("tx", hex.EncodeToString([]byte(t)))
+}
+
+func Query(q string) logx.LogField {
+	return logx.Field("q", q)
+}
+
+func InfoHash(infoHash string) logx.LogField {
+	return logx.Field("infohash", hex.EncodeToString([]byte(infoHash)))
+}
+
+func Err(err error) logx.LogField {
+	if err == nil {
+		return logx.Field("err", "")
+	}
+	return logx.Field("err", err.Error())
+}
@@ -0,0 +1,66 @@
+package logging
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSetLevels(t *testing.T) {
+	a, b := Get("test.a"), Get("test.b")
+	if err := SetLevels("error,test.b=debug"); err != nil {
+		t.Fatal(err)
+	}
+	if a.Level() != ErrorLevel || b.Level() != DebugLevel || Get("test.c").Level() != ErrorLevel {
+		t.Fatalf("levels = %v", Levels())
+	}
+	if a.Enabled(InfoLevel) || !a.Enabled(ErrorLevel) || !b.Enabled(DebugLevel) {
+		t.Fatal("unexpected enabled levels")
+	}
+	if err := SetLevels("info,test.a=loud"); err != ErrBadLevel {
+		t.Fatalf("err = %v", err)
+	}
+	// 出错时不修改任何级别
+	if a.Level() != ErrorLevel {
+		t.Fatal("level changed on error")
+	}
+	SetLevels("info")
+}
+
+func TestPacketSample(t *testing.T) {
+	l := Get("test.packet")
+	l.SetLevel(InfoLevel)
+	for i := 0; i < 10; i++ {
+		if l.Packet() {
+			t.Fatal("packet logs are off at info level")
+		}
+	}
+	l.SetLevel(DebugLevel)
+	SetSample(4)
+	n := 0
+	for i := 0; i < 100; i++ {
+		if l.Packet() {
+			n++
+		}
+	}
+	if n != 25 {
+		t.Fatalf("sampled %v of 100", n)
+	}
+	l.SetLevel(OffLevel)
+	SetTrace(true)
+	if !l.Packet() {
+		t.Fatal("trace logs every packet")
+	}
+	SetTrace(false)
+	SetSample(100)
+
+	// 不输出时不分配内存
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 6881}
+	allocs := testing.AllocsPerRun(100, func() {
+		if l.Packet() {
+			l.Packetw("send", Addr(addr), Tx("aa"))
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("allocs = %v", allocs)
+	}
+}
@@ -0,0 +1,309 @@
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zxw/ciligo/logging"
+)
+
+var logger = logging.Get("lsd")
+
+// Local Service Discovery
+// http://www.bittorrent.org/beps/bep_0014.html
+// BT-SEARCH * HTTP/1.1\r\n
+// Host: <host>\r\n
+// Port: <port>\r\n
+// Infohash: <40位hex>\r\n
+// cookie: <用于过滤自己发出的包>\r\n
+// \r\n\r\n
+
+const (
+	MulticastPort = 6771
+	Group4        = "239.192.152.143"
+	Group6        = "ff15::efc0:988f"
+	peerTTL       = time.Minute * 15
+	reannounce    = time.Minute * 5
+	// 同一个infohash一分钟内最多announce一次
+	minAnnounceInterval = time.Minute
+	maxPeersPerHash     = 200
+)
+
+var (
+	ErrNotAnnounce = errors.New("not a BT-SEARCH message")
+	ErrNoGroup     = errors.New("could not join any lsd multicast group")
+)
+
+type Announce struct {
+	Port       int
+	InfoHashes []string // 20字节
+	Cookie     string
+}
+
+// Marshal host为组播地址，ipv6需要带中括号
+func (a *Announce) Marshal(host string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	buf.WriteString("Host: " + host + "\r\n")
+	buf.WriteString("Port: " + strconv.Itoa(a.Port) + "\r\n")
+	for _, infoHash := range a.InfoHashes {
+		buf.WriteString("Infohash: " + hex.EncodeToString([]byte(infoHash)) + "\r\n")
+	}
+	if a.Cookie != "" {
+		buf.WriteString("cookie: " + a.Cookie + "\r\n")
+	}
+	buf.WriteString("\r\n\r\n")
+	return buf.Bytes()
+}
+
+func ParseAnnounce(b []byte) (*Announce, error) {
+	if !bytes.HasPrefix(b, []byte("BT-SEARCH * HTTP/1.1\r\n")) {
+		return nil, ErrNotAnnounce
+	}
+	r := bufio.NewReader(bytes.NewReader(b))
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(req.Header.Get("Port"))
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, ErrNotAnnounce
+	}
+	a := &Announce{
+		Port:   port,
+		Cookie: req.Header.Get("Cookie"),
+	}
+	for _, v := range req.Header.Values("Infohash") {
+		infoHash, err := hex.DecodeString(strings.TrimSpace(v))
+		if err == nil && len(infoHash) == 20 {
+			a.InfoHashes = append(a.InfoHashes, string(infoHash))
+		}
+	}
+	if len(a.InfoHashes) == 0 {
+		return nil, ErrNotAnnounce
+	}
+	return a, nil
+}
+
+type group struct {
+	conn *net.UDPConn // 接收组播
+	// 发送用普通socket：ListenMulticastUDP关闭了IP_MULTICAST_LOOP，
+	// 用它发送时同一台机器上的其他客户端收不到，自己发出的包靠cookie过滤
+	send *net.UDPConn
+	addr *net.UDPAddr
+	host string
+}
+
+type peerEntry struct {
+	addr *net.TCPAddr
+	seen time.Time
+}
+
+// Service 在局域网组播announce我们关心的infohash，同时收集别人的announce
+type Service struct {
+	port   int
+	cookie string
+	groups []*group
+	mutex  sync.Mutex
+	peers  map[string]map[string]*peerEntry // infohash -> ip:port
+	// 需要定期announce的infohash和上次announce的时间
+	announced map[string]time.Time
+	// 发现peer的回调，类型为func(infoHash string, addr *net.TCPAddr)
+	onPeer atomic.Value
+	closed chan struct{}
+}
+
+// New port为我们的bt端口
+func New(port int) *Service {
+	cookie := make([]byte, 8)
+	rand.Read(cookie)
+	return &Service{
+		port:      port,
+		cookie:    hex.EncodeToString(cookie),
+		peers:     make(map[string]map[string]*peerEntry),
+		announced: make(map[string]time.Time),
+		closed:    make(chan struct{}),
+	}
+}
+
+// OnPeer 设置发现peer时的回调，在收包协程中调用，不能阻塞
+func (s *Service) OnPeer(fn func(infoHash string, addr *net.TCPAddr)) {
+	s.onPeer.Store(fn)
+}
+
+// Start 加入ipv4和ipv6组播组，有一个成功即可
+func (s *Service) Start() error {
+	for _, g := range []struct{ network, ip string }{{"udp4", Group4}, {"udp6", Group6}} {
+		addr := &net.UDPAddr{IP: net.ParseIP(g.ip), Port: MulticastPort}
+		conn, err := net.ListenMulticastUDP(g.network, nil, addr)
+		if err != nil {
+			logger.Errorw("join failed", logging.Addr(addr), logging.Err(err))
+			continue
+		}
+		send, err := net.ListenUDP(g.network, nil)
+		if err != nil {
+			conn.Close()
+			logger.Errorw("join failed", logging.Addr(addr), logging.Err(err))
+			continue
+		}
+		logger.Infow("join", logging.Addr(addr))
+		gr := &group{conn: conn, send: send, addr: addr, host: addr.String()}
+		s.groups = append(s.groups, gr)
+		go s.recv(gr)
+	}
+	if len(s.groups) == 0 {
+		return ErrNoGroup
+	}
+	go s.loop()
+	return nil
+}
+
+func (s *Service) Close() {
+	close(s.closed)
+	for _, g := range s.groups {
+		g.conn.Close()
+		g.send.Close()
+	}
+}
+
+func (s *Service) recv(g *group) {
+	buffer := make([]byte, 2048)
+	for {
+		n, addr, err := g.conn.ReadFromUDP(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		s.handle(buffer[:n], addr)
+	}
+}
+
+func (s *Service) handle(b []byte, from *net.UDPAddr) {
+	a, err := ParseAnnounce(b)
+	if err != nil || a.Cookie == s.cookie {
+		return
+	}
+	peer := &net.TCPAddr{IP: from.IP, Port: a.Port, Zone: from.Zone}
+	fn, _ := s.onPeer.Load().(func(string, *net.TCPAddr))
+	for _, infoHash := range a.InfoHashes {
+		logger.Debugw("peer", logging.Addr(peer), logging.InfoHash(infoHash))
+		s.add(infoHash, peer)
+		if fn != nil {
+			fn(infoHash, peer)
+		}
+	}
+}
+
+func (s *Service) add(infoHash string, peer *net.TCPAddr) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entries := s.peers[infoHash]
+	if entries == nil {
+		entries = make(map[string]*peerEntry)
+		s.peers[infoHash] = entries
+	}
+	key := peer.String()
+	if e := entries[key]; e != nil {
+		e.seen = time.Now()
+		return
+	}
+	if len(entries) < maxPeersPerHash {
+		entries[key] = &peerEntry{addr: peer, seen: time.Now()}
+	}
+}
+
+// Announce 组播announce，之后每5分钟重复一次。一分钟内重复调用会被忽略
+func (s *Service) Announce(infoHash string) {
+	s.mutex.Lock()
+	last, ok := s.announced[infoHash]
+	if ok && time.Since(last) < minAnnounceInterval {
+		s.mutex.Unlock()
+		return
+	}
+	s.announced[infoHash] = time.Now()
+	s.mutex.Unlock()
+	s.send([]string{infoHash})
+}
+
+// Unannounce 停止定期announce
+func (s *Service) Unannounce(infoHash string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.announced, infoHash)
+}
+
+func (s *Service) send(infoHashes []string) {
+	a := &Announce{Port: s.port, InfoHashes: infoHashes, Cookie: s.cookie}
+	for _, g := range s.groups {
+		if _, err := g.send.WriteToUDP(a.Marshal(g.host), g.addr); err != nil {
+			logger.Errorw("send failed", logging.Addr(g.addr), logging.Err(err))
+		}
+	}
+}
+
+// loop 定期重新announce，清理过期的peer
+func (s *Service) loop() {
+	ticker := time.NewTicker(reannounce)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		}
+		var infoHashes []string
+		s.mutex.Lock()
+		now := time.Now()
+		for infoHash := range s.announced {
+			infoHashes = append(infoHashes, infoHash)
+			s.announced[infoHash] = now
+		}
+		for infoHash, entries := range s.peers {
+			for key, e := range entries {
+				if now.Sub(e.seen) > peerTTL {
+					delete(entries, key)
+				}
+			}
+			if len(entries) == 0 {
+				delete(s.peers, infoHash)
+			}
+		}
+		s.mutex.Unlock()
+		// 一个包放不下太多infohash，分批发送
+		for len(infoHashes) > 0 {
+			n := len(infoHashes)
+			if n > 16 {
+				n = 16
+			}
+			s.send(infoHashes[:n])
+			infoHashes = infoHashes[n:]
+		}
+	}
+}
+
+// GetPeers 局域网内announce过infoHash的peer，实现了metadata.PeerSource。
+// 收集到的infohash很多，这里不announce，只有调用Announce的才会组播
+func (s *Service) GetPeers(ctx context.Context, infoHash string) ([]*net.UDPAddr, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var peers []*net.UDPAddr
+	for _, e := range s.peers[infoHash] {
+		if time.Since(e.seen) < peerTTL {
+			peers = append(peers, &net.UDPAddr{IP: e.addr.IP, Port: e.addr.Port, Zone: e.addr.Zone})
+		}
+	}
+	return peers, nil
+}
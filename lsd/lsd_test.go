@@ -0,0 +1,89 @@
+package lsd
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnnounceRoundTrip(t *testing.T) {
+	a := &Announce{
+		Port:       6881,
+		InfoHashes: []string{strings.Repeat("\x01", 20), strings.Repeat("\xab", 20)},
+		Cookie:     "abc",
+	}
+	b := a.Marshal("[ff15::efc0:988f]:6771")
+	if !strings.Contains(string(b), "Infohash: abababababababababababababababababababab\r\n") {
+		t.Fatalf("unexpected message %q", b)
+	}
+	got, err := ParseAnnounce(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Port != 6881 || got.Cookie != "abc" || len(got.InfoHashes) != 2 || got.InfoHashes[1] != a.InfoHashes[1] {
+		t.Fatalf("unexpected announce %+v", got)
+	}
+	for _, bad := range []string{
+		"M-SEARCH * HTTP/1.1\r\nHost: x\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nHost: x\r\nPort: 0\r\nInfohash: 0101010101010101010101010101010101010101\r\n\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nHost: x\r\nPort: 1\r\nInfohash: zz\r\n\r\n\r\n",
+	} {
+		if _, err := ParseAnnounce([]byte(bad)); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestHandle(t *testing.T) {
+	s := New(6881)
+	var found []*net.TCPAddr
+	s.OnPeer(func(infoHash string, addr *net.TCPAddr) {
+		found = append(found, addr)
+	})
+	infoHash := strings.Repeat("\x02", 20)
+	from := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 9), Port: 6771}
+	// 自己发出的包被忽略
+	own := &Announce{Port: 6881, InfoHashes: []string{infoHash}, Cookie: s.cookie}
+	s.handle(own.Marshal(Group4), from)
+	other := &Announce{Port: 51413, InfoHashes: []string{infoHash}}
+	s.handle(other.Marshal(Group4), from)
+	if len(found) != 1 || found[0].String() != "192.168.1.9:51413" {
+		t.Fatalf("unexpected peers %v", found)
+	}
+	peers, _ := s.GetPeers(context.Background(), infoHash)
+	if len(peers) != 1 || peers[0].Port != 51413 {
+		t.Fatalf("unexpected GetPeers %v", peers)
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	a, b := New(6881), New(6882)
+	if err := a.Start(); err != nil {
+		t.Skipf("multicast unavailable: %v", err)
+	}
+	defer a.Close()
+	if err := b.Start(); err != nil {
+		t.Skipf("multicast unavailable: %v", err)
+	}
+	defer b.Close()
+	found := make(chan *net.TCPAddr, 4)
+	b.OnPeer(func(infoHash string, addr *net.TCPAddr) {
+		found <- addr
+	})
+	infoHash := strings.Repeat("\x03", 20)
+	a.Announce(infoHash)
+	select {
+	case peer := <-found:
+		if peer.Port != 6881 {
+			t.Fatalf("unexpected peer %v", peer)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("announce not received")
+	}
+	peers, _ := b.GetPeers(context.Background(), infoHash)
+	if len(peers) != 1 || peers[0].Port != 6881 {
+		t.Fatalf("unexpected GetPeers %v", peers)
+	}
+}
@@ -1,22 +1,68 @@
 package main
 
 import (
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/zeromicro/go-zero/core/logx"
+	"github.com/zeromicro/go-zero/core/service"
+	"github.com/zeromicro/go-zero/rest"
+	"github.com/zxw/ciligo/api"
+	"github.com/zxw/ciligo/catalog"
 	"github.com/zxw/ciligo/dht"
+	"github.com/zxw/ciligo/logging"
+	"github.com/zxw/ciligo/lsd"
+	"github.com/zxw/ciligo/metadata"
+	"github.com/zxw/ciligo/metrics"
+	"github.com/zxw/ciligo/tracker"
+	"github.com/zxw/ciligo/utp"
+	"github.com/zxw/ciligo/watchlist"
 )
 
 var (
-	version          = "v1.0.1"
-	port             = flag.String("p", "8050", "listen port")
-	targetAddr       = flag.String("a", "", "send findnode addr")
-	ipv46            = flag.String("t", "4", "4/6")
-	showVer    *bool = flag.Bool("v", false, "to show version of mini_datapipe")
+	version              = "v1.0.1"
+	port                 = flag.String("p", "8050", "listen port")
+	targetAddr           = flag.String("a", "", "send findnode addr")
+	ipv46                = flag.String("t", "4", "4/6")
+	httpAddr             = flag.String("http", "", "http api listen addr, e.g. :8080")
+	adminAddr            = flag.String("admin", "", "admin api listen addr for log levels and watchlist changes, e.g. 127.0.0.1:8081; it has no auth, keep it off public interfaces")
+	catalogMax           = flag.Int("catalog-max", catalog.DefaultMaxTorrents, "max infohashes kept in the in-memory catalog, least recently seen are evicted first, 0 for unlimited")
+	fetchWorkers         = flag.Int("fetch", 16, "metadata fetch workers, 0 to disable")
+	useUTP               = flag.Bool("utp", true, "fetch metadata over uTP when tcp fails")
+	pexStore             = flag.Bool("pexstore", false, "record ut_pex peers in the dht peer store")
+	bootstrap            = flag.String("bootstrap", "", "comma separated bootstrap host:port list, replaces the default router nodes")
+	bootstrapFile        = flag.String("bootstrap-file", "", "file of bootstrap host:port entries, one per line")
+	snapshot             = flag.String("snapshot", "", "routing table snapshot file, loaded at start and saved periodically")
+	networkID            = flag.String("network", "", "private dht network id, messages without it are ignored and public router nodes are not used")
+	pps                  = flag.Float64("pps", 300, "global outgoing dht packets per second, 0 for unlimited")
+	blocklist            = flag.String("blocklist", "", "ip blocklist file of CIDR or P2P format ranges")
+	queryRate            = flag.Float64("query-rate", 5, "incoming dht queries per second allowed from one ip, 0 for unlimited")
+	rejectLowPorts       = flag.Bool("reject-low-ports", false, "reject dht nodes using ports below 1024")
+	minNodes             = flag.Int("min-nodes", 32, "re-bootstrap when the routing table has fewer nodes")
+	useLSD               = flag.Bool("lsd", false, "enable bep-014 local service discovery on the lan")
+	trackerAddr          = flag.String("tracker", "", "embedded http+udp tracker listen addr, e.g. :6969")
+	trackers             = flag.String("trackers", "", "comma separated udp/http tracker urls queried alongside get_peers")
+	watchFile            = flag.String("watch", "", "watchlist file of infohashes to monitor, one \"hex [label]\" per line; changes made through the api are written back")
+	watchWebhook         = flag.String("watch-webhook", "", "url that watchlist events are POSTed to as json")
+	watchThreshold       = flag.Int("watch-threshold", 50, "peer count that triggers a watchlist grew event")
+	watchInterval        = flag.Duration("watch-interval", time.Minute*15, "how often watched infohashes are looked up again")
+	seeds                = flag.String("seed", "", "comma separated hex infohashes announced to the dht periodically")
+	seedPort             = flag.Int("seed-port", 0, "download port announced for -seed infohashes, 0 to use the dht udp port (implied_port)")
+	metricsAddr          = flag.String("metrics-addr", "", "standalone prometheus /metrics listen addr, /metrics is also served on -http")
+	logLevel             = flag.String("log-level", "info", "log levels, e.g. info,dht=debug,metadata=error")
+	logSample            = flag.Int("log-sample", 100, "log one in n packets when a subsystem is at debug level")
+	trace                = flag.Bool("trace", false, "log every dht packet, toggled at runtime with SIGHUP or POST /admin/log?trace=on on the -admin server")
+	showVer        *bool = flag.Bool("v", false, "to show version of mini_datapipe")
 )
 
 func initInerLog() {
@@ -44,6 +90,247 @@ func initLog() error {
 	return err
 }
 
+func restConf(addr string) (rest.RestConf, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return rest.RestConf{}, err
+	}
+	httpPort, err := strconv.Atoi(portStr)
+	if err != nil {
+		return rest.RestConf{}, err
+	}
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	return rest.RestConf{
+		ServiceConf: service.ServiceConf{
+			Name: "ciligo",
+			Mode: service.ProMode,
+		},
+		Host:     host,
+		Port:     httpPort,
+		MaxConns: 10000,
+		MaxBytes: 1048576,
+		Timeout:  30000,
+	}, nil
+}
+
+func startAPI(c *dht.Client, cat *catalog.Catalog, wl *watchlist.Watchlist, metricsHandler http.Handler) error {
+	conf, err := restConf(*httpAddr)
+	if err != nil {
+		return err
+	}
+	server, err := api.NewServer(conf, c, cat, wl)
+	if err != nil {
+		return err
+	}
+	server.Handle(http.MethodGet, "/metrics", metricsHandler)
+	logx.Infof("http api listen:%v", *httpAddr)
+	go server.Start()
+	return nil
+}
+
+// startAdmin 日志级别和关注列表的修改接口，不带认证，只应监听本机或内网地址
+func startAdmin(c *dht.Client, cat *catalog.Catalog, wl *watchlist.Watchlist) error {
+	conf, err := restConf(*adminAddr)
+	if err != nil {
+		return err
+	}
+	server, err := api.NewAdminServer(conf, c, cat, wl)
+	if err != nil {
+		return err
+	}
+	logx.Infof("admin api listen:%v", *adminAddr)
+	go server.Start()
+	return nil
+}
+
+func newTrackerSource() (*tracker.Source, error) {
+	udp, err := tracker.NewUDPClient()
+	if err != nil {
+		return nil, err
+	}
+	http := tracker.NewHTTPClient(time.Second * 15)
+	return tracker.NewSource(udp, http, strings.Split(*trackers, ","), metadata.NewPeerID()), nil
+}
+
+// configureClient 启动节点、私有网络、限速等配置，需在Start之前调用
+func configureClient(c *dht.Client) error {
+	c.SetNetworkID(*networkID)
+	if *bootstrap != "" {
+		c.SetBootstrap(strings.Split(*bootstrap, ","))
+	}
+	if *bootstrapFile != "" {
+		if err := c.LoadBootstrapFile(*bootstrapFile); err != nil {
+			return err
+		}
+	}
+	if *snapshot != "" {
+		if err := c.LoadSnapshot(*snapshot); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	c.SetMinNodes(*minNodes)
+	rate := dht.DefaultRateConfig()
+	rate.Global = *pps
+	c.SetRateLimit(rate)
+	guard := dht.DefaultGuardConfig()
+	guard.QueryRate = *queryRate
+	guard.RejectLowPorts = *rejectLowPorts
+	c.SetGuard(guard)
+	if *blocklist != "" {
+		b, err := dht.LoadBlocklist(*blocklist)
+		if err != nil {
+			return err
+		}
+		c.SetBlocklist(b)
+	}
+	return nil
+}
+
+func saveSnapshot(c *dht.Client) {
+	ticker := time.NewTicker(time.Minute * 5)
+	for range ticker.C {
+		if err := c.SaveSnapshot(*snapshot); err != nil {
+			logx.Infof("save snapshot err:%v", err)
+		}
+	}
+}
+
+// startTracker http和udp监听同一个端口，共用dht的PeerStore
+func startTracker(c *dht.Client) error {
+	server := tracker.NewServer(c.PeerStore())
+	conn, err := net.ListenPacket("udp", *trackerAddr)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", *trackerAddr)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	logx.Infof("tracker listen:%v", *trackerAddr)
+	go server.ServeUDP(conn)
+	go http.Serve(ln, server)
+	return nil
+}
+
+// newWatchlist 关注列表，没有指定文件时只关注ubuntu的iso
+func newWatchlist(c *dht.Client) (*watchlist.Watchlist, error) {
+	conf := watchlist.DefaultConfig()
+	conf.GrowThreshold = *watchThreshold
+	wl := watchlist.New(conf, c)
+	var hook *watchlist.Webhook
+	if *watchWebhook != "" {
+		hook = watchlist.NewWebhook(*watchWebhook, time.Second*10)
+		go hook.Run()
+	}
+	wl.OnEvent(func(e *watchlist.Event) {
+		logx.Infof("watchlist %v infoHash:%v,label:%v,peers:%v", e.Type, e.InfoHash, e.Label, e.Peers)
+		if hook != nil {
+			hook.Send(e)
+		}
+	})
+	c.OnWatch(func(r *dht.WatchResult) {
+		wl.Observe(r.InfoHash, r.Peers, r.Time)
+	})
+	if *watchFile != "" {
+		// 文件不存在时从空列表开始，第一次修改时创建
+		if err := wl.LoadFile(*watchFile); err != nil && !os.IsNotExist(err) {
+			return wl, err
+		}
+		wl.Persist(*watchFile)
+		return wl, nil
+	}
+	// ubuntu-14.04.2-desktop-amd64.iso
+	infoHash, _ := hex.DecodeString("546cf15f724d19c4319cc17b179d7e035f89c1f4")
+	return wl, wl.Add(string(infoHash), "ubuntu-14.04.2-desktop-amd64.iso")
+}
+
+// announceLocal 在局域网组播-seed和关注列表中的infohash(bep-014)，启动时一次，之后每5分钟同步，
+// 关注列表中删除的停止announce
+func announceLocal(local *lsd.Service, seeded []string, wl *watchlist.Watchlist) {
+	ticker := time.NewTicker(time.Minute * 5)
+	defer ticker.Stop()
+	announced := make(map[string]bool)
+	for {
+		current := make(map[string]bool)
+		for _, infoHash := range seeded {
+			current[infoHash] = true
+		}
+		for _, item := range wl.List() {
+			infoHash, _ := hex.DecodeString(item.InfoHash)
+			current[string(infoHash)] = true
+		}
+		for infoHash := range current {
+			local.Announce(infoHash)
+		}
+		for infoHash := range announced {
+			if !current[infoHash] {
+				local.Unannounce(infoHash)
+			}
+		}
+		announced = current
+		<-ticker.C
+	}
+}
+
+// localPingInterval 同一个局域网peer多久ping一次，它announce的每个infohash都会回调一次
+const localPingInterval = time.Minute * 10
+
+// pingLocal 在单独的goroutine里ping局域网peer，按地址去重。Ping受发包限速可能阻塞，
+// 不能放在lsd的收包回调里，队列满时直接丢弃
+func pingLocal(c *dht.Client) func(*net.UDPAddr) {
+	queue := make(chan *net.UDPAddr, 64)
+	go func() {
+		pinged := make(map[string]time.Time)
+		for addr := range queue {
+			now := time.Now()
+			key := addr.String()
+			if last, ok := pinged[key]; ok && now.Sub(last) < localPingInterval {
+				continue
+			}
+			if len(pinged) >= 1024 {
+				for k, last := range pinged {
+					if now.Sub(last) >= localPingInterval {
+						delete(pinged, k)
+					}
+				}
+			}
+			pinged[key] = now
+			c.Ping(addr)
+		}
+	}()
+	return func(addr *net.UDPAddr) {
+		select {
+		case queue <- addr:
+		default:
+		}
+	}
+}
+
+func startMetrics(handler http.Handler) error {
+	ln, err := net.Listen("tcp", *metricsAddr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", handler)
+	logx.Infof("metrics listen:%v", *metricsAddr)
+	go http.Serve(ln, mux)
+	return nil
+}
+
+// toggleTrace 收到SIGHUP时切换包日志trace
+func toggleTrace() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		logging.SetTrace(!logging.Tracing())
+		logx.Infof("packet trace:%v", logging.Tracing())
+	}
+}
+
 func main() {
 	flag.Parse()
 
@@ -55,21 +342,144 @@ func main() {
 	if initLog() != nil {
 		return
 	}
+	if err := logging.SetLevels(*logLevel); err != nil {
+		logx.Infof("log level %v err:%v", *logLevel, err)
+		return
+	}
+	logging.SetSample(*logSample)
+	logging.SetTrace(*trace)
+	go toggleTrace()
 	logx.Info(os.Args)
 	logx.Infof("main port:%v,findnode addr:%v ", *port, *targetAddr)
 	c := dht.NewClient(*port, *targetAddr, *ipv46)
 	if c == nil {
 		logx.Infof("NewClient fail")
 	} else {
-		info := []string{
-			"546cf15f724d19c4319cc17b179d7e035f89c1f4",
-			// "32D9A70EB9E1AD7609C5A6913E8216CFFE95998E",
+		if err := configureClient(c); err != nil {
+			logx.Infof("dht config err:%v", err)
+			return
+		}
+		c.SetWatchInterval(*watchInterval, 0)
+		var seeded []string
+		for _, seed := range strings.Split(*seeds, ",") {
+			if seed == "" {
+				continue
+			}
+			infoHash, _ := hex.DecodeString(seed)
+			if err := c.Seed(string(infoHash), *seedPort, *seedPort == 0); err != nil {
+				logx.Infof("seed %v err:%v", seed, err)
+				return
+			}
+			seeded = append(seeded, string(infoHash))
 		}
-		err := c.Start()
+		wl, err := newWatchlist(c)
 		if err != nil {
+			logx.Infof("watchlist err:%v", err)
 			return
 		}
-		c.SearchFileInfo(info)
+		// 先监听，uTP需要socket；回调都注册完再Start，最初收到的包不会漏掉
+		if err := c.ListenUDP(); err != nil {
+			return
+		}
+		cat := catalog.New()
+		cat.SetMaxTorrents(*catalogMax)
+		var local *lsd.Service
+		if *useLSD {
+			// announce的是下载端口，和-seed一样没有指定时使用dht端口
+			listenPort, _ := strconv.Atoi(*port)
+			if *seedPort != 0 {
+				listenPort = *seedPort
+			}
+			local = lsd.New(listenPort)
+			if err := local.Start(); err != nil {
+				logx.Infof("lsd start err:%v", err)
+				local = nil
+			} else {
+				go announceLocal(local, seeded, wl)
+			}
+		}
+		var pool *metadata.Pool
+		if *fetchWorkers > 0 {
+			conf := metadata.DefaultConfig()
+			conf.Workers = *fetchWorkers
+			dialers := metadata.Dialers{&net.Dialer{Timeout: time.Second * 3}}
+			if *useUTP {
+				// uTP和dht共用udp端口，按首字节分流
+				sock := utp.NewSocket(c.PacketConn())
+				c.OnPacket(sock.HandlePacket)
+				dialers = append(dialers, sock)
+			}
+			sources := metadata.PeerSources{c}
+			if *trackers != "" {
+				if s, err := newTrackerSource(); err != nil {
+					logx.Infof("tracker client err:%v", err)
+				} else {
+					sources = append(sources, s)
+				}
+			}
+			if local != nil {
+				sources = append(sources, local)
+			}
+			pool = metadata.NewPool(conf, dialers, sources, cat)
+			if *pexStore {
+				pool.RecordPex(c.PeerStore())
+			}
+			pool.Start()
+		}
+		c.OnHarvest(func(h *dht.HarvestInfo) {
+			var peer *net.TCPAddr
+			if h.Announce {
+				peer = &net.TCPAddr{IP: h.From.IP, Port: h.Port}
+				cat.Touch(h.InfoHash, peer.String())
+			} else {
+				cat.Touch(h.InfoHash, "")
+			}
+			if pool != nil {
+				pool.Add(h.InfoHash, peer)
+			}
+		})
+		if local != nil {
+			// 局域网peer一般和dht共用端口，ping一下，有回复就进入路由表
+			ping := pingLocal(c)
+			local.OnPeer(func(infoHash string, peer *net.TCPAddr) {
+				cat.Touch(infoHash, peer.String())
+				if pool != nil {
+					pool.Add(infoHash, peer)
+				}
+				ping(&net.UDPAddr{IP: peer.IP, Port: peer.Port, Zone: peer.Zone})
+			})
+		}
+		if err := c.Start(); err != nil {
+			return
+		}
+		if *snapshot != "" {
+			go saveSnapshot(c)
+		}
+		metricsHandler := metrics.Handler(metrics.NewCollector(c, cat, pool))
+		if *metricsAddr != "" {
+			if err := startMetrics(metricsHandler); err != nil {
+				logx.Infof("start metrics err:%v", err)
+				return
+			}
+		}
+		if *trackerAddr != "" {
+			if err := startTracker(c); err != nil {
+				logx.Infof("start tracker err:%v", err)
+				return
+			}
+		}
+		if *httpAddr != "" {
+			if err := startAPI(c, cat, wl, metricsHandler); err != nil {
+				logx.Infof("start http api err:%v", err)
+				return
+			}
+		}
+		if *adminAddr != "" {
+			if err := startAdmin(c, cat, wl); err != nil {
+				logx.Infof("start admin api err:%v", err)
+				return
+			}
+		}
 	}
 	stop := make(chan int, 1)
 	<-stop
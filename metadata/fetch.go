@@ -0,0 +1,195 @@
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+	"github.com/zxw/ciligo/peerwire"
+)
+
+// 通过bep-009协议从peer获取种子的metadata(info字典)
+// http://www.bittorrent.org/beps/bep_0009.html
+// http://www.bittorrent.org/beps/bep_0010.html
+
+const (
+	utMetadataID    = 1 // 我们在扩展握手里声明的ut_metadata编号
+	utPexID         = 2 // 我们在扩展握手里声明的ut_pex编号
+	pieceSize       = 16 * 1024
+	maxMetadataSize = 10 * 1024 * 1024
+)
+
+var (
+	ErrNoExtension    = errors.New("peer does not support extension protocol")
+	ErrNoMetadata     = errors.New("peer does not support ut_metadata")
+	ErrMetadataSize   = errors.New("bad metadata_size")
+	ErrMetadataReject = errors.New("metadata request rejected")
+	ErrMetadataHash   = errors.New("metadata hash mismatch")
+)
+
+// Dialer 建立到peer的连接，net.Dialer和utp都可以用
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+type metadataMsg struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size"`
+}
+
+// Fetch 连接peer并下载infoHash对应的metadata，返回校验过的info字典。
+// 连接期间收到的ut_pex中的peer交给onPex，onPex可以为nil
+func Fetch(ctx context.Context, dialer Dialer, addr string, infoHash string, peerID string, onPex func([]*net.TCPAddr)) ([]byte, error) {
+	netConn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer netConn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		netConn.SetDeadline(deadline)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			netConn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	conn, err := peerwire.NewConn(netConn, &peerwire.Handshake{
+		Reserved: peerwire.DefaultReserved(),
+		InfoHash: infoHash,
+		PeerID:   peerID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !conn.Remote.Reserved.Has(peerwire.ExtensionBit) {
+		return nil, ErrNoExtension
+	}
+	hs, err := (&peerwire.ExtendedHandshake{
+		M: map[string]int{
+			"ut_metadata":    utMetadataID,
+			peerwire.PexName: utPexID,
+		},
+	}).Message()
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.WriteMessage(hs); err != nil {
+		return nil, err
+	}
+
+	var size int
+	var pieces [][]byte
+	received := 0
+	for {
+		m, err := conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if m.KeepAlive || m.ID != peerwire.Extended {
+			continue
+		}
+		switch m.ExtendedID {
+		case utPexID:
+			if onPex == nil {
+				continue
+			}
+			if pex, err := peerwire.ParsePex(m.Data); err == nil {
+				var peers []*net.TCPAddr
+				for _, peer := range pex.AddedPeers() {
+					peers = append(peers, peer.Addr)
+				}
+				if len(peers) > 0 {
+					onPex(peers)
+				}
+			}
+		case peerwire.ExtendedHandshakeID:
+			if pieces != nil {
+				continue
+			}
+			if conn.RemoteExt.ID("ut_metadata") == 0 {
+				return nil, ErrNoMetadata
+			}
+			size = conn.RemoteExt.MetadataSize
+			if size <= 0 || size > maxMetadataSize {
+				return nil, ErrMetadataSize
+			}
+			pieces = make([][]byte, (size+pieceSize-1)/pieceSize)
+			for i := range pieces {
+				if err := conn.WriteExtended("ut_metadata", map[string]interface{}{
+					"msg_type": 0,
+					"piece":    i,
+				}); err != nil {
+					return nil, err
+				}
+			}
+		case utMetadataID:
+			if pieces == nil {
+				continue
+			}
+			msg, data, err := decodeMetadataMsg(m.Data)
+			if err != nil {
+				return nil, err
+			}
+			if msg.MsgType == 2 {
+				return nil, ErrMetadataReject
+			}
+			if msg.MsgType != 1 || msg.Piece < 0 || msg.Piece >= len(pieces) || pieces[msg.Piece] != nil {
+				continue
+			}
+			pieces[msg.Piece] = data
+			received++
+			if received == len(pieces) {
+				info := bytes.Join(pieces, nil)
+				if len(info) != size {
+					return nil, ErrMetadataSize
+				}
+				if sum := sha1.Sum(info); string(sum[:]) != infoHash {
+					return nil, ErrMetadataHash
+				}
+				return info, nil
+			}
+		}
+	}
+}
+
+// data消息是bencode字典后面直接跟piece数据，需要算出字典的长度
+func decodeMetadataMsg(payload []byte) (*metadataMsg, []byte, error) {
+	underlying := bytes.NewReader(payload)
+	r := bufio.NewReader(underlying)
+	var msg metadataMsg
+	if err := bencode.Unmarshal(r, &msg); err != nil {
+		return nil, nil, fmt.Errorf("decode ut_metadata msg: %w", err)
+	}
+	consumed := len(payload) - r.Buffered() - underlying.Len()
+	return &msg, payload[consumed:], nil
+}
+
+// Dialers 依次尝试多个dialer，例如先tcp再uTP
+type Dialers []Dialer
+
+func (dialers Dialers) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	err := errors.New("no dialer")
+	for _, dialer := range dialers {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, network, address)
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return nil, err
+}
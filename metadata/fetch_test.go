@@ -0,0 +1,126 @@
+package metadata
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"net"
+	"testing"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+	"github.com/zxw/ciligo/peerwire"
+)
+
+// servePeer 模拟一个支持ut_metadata的peer
+func servePeer(t *testing.T, ln net.Listener, info []byte) {
+	netConn, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer netConn.Close()
+	remote, err := peerwire.ReadHandshake(netConn)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	peerwire.WriteHandshake(netConn, &peerwire.Handshake{
+		Reserved: peerwire.DefaultReserved(),
+		InfoHash: remote.InfoHash,
+		PeerID:   "-TEST00-000000000000",
+	})
+	conn := &peerwire.Conn{Conn: netConn, Remote: remote}
+	hs, _ := (&peerwire.ExtendedHandshake{
+		M:            map[string]int{"ut_metadata": 3},
+		MetadataSize: len(info),
+	}).Message()
+	conn.WriteMessage(hs)
+	for {
+		m, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if m.ID != peerwire.Extended || m.ExtendedID != 3 {
+			continue
+		}
+		msg, _, err := decodeMetadataMsg(m.Data)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		end := (msg.Piece + 1) * pieceSize
+		if end > len(info) {
+			end = len(info)
+		}
+		var body bytes.Buffer
+		bencode.Marshal(&body, map[string]interface{}{
+			"msg_type":   1,
+			"piece":      msg.Piece,
+			"total_size": len(info),
+		})
+		body.Write(info[msg.Piece*pieceSize : end])
+		conn.WriteMessage(&peerwire.Message{
+			ID:         peerwire.Extended,
+			ExtendedID: conn.RemoteExt.ID("ut_metadata"),
+			Data:       body.Bytes(),
+		})
+	}
+}
+
+func TestFetch(t *testing.T) {
+	var files []map[string]interface{}
+	for i := 0; i < 2000; i++ {
+		files = append(files, map[string]interface{}{
+			"length": i,
+			"path":   []string{"dir", "file" + string(rune('a'+i%26))},
+		})
+	}
+	var buf bytes.Buffer
+	bencode.Marshal(&buf, map[string]interface{}{
+		"name":         "test",
+		"piece length": 16384,
+		"files":        files,
+	})
+	info := buf.Bytes()
+	if len(info) <= pieceSize {
+		t.Fatalf("info too small to test multiple pieces: %v", len(info))
+	}
+	sum := sha1.Sum(info)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go servePeer(t, ln, info)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	got, err := Fetch(ctx, &net.Dialer{}, ln.Addr().String(), string(sum[:]), NewPeerID(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, info) {
+		t.Fatal("metadata mismatch")
+	}
+	name, parsed, err := ParseInfo(got)
+	if err != nil || name != "test" || len(parsed) != 2000 || parsed[1].Length != 1 {
+		t.Fatalf("ParseInfo name=%v files=%v err=%v", name, len(parsed), err)
+	}
+}
+
+func TestFetchHashMismatch(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go servePeer(t, ln, []byte("d4:name4:teste"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	_, err = Fetch(ctx, &net.Dialer{}, ln.Addr().String(), string(make([]byte, 20)), NewPeerID(), nil)
+	if err != ErrMetadataHash {
+		t.Fatalf("err=%v", err)
+	}
+}
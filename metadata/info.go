@@ -0,0 +1,51 @@
+package metadata
+
+import (
+	"bytes"
+	"errors"
+
+	bencode "github.com/jackpal/bencode-go"
+	"github.com/zxw/ciligo/catalog"
+)
+
+var ErrNoName = errors.New("info dict has no name")
+
+type fileInfo struct {
+	Length   int64    `bencode:"length"`
+	Path     []string `bencode:"path"`
+	PathUTF8 []string `bencode:"path.utf-8"`
+}
+
+type infoDict struct {
+	Name     string     `bencode:"name"`
+	NameUTF8 string     `bencode:"name.utf-8"`
+	Length   int64      `bencode:"length"`
+	Files    []fileInfo `bencode:"files"`
+}
+
+// ParseInfo 解析info字典，单文件种子的文件名就是name
+func ParseInfo(info []byte) (string, []catalog.File, error) {
+	var dict infoDict
+	if err := bencode.Unmarshal(bytes.NewReader(info), &dict); err != nil {
+		return "", nil, err
+	}
+	name := dict.Name
+	if dict.NameUTF8 != "" {
+		name = dict.NameUTF8
+	}
+	if name == "" {
+		return "", nil, ErrNoName
+	}
+	if len(dict.Files) == 0 {
+		return name, []catalog.File{{Path: []string{name}, Length: dict.Length}}, nil
+	}
+	files := make([]catalog.File, 0, len(dict.Files))
+	for _, f := range dict.Files {
+		path := f.Path
+		if len(f.PathUTF8) > 0 {
+			path = f.PathUTF8
+		}
+		files = append(files, catalog.File{Path: path, Length: f.Length})
+	}
+	return name, files, nil
+}
@@ -0,0 +1,457 @@
+package metadata
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zeromicro/go-zero/core/logx"
+	"github.com/zxw/ciligo/catalog"
+	"github.com/zxw/ciligo/logging"
+)
+
+var logger = logging.Get("metadata")
+
+var (
+	ErrNoPeers   = errors.New("no candidate peers")
+	ErrQueueFull = errors.New("retry queue full")
+)
+
+// PeerSource 查询infohash的peer，dht.Client实现了它
+type PeerSource interface {
+	GetPeers(ctx context.Context, infoHash string) ([]*net.UDPAddr, error)
+}
+
+// PeerSources 并发查询多个来源(dht、tracker)，合并去重，有一个来源成功即可
+type PeerSources []PeerSource
+
+func (sources PeerSources) GetPeers(ctx context.Context, infoHash string) ([]*net.UDPAddr, error) {
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	seen := make(map[string]bool)
+	var peers []*net.UDPAddr
+	err := ErrNoPeers
+	for _, source := range sources {
+		wg.Add(1)
+		go func(source PeerSource) {
+			defer wg.Done()
+			found, serr := source.GetPeers(ctx, infoHash)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if serr != nil {
+				err = serr
+			}
+			for _, addr := range found {
+				if key := addr.String(); !seen[key] {
+					seen[key] = true
+					peers = append(peers, addr)
+				}
+			}
+		}(source)
+	}
+	wg.Wait()
+	if len(peers) == 0 {
+		return nil, err
+	}
+	return peers, nil
+}
+
+// Finisher 可选，PeerSource实现它时在infohash获取成功或放弃后被调用，tracker.Source用它发送stopped
+type Finisher interface {
+	Finish(infoHash string)
+}
+
+// Finish 通知实现了Finisher的来源
+func (sources PeerSources) Finish(infoHash string) {
+	for _, source := range sources {
+		if f, ok := source.(Finisher); ok {
+			f.Finish(infoHash)
+		}
+	}
+}
+
+// PexStore 记录pex发现的peer，dht.PeerStore实现了它
+type PexStore interface {
+	Add(infoHash string, addr *net.TCPAddr)
+}
+
+// Store 保存metadata，catalog.Catalog实现了它
+type Store interface {
+	HasMetadata(infoHash string) bool
+	SetMetadata(infoHash string, name string, files []catalog.File)
+}
+
+type Config struct {
+	Workers       int           // 同时处理的infohash数
+	PeersPerHash  int           // 每个infohash同时连接的peer数
+	MaxPeers      int           // 每个infohash最多记录和尝试的peer数
+	PeerTimeout   time.Duration // 单个peer的超时
+	LookupTimeout time.Duration // get_peers查询的超时
+	MaxRetries    int
+	RetryBackoff  time.Duration // 第n次重试等待 RetryBackoff*2^(n-1)
+	FailureTTL    time.Duration // 永久失败的infohash在这段时间内不再尝试
+	QueueSize     int
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Workers:       16,
+		PeersPerHash:  4,
+		MaxPeers:      64,
+		PeerTimeout:   time.Second * 10,
+		LookupTimeout: time.Second * 15,
+		MaxRetries:    3,
+		RetryBackoff:  time.Minute,
+		FailureTTL:    time.Hour * 6,
+		QueueSize:     4096,
+	}
+}
+
+// PoolStats 获取统计，Failures按失败原因计数每一次失败的尝试
+type PoolStats struct {
+	Fetched  uint64
+	Failures map[string]uint64
+	GaveUp   uint64 // 多次重试后放弃的infohash
+	Dropped  uint64 // 队列满丢弃的infohash
+	Pending  int
+}
+
+// Failure 多次重试后仍然失败的记录
+type Failure struct {
+	Reason   string
+	Attempts int
+	Time     time.Time
+}
+
+type task struct {
+	infoHash string
+	peers    map[string]*net.TCPAddr
+	attempts int
+}
+
+// Pool 消费收集到的infohash，去重后并发从peer获取metadata
+type Pool struct {
+	conf   Config
+	dialer Dialer
+	source PeerSource
+	store  Store
+	// 可选，pex发现的peer同时记录到这里
+	pexStore PexStore
+	peerID   string
+	queue    chan *task
+	mutex    sync.Mutex
+	tasks    map[string]*task // 排队、处理中或等待重试
+	failed   map[string]*Failure
+	stats    PoolStats
+}
+
+func NewPool(conf Config, dialer Dialer, source PeerSource, store Store) *Pool {
+	return &Pool{
+		conf:   conf,
+		dialer: dialer,
+		source: source,
+		store:  store,
+		peerID: NewPeerID(),
+		queue:  make(chan *task, conf.QueueSize),
+		tasks:  make(map[string]*task),
+		failed: make(map[string]*Failure),
+		stats:  PoolStats{Failures: make(map[string]uint64)},
+	}
+}
+
+// RecordPex 把pex发现的peer也记录到store，需在Start之前调用
+func (p *Pool) RecordPex(store PexStore) {
+	p.pexStore = store
+}
+
+func (p *Pool) Start() {
+	for i := 0; i < p.conf.Workers; i++ {
+		go p.work()
+	}
+	go p.expireLoop()
+}
+
+// expireLoop 定期删除超过FailureTTL的失败记录，否则没有再次提交的infohash会一直留在内存里
+func (p *Pool) expireLoop() {
+	interval := p.conf.FailureTTL / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	for now := range ticker.C {
+		p.expire(now)
+	}
+}
+
+func (p *Pool) expire(now time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for infoHash, f := range p.failed {
+		if now.Sub(f.Time) >= p.conf.FailureTTL {
+			delete(p.failed, infoHash)
+		}
+	}
+}
+
+// Add 提交一个infohash，peer可以为nil。已有元数据、正在处理或近期失败的会被跳过，不会阻塞
+func (p *Pool) Add(infoHash string, peer *net.TCPAddr) {
+	if len(infoHash) != 20 || p.store.HasMetadata(infoHash) {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if f := p.failed[infoHash]; f != nil {
+		if time.Since(f.Time) < p.conf.FailureTTL {
+			return
+		}
+		delete(p.failed, infoHash)
+	}
+	t := p.tasks[infoHash]
+	if t != nil {
+		if peer != nil && len(t.peers) < p.conf.MaxPeers {
+			t.peers[peer.String()] = peer
+		}
+		return
+	}
+	t = &task{
+		infoHash: infoHash,
+		peers:    make(map[string]*net.TCPAddr),
+	}
+	if peer != nil {
+		t.peers[peer.String()] = peer
+	}
+	select {
+	case p.queue <- t:
+		p.tasks[infoHash] = t
+	default:
+		p.stats.Dropped++
+		logger.Debugw("queue full", logging.InfoHash(infoHash))
+	}
+}
+
+// Failed 查询infohash的永久失败记录
+func (p *Pool) Failed(infoHash string) (Failure, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	f := p.failed[infoHash]
+	if f == nil {
+		return Failure{}, false
+	}
+	return *f, true
+}
+
+// Pending 排队、处理中和等待重试的infohash数
+func (p *Pool) Pending() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.tasks)
+}
+
+func (p *Pool) Stats() PoolStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	s := p.stats
+	s.Failures = make(map[string]uint64, len(p.stats.Failures))
+	for reason, n := range p.stats.Failures {
+		s.Failures[reason] = n
+	}
+	s.Pending = len(p.tasks)
+	return s
+}
+
+// failureReason 失败原因分类，用于统计
+func failureReason(err error) string {
+	switch {
+	case errors.Is(err, ErrNoPeers):
+		return "no_peers"
+	case errors.Is(err, ErrNoExtension), errors.Is(err, ErrNoMetadata):
+		return "unsupported"
+	case errors.Is(err, ErrMetadataReject):
+		return "rejected"
+	case errors.Is(err, ErrMetadataHash), errors.Is(err, ErrMetadataSize):
+		return "bad_metadata"
+	case errors.Is(err, ErrNoName):
+		return "bad_info"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return "timeout"
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return "timeout"
+	}
+	return "other"
+}
+
+func (p *Pool) work() {
+	for t := range p.queue {
+		p.process(t)
+	}
+}
+
+func (p *Pool) process(t *task) {
+	if p.store.HasMetadata(t.infoHash) {
+		p.finish(t)
+		return
+	}
+	info, err := p.fetch(t)
+	if err == nil {
+		name, files, perr := ParseInfo(info)
+		if perr == nil {
+			logger.Infow("fetched", logging.InfoHash(t.infoHash), logx.Field("name", name), logx.Field("files", len(files)))
+			p.store.SetMetadata(t.infoHash, name, files)
+			p.mutex.Lock()
+			p.stats.Fetched++
+			p.mutex.Unlock()
+			p.finish(t)
+			return
+		}
+		err = perr
+	}
+	p.retry(t, err)
+}
+
+// fetch 合并announce来源、get_peers和pex发现的peer，限制并发逐个尝试，任一成功即返回
+func (p *Pool) fetch(t *task) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.conf.LookupTimeout)
+	found, _ := p.source.GetPeers(ctx, t.infoHash)
+	cancel()
+	peers := make([]*net.TCPAddr, 0, len(found))
+	for _, addr := range found {
+		peers = append(peers, &net.TCPAddr{IP: addr.IP, Port: addr.Port})
+	}
+	p.addPeers(t, peers)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	type result struct {
+		info []byte
+		err  error
+	}
+	// 同时运行的不超过PeersPerHash个，返回后剩余的协程不会阻塞
+	results := make(chan result, p.conf.PeersPerHash)
+	onPex := func(peers []*net.TCPAddr) {
+		p.addPeers(t, peers)
+		if p.pexStore != nil {
+			for _, peer := range peers {
+				p.pexStore.Add(t.infoHash, peer)
+			}
+		}
+	}
+	tried := make(map[string]bool)
+	running := 0
+	lastErr := ErrNoPeers
+	for {
+		for running < p.conf.PeersPerHash && len(tried) < p.conf.MaxPeers {
+			peer := p.nextPeer(t, tried)
+			if peer == nil {
+				break
+			}
+			running++
+			go func(addr string) {
+				peerCtx, peerCancel := context.WithTimeout(ctx, p.conf.PeerTimeout)
+				defer peerCancel()
+				info, err := Fetch(peerCtx, p.dialer, addr, t.infoHash, p.peerID, onPex)
+				results <- result{info, err}
+			}(peer.String())
+		}
+		if running == 0 {
+			return nil, lastErr
+		}
+		r := <-results
+		running--
+		if r.err == nil {
+			return r.info, nil
+		}
+		lastErr = r.err
+	}
+}
+
+func (p *Pool) addPeers(t *task, peers []*net.TCPAddr) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, peer := range peers {
+		if len(t.peers) >= p.conf.MaxPeers {
+			return
+		}
+		t.peers[peer.String()] = peer
+	}
+}
+
+// nextPeer 取一个本轮还没尝试过的peer
+func (p *Pool) nextPeer(t *task, tried map[string]bool) *net.TCPAddr {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for key, peer := range t.peers {
+		if !tried[key] {
+			tried[key] = true
+			return peer
+		}
+	}
+	return nil
+}
+
+func (p *Pool) retry(t *task, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	t.attempts++
+	p.stats.Failures[failureReason(err)]++
+	if t.attempts > p.conf.MaxRetries {
+		p.stats.GaveUp++
+		p.giveUp(t, err)
+		return
+	}
+	backoff := p.conf.RetryBackoff << uint(t.attempts-1)
+	time.AfterFunc(backoff, func() {
+		select {
+		case p.queue <- t:
+		default:
+			// 队列满时不能静默丢掉，同样记为失败，FailureTTL之后可以重新提交
+			p.mutex.Lock()
+			p.stats.Dropped++
+			p.giveUp(t, ErrQueueFull)
+			p.mutex.Unlock()
+		}
+	})
+}
+
+// giveUp 记录永久失败并移除任务，调用时需持有锁
+func (p *Pool) giveUp(t *task, err error) {
+	logger.Infow("gave up", logging.InfoHash(t.infoHash), logx.Field("attempts", t.attempts), logging.Err(err))
+	p.failed[t.infoHash] = &Failure{
+		Reason:   err.Error(),
+		Attempts: t.attempts,
+		Time:     time.Now(),
+	}
+	delete(p.tasks, t.infoHash)
+	p.notifyFinish(t.infoHash)
+}
+
+func (p *Pool) finish(t *task) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.tasks, t.infoHash)
+	p.notifyFinish(t.infoHash)
+}
+
+// notifyFinish 不在锁内等待来源的网络请求
+func (p *Pool) notifyFinish(infoHash string) {
+	if f, ok := p.source.(Finisher); ok {
+		go f.Finish(infoHash)
+	}
+}
+
+// NewPeerID peer_id = -CL0001- + 12字节随机数
+func NewPeerID() string {
+	buf := make([]byte, 12)
+	rand.Read(buf)
+	id := "-CL0001-"
+	for _, b := range buf {
+		id += strconv.Itoa(int(b % 10))
+	}
+	return id
+}
@@ -0,0 +1,204 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zxw/ciligo/catalog"
+)
+
+var errRefused = errors.New("refused")
+
+// fakeDialer 记录每次拨号的时间，总是失败
+type fakeDialer struct {
+	mutex sync.Mutex
+	dials []time.Time
+}
+
+func (d *fakeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.dials = append(d.dials, time.Now())
+	return nil, errRefused
+}
+
+func (d *fakeDialer) times() []time.Time {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]time.Time(nil), d.dials...)
+}
+
+type fakeSource []*net.UDPAddr
+
+func (s fakeSource) GetPeers(ctx context.Context, infoHash string) ([]*net.UDPAddr, error) {
+	if len(s) == 0 {
+		return nil, ErrNoPeers
+	}
+	return s, nil
+}
+
+// finishSource 记录Finish通知
+type finishSource struct {
+	fakeSource
+	finished chan string
+}
+
+func (s *finishSource) Finish(infoHash string) {
+	s.finished <- infoHash
+}
+
+type fakeStore map[string]bool
+
+func (s fakeStore) HasMetadata(infoHash string) bool {
+	return s[infoHash]
+}
+
+func (s fakeStore) SetMetadata(infoHash string, name string, files []catalog.File) {
+	s[infoHash] = true
+}
+
+func testConfig() Config {
+	conf := DefaultConfig()
+	conf.Workers = 1
+	conf.PeerTimeout = time.Second
+	conf.LookupTimeout = time.Second
+	conf.MaxRetries = 2
+	conf.RetryBackoff = time.Millisecond * 50
+	conf.QueueSize = 2
+	return conf
+}
+
+func hash(b byte) string {
+	h := make([]byte, 20)
+	h[0] = b
+	return string(h)
+}
+
+func TestPoolAdd(t *testing.T) {
+	store := fakeStore{hash(2): true}
+	p := NewPool(testConfig(), &fakeDialer{}, fakeSource(nil), store)
+
+	// 同一个infohash只排队一次，peer合并
+	p.Add(hash(1), &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1})
+	p.Add(hash(1), &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1})
+	if p.Pending() != 1 || len(p.queue) != 1 {
+		t.Fatalf("pending=%v queue=%v", p.Pending(), len(p.queue))
+	}
+	if n := len(p.tasks[hash(1)].peers); n != 2 {
+		t.Fatalf("peers=%v", n)
+	}
+
+	// 已有元数据和长度不对的跳过
+	p.Add(hash(2), nil)
+	p.Add("short", nil)
+	if p.Pending() != 1 {
+		t.Fatalf("pending=%v", p.Pending())
+	}
+
+	// 队列满丢弃
+	p.Add(hash(3), nil)
+	p.Add(hash(4), nil)
+	if st := p.Stats(); st.Pending != 2 || st.Dropped != 1 {
+		t.Fatalf("stats=%+v", st)
+	}
+}
+
+func TestPoolRetry(t *testing.T) {
+	dialer := &fakeDialer{}
+	conf := testConfig()
+	source := &finishSource{fakeSource{{IP: net.IPv4(127, 0, 0, 1), Port: 1}}, make(chan string, 1)}
+	p := NewPool(conf, dialer, source, fakeStore{})
+	p.Start()
+	p.Add(hash(1), nil)
+
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		if _, ok := p.Failed(hash(1)); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("not given up")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	f, _ := p.Failed(hash(1))
+	// 放弃后通知来源，例如向tracker发送stopped
+	select {
+	case infoHash := <-source.finished:
+		if infoHash != hash(1) {
+			t.Fatalf("finished %x", infoHash)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("source not notified")
+	}
+	if f.Attempts != conf.MaxRetries+1 || f.Reason != errRefused.Error() {
+		t.Fatalf("failure=%+v", f)
+	}
+	// 第n次重试等待RetryBackoff*2^(n-1)
+	dials := dialer.times()
+	if len(dials) != conf.MaxRetries+1 {
+		t.Fatalf("dials=%v", len(dials))
+	}
+	for i := 1; i < len(dials); i++ {
+		if gap := dials[i].Sub(dials[i-1]); gap < conf.RetryBackoff<<uint(i-1) {
+			t.Fatalf("retry %v after %v", i, gap)
+		}
+	}
+	st := p.Stats()
+	if st.Pending != 0 || st.GaveUp != 1 || st.Failures["other"] != uint64(conf.MaxRetries+1) {
+		t.Fatalf("stats=%+v", st)
+	}
+
+	// FailureTTL内不再尝试，过期后可以重新提交
+	p.Add(hash(1), nil)
+	if p.Pending() != 0 {
+		t.Fatal("failed infohash queued again")
+	}
+	p.mutex.Lock()
+	p.failed[hash(1)].Time = time.Now().Add(-conf.FailureTTL)
+	p.mutex.Unlock()
+	p.Add(hash(1), nil)
+	if _, ok := p.Failed(hash(1)); ok || p.Pending() != 1 {
+		t.Fatalf("pending=%v after FailureTTL", p.Pending())
+	}
+}
+
+func TestPoolExpire(t *testing.T) {
+	conf := testConfig()
+	p := NewPool(conf, &fakeDialer{}, fakeSource(nil), fakeStore{})
+	now := time.Now()
+	p.failed[hash(1)] = &Failure{Time: now.Add(-conf.FailureTTL)}
+	p.failed[hash(2)] = &Failure{Time: now}
+	// 过期的记录不需要再次提交也会被删除
+	p.expire(now)
+	if _, ok := p.Failed(hash(1)); ok {
+		t.Fatal("expired failure kept")
+	}
+	if _, ok := p.Failed(hash(2)); !ok {
+		t.Fatal("recent failure removed")
+	}
+}
+
+func TestPoolRetryQueueFull(t *testing.T) {
+	conf := testConfig()
+	conf.QueueSize = 1
+	// 不启动worker，队列一直是满的
+	p := NewPool(conf, &fakeDialer{}, fakeSource(nil), fakeStore{})
+	p.Add(hash(1), nil)
+	tk := &task{infoHash: hash(2), peers: make(map[string]*net.TCPAddr)}
+	p.tasks[hash(2)] = tk
+	p.retry(tk, ErrNoPeers)
+
+	time.Sleep(conf.RetryBackoff * 4)
+	f, ok := p.Failed(hash(2))
+	if !ok || f.Reason != ErrQueueFull.Error() || f.Attempts != 1 {
+		t.Fatalf("failure=%+v ok=%v", f, ok)
+	}
+	if st := p.Stats(); st.Pending != 1 || st.Dropped != 1 {
+		t.Fatalf("stats=%+v", st)
+	}
+}
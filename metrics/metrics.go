@@ -0,0 +1,145 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/zxw/ciligo/catalog"
+	"github.com/zxw/ciligo/dht"
+	"github.com/zxw/ciligo/metadata"
+)
+
+// Collector 在每次抓取时从dht、metadata、catalog读取统计，转换成prometheus指标。
+// 各模块只维护自己的计数，不依赖prometheus
+
+const namespace = "ciligo"
+
+var (
+	packetsDesc       = newDesc("dht", "packets_total", "KRPC packets by direction and message type.", "direction", "type")
+	decodeErrorsDesc  = newDesc("dht", "decode_errors_total", "Received packets that failed to decode.")
+	bucketNodesDesc   = newDesc("dht", "bucket_nodes", "Nodes in each routing table bucket, by distance.", "distance")
+	nodesDesc         = newDesc("dht", "nodes", "Nodes in the routing table.")
+	pendingDesc       = newDesc("dht", "pending_transactions", "Queries waiting for a reply.")
+	lookupDesc        = newDesc("dht", "lookup_duration_seconds", "Iterative lookup duration.", "query")
+	harvestedDesc     = newDesc("dht", "infohashes_harvested_total", "Infohashes seen in incoming queries, by query type.", "query")
+	peerStoreDesc     = newDesc("dht", "peer_store_peers", "Peers recorded from announce_peer and tracker announces.")
+	watchingDesc      = newDesc("dht", "watched_infohashes", "Infohashes looked up periodically.")
+	seedingDesc       = newDesc("dht", "seeded_infohashes", "Infohashes announced periodically.")
+	rateSentDesc      = newDesc("dht", "rate_sent_total", "Packets allowed by the send rate limiter.")
+	rateDroppedDesc   = newDesc("dht", "rate_dropped_total", "Packets dropped by the send rate limiter.")
+	rateErrorsDesc    = newDesc("dht", "send_errors_total", "Packets that failed to send.")
+	queryRepliesDesc  = newDesc("dht", "query_replies_total", "Queries answered, by result.", "result")
+	slowdownDesc      = newDesc("dht", "send_slowdown", "Current send rate slowdown factor, 1 for full speed.")
+	guardDesc         = newDesc("dht", "guard_total", "Incoming packets and nodes refused by the guard, by reason.", "reason")
+	bannedDesc        = newDesc("dht", "banned_ips", "IPs currently banned by the guard.")
+	bootstrapDesc     = newDesc("dht", "bootstrap_responses_total", "Responses from each bootstrap host.", "host")
+	healthDesc        = newDesc("dht", "tracked_nodes", "Nodes with response statistics.")
+	fetchedDesc       = newDesc("metadata", "fetched_total", "Torrents whose metadata was fetched.")
+	fetchFailuresDesc = newDesc("metadata", "fetch_failures_total", "Failed metadata fetch attempts, by reason.", "reason")
+	gaveUpDesc        = newDesc("metadata", "gave_up_total", "Infohashes given up after all retries.")
+	droppedDesc       = newDesc("metadata", "dropped_total", "Infohashes dropped because the queue was full.")
+	fetchPendingDesc  = newDesc("metadata", "pending", "Infohashes queued, fetching or waiting to retry.")
+	torrentsDesc      = newDesc("catalog", "torrents", "Unique infohashes in the catalog.")
+)
+
+func newDesc(subsystem, name, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, name), help, labels, nil)
+}
+
+type Collector struct {
+	client  *dht.Client
+	catalog *catalog.Catalog
+	pool    *metadata.Pool // 可以为nil
+}
+
+func NewCollector(client *dht.Client, cat *catalog.Catalog, pool *metadata.Pool) *Collector {
+	return &Collector{client: client, catalog: cat, pool: pool}
+}
+
+// Handler 只包含本collector的/metrics处理函数
+func Handler(c *Collector) http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c)
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		packetsDesc, decodeErrorsDesc, bucketNodesDesc, nodesDesc, pendingDesc, lookupDesc, harvestedDesc,
+		peerStoreDesc, watchingDesc, seedingDesc, rateSentDesc, rateDroppedDesc, rateErrorsDesc, queryRepliesDesc, slowdownDesc,
+		guardDesc, bannedDesc, bootstrapDesc, healthDesc, fetchedDesc, fetchFailuresDesc, gaveUpDesc,
+		droppedDesc, fetchPendingDesc, torrentsDesc,
+	} {
+		ch <- desc
+	}
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	counter := func(desc *prometheus.Desc, v uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(v), labels...)
+	}
+	gauge := func(desc *prometheus.Desc, v float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v, labels...)
+	}
+
+	st := c.client.Stats()
+	for kind, n := range st.Received {
+		counter(packetsDesc, n, "in", kind)
+	}
+	for kind, n := range st.Sent {
+		counter(packetsDesc, n, "out", kind)
+	}
+	counter(decodeErrorsDesc, st.DecodeErrors)
+	total := 0
+	for dis, n := range st.Buckets {
+		gauge(bucketNodesDesc, float64(n), strconv.Itoa(dis))
+		total += n
+	}
+	gauge(nodesDesc, float64(total))
+	gauge(pendingDesc, float64(st.Pending))
+	for q, h := range st.Lookups {
+		buckets := make(map[float64]uint64, len(h.Bounds))
+		for i, bound := range h.Bounds {
+			buckets[bound] = h.Counts[i]
+		}
+		ch <- prometheus.MustNewConstHistogram(lookupDesc, h.Count, h.Sum, buckets, q)
+	}
+	for q, n := range st.Harvested {
+		counter(harvestedDesc, n, q)
+	}
+	gauge(peerStoreDesc, float64(st.Peers))
+	gauge(watchingDesc, float64(st.Watching))
+	gauge(seedingDesc, float64(st.Seeding))
+
+	rate := c.client.RateStats()
+	counter(rateSentDesc, rate.Sent)
+	counter(rateDroppedDesc, rate.Dropped)
+	counter(rateErrorsDesc, rate.Errors)
+	counter(queryRepliesDesc, rate.Replies, "reply")
+	counter(queryRepliesDesc, rate.Timeouts, "timeout")
+	gauge(slowdownDesc, rate.Slowdown)
+	guard := c.client.GuardStats()
+	counter(guardDesc, guard.Limited, "limited")
+	counter(guardDesc, guard.Blocked, "blocked")
+	counter(guardDesc, guard.Rejected, "rejected")
+	counter(guardDesc, guard.Bans, "banned")
+	gauge(bannedDesc, float64(guard.Banned))
+	for _, h := range c.client.BootstrapStatus() {
+		counter(bootstrapDesc, uint64(h.Responses), h.Host)
+	}
+	gauge(healthDesc, float64(st.Tracked))
+
+	if c.pool != nil {
+		ps := c.pool.Stats()
+		counter(fetchedDesc, ps.Fetched)
+		for reason, n := range ps.Failures {
+			counter(fetchFailuresDesc, n, reason)
+		}
+		counter(gaveUpDesc, ps.GaveUp)
+		counter(droppedDesc, ps.Dropped)
+		gauge(fetchPendingDesc, float64(ps.Pending))
+	}
+	gauge(torrentsDesc, float64(c.catalog.Len()))
+}
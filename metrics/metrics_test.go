@@ -0,0 +1,35 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zxw/ciligo/catalog"
+	"github.com/zxw/ciligo/dht"
+	"github.com/zxw/ciligo/metadata"
+)
+
+func TestHandler(t *testing.T) {
+	client := dht.NewClient("0", "", "6")
+	pool := metadata.NewPool(metadata.DefaultConfig(), nil, nil, catalog.New())
+	server := httptest.NewServer(Handler(NewCollector(client, catalog.New(), pool)))
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	for _, want := range []string{
+		`ciligo_dht_packets_total{direction="in",type="get_peers"} 0`,
+		`ciligo_dht_lookup_duration_seconds_bucket{query="find_node",le="+Inf"} 0`,
+		`ciligo_metadata_pending 0`,
+		`ciligo_catalog_torrents 0`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("missing %q", want)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package peerwire
+
+import (
+	"net"
+)
+
+// Conn 完成握手的peer连接
+type Conn struct {
+	net.Conn
+	Remote    *Handshake
+	RemoteExt *ExtendedHandshake // 收到扩展握手之后才有
+}
+
+// NewConn 发送握手并读取对方握手，检查info_hash一致
+func NewConn(conn net.Conn, local *Handshake) (*Conn, error) {
+	if err := WriteHandshake(conn, local); err != nil {
+		return nil, err
+	}
+	remote, err := ReadHandshake(conn)
+	if err != nil {
+		return nil, err
+	}
+	if remote.InfoHash != local.InfoHash {
+		return nil, ErrHandshake
+	}
+	return &Conn{Conn: conn, Remote: remote}, nil
+}
+
+func (c *Conn) ReadMessage() (*Message, error) {
+	m, err := ReadMessage(c.Conn)
+	if err != nil {
+		return nil, err
+	}
+	if m.ID == Extended && m.ExtendedID == ExtendedHandshakeID && !m.KeepAlive {
+		if ext, err := ParseExtendedHandshake(m.Data); err == nil {
+			c.RemoteExt = ext
+		}
+	}
+	return m, nil
+}
+
+func (c *Conn) WriteMessage(m *Message) error {
+	return WriteMessage(c.Conn, m)
+}
+
+// WriteExtended 按对方扩展握手里的编号发送扩展消息
+func (c *Conn) WriteExtended(name string, v interface{}) error {
+	id := c.RemoteExt.ID(name)
+	if id == 0 {
+		return ErrExtensionUnsupported
+	}
+	m, err := NewExtended(id, v)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(m)
+}
@@ -0,0 +1,66 @@
+package peerwire
+
+import (
+	"bytes"
+	"errors"
+	"net"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// 扩展协议 http://www.bittorrent.org/beps/bep_0010.html
+// 扩展握手是extended消息中编号为0的bencode字典，m声明了本端支持的扩展及其消息编号
+
+const ExtendedHandshakeID = 0
+
+var ErrExtensionUnsupported = errors.New("extension not supported by peer")
+
+type ExtendedHandshake struct {
+	M            map[string]int `bencode:"m"`
+	V            string         `bencode:"v,omitempty"`      // 客户端名和版本
+	YourIP       string         `bencode:"yourip,omitempty"` // 对方看到的我们的ip，4或16字节
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+	P            int            `bencode:"p,omitempty"` // 对方的tcp监听端口
+	Reqq         int            `bencode:"reqq,omitempty"`
+}
+
+// ID 对方为扩展name分配的消息编号，0表示不支持
+func (h *ExtendedHandshake) ID(name string) byte {
+	if h == nil {
+		return 0
+	}
+	id := h.M[name]
+	if id <= 0 || id > 255 {
+		return 0
+	}
+	return byte(id)
+}
+
+// RemoteIP 解析yourip字段
+func (h *ExtendedHandshake) RemoteIP() net.IP {
+	if len(h.YourIP) == 4 || len(h.YourIP) == 16 {
+		return net.IP(h.YourIP)
+	}
+	return nil
+}
+
+func (h *ExtendedHandshake) Message() (*Message, error) {
+	return NewExtended(ExtendedHandshakeID, *h)
+}
+
+func ParseExtendedHandshake(data []byte) (*ExtendedHandshake, error) {
+	var h ExtendedHandshake
+	if err := bencode.Unmarshal(bytes.NewReader(data), &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// NewExtended 把v编码成bencode，作为编号为extID的扩展消息
+func NewExtended(extID byte, v interface{}) (*Message, error) {
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, v); err != nil {
+		return nil, err
+	}
+	return &Message{ID: Extended, ExtendedID: extID, Data: buf.Bytes()}, nil
+}
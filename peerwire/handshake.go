@@ -0,0 +1,86 @@
+package peerwire
+
+import (
+	"errors"
+	"io"
+)
+
+// BitTorrent peer协议
+// http://www.bittorrent.org/beps/bep_0003.html
+// v2 http://www.bittorrent.org/beps/bep_0052.html
+// 握手 = <pstrlen><pstr><reserved 8字节><info_hash 20字节><peer_id 20字节>
+// v2的info_hash是sha256截断到20字节
+
+const (
+	Protocol      = "BitTorrent protocol"
+	HandshakeSize = 49 + len(Protocol)
+)
+
+var ErrHandshake = errors.New("bad handshake")
+
+// 保留位
+const (
+	ExtensionBit = 5*8 + 3 // reserved[5] & 0x10 bep-010扩展协议
+	FastBit      = 7*8 + 5 // reserved[7] & 0x04 bep-006 fast extension
+	DHTBit       = 7*8 + 7 // reserved[7] & 0x01 bep-005 dht端口
+)
+
+type Reserved [8]byte
+
+// Set 按bit编号设置保留位，编号从reserved[0]的最高位开始
+func (r *Reserved) Set(bit int) {
+	r[bit/8] |= 1 << uint(7-bit%8)
+}
+
+func (r Reserved) Has(bit int) bool {
+	return r[bit/8]&(1<<uint(7-bit%8)) != 0
+}
+
+type Handshake struct {
+	Reserved Reserved
+	InfoHash string
+	PeerID   string
+}
+
+// DefaultReserved 声明支持扩展协议、dht和fast extension
+func DefaultReserved() Reserved {
+	var r Reserved
+	r.Set(ExtensionBit)
+	r.Set(FastBit)
+	r.Set(DHTBit)
+	return r
+}
+
+func (h *Handshake) Marshal() []byte {
+	buf := make([]byte, 0, HandshakeSize)
+	buf = append(buf, byte(len(Protocol)))
+	buf = append(buf, Protocol...)
+	buf = append(buf, h.Reserved[:]...)
+	buf = append(buf, h.InfoHash...)
+	buf = append(buf, h.PeerID...)
+	return buf
+}
+
+func WriteHandshake(w io.Writer, h *Handshake) error {
+	if len(h.InfoHash) != 20 || len(h.PeerID) != 20 {
+		return ErrHandshake
+	}
+	_, err := w.Write(h.Marshal())
+	return err
+}
+
+func ReadHandshake(r io.Reader) (*Handshake, error) {
+	buf := make([]byte, HandshakeSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	if buf[0] != byte(len(Protocol)) || string(buf[1:20]) != Protocol {
+		return nil, ErrHandshake
+	}
+	h := &Handshake{
+		InfoHash: string(buf[28:48]),
+		PeerID:   string(buf[48:68]),
+	}
+	copy(h.Reserved[:], buf[20:28])
+	return h, nil
+}
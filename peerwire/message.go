@@ -0,0 +1,197 @@
+package peerwire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 消息 = <4字节长度><1字节id><payload>，长度为0是keep-alive
+
+type MessageID byte
+
+const (
+	Choke         MessageID = 0
+	Unchoke       MessageID = 1
+	Interested    MessageID = 2
+	NotInterested MessageID = 3
+	Have          MessageID = 4
+	Bitfield      MessageID = 5
+	Request       MessageID = 6
+	Piece         MessageID = 7
+	Cancel        MessageID = 8
+	Port          MessageID = 9 // bep-005
+	// fast extension bep-006
+	Suggest     MessageID = 13
+	HaveAll     MessageID = 14
+	HaveNone    MessageID = 15
+	Reject      MessageID = 16
+	AllowedFast MessageID = 17
+	Extended    MessageID = 20 // bep-010
+	// v2 bep-052
+	HashRequest MessageID = 21
+	Hashes      MessageID = 22
+	HashReject  MessageID = 23
+)
+
+// MaxMessageSize 超过这个长度的消息认为是异常，piece消息一般是16KiB
+const MaxMessageSize = 256 * 1024
+
+var (
+	ErrMessageTooLarge = errors.New("message too large")
+	ErrBadMessage      = errors.New("bad message")
+)
+
+// Message 解析后的消息，按ID只使用对应的字段
+type Message struct {
+	KeepAlive bool
+	ID        MessageID
+	// have、request、piece、cancel、suggest、reject、allowed_fast
+	Index  uint32
+	Begin  uint32
+	Length uint32
+	// bitfield、piece的数据
+	Data []byte
+	// port
+	Port uint16
+	// extended
+	ExtendedID byte
+	// hash_request、hashes、hash_reject
+	PiecesRoot  string
+	BaseLayer   uint32
+	ProofLayers uint32
+}
+
+func (m *Message) String() string {
+	if m.KeepAlive {
+		return "keep-alive"
+	}
+	return fmt.Sprintf("msg(%d)", m.ID)
+}
+
+func (m *Message) Marshal() []byte {
+	if m.KeepAlive {
+		return []byte{0, 0, 0, 0}
+	}
+	buf := make([]byte, 5, 5+32+len(m.Data))
+	buf[4] = byte(m.ID)
+	switch m.ID {
+	case Have, Suggest, AllowedFast:
+		buf = appendUint32(buf, m.Index)
+	case Request, Cancel, Reject:
+		buf = appendUint32(buf, m.Index)
+		buf = appendUint32(buf, m.Begin)
+		buf = appendUint32(buf, m.Length)
+	case Piece:
+		buf = appendUint32(buf, m.Index)
+		buf = appendUint32(buf, m.Begin)
+		buf = append(buf, m.Data...)
+	case Bitfield:
+		buf = append(buf, m.Data...)
+	case Port:
+		buf = append(buf, byte(m.Port>>8), byte(m.Port))
+	case Extended:
+		buf = append(buf, m.ExtendedID)
+		buf = append(buf, m.Data...)
+	case HashRequest, Hashes, HashReject:
+		buf = append(buf, m.PiecesRoot...)
+		buf = appendUint32(buf, m.BaseLayer)
+		buf = appendUint32(buf, m.Index)
+		buf = appendUint32(buf, m.Length)
+		buf = appendUint32(buf, m.ProofLayers)
+		if m.ID == Hashes {
+			buf = append(buf, m.Data...)
+		}
+	}
+	binary.BigEndian.PutUint32(buf, uint32(len(buf)-4))
+	return buf
+}
+
+func WriteMessage(w io.Writer, m *Message) error {
+	_, err := w.Write(m.Marshal())
+	return err
+}
+
+func ReadMessage(r io.Reader) (*Message, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return &Message{KeepAlive: true}, nil
+	}
+	if length > MaxMessageSize {
+		return nil, ErrMessageTooLarge
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return ParseMessage(buf)
+}
+
+// ParseMessage 解析不带长度前缀的消息
+func ParseMessage(buf []byte) (*Message, error) {
+	if len(buf) == 0 {
+		return &Message{KeepAlive: true}, nil
+	}
+	m := &Message{ID: MessageID(buf[0])}
+	payload := buf[1:]
+	switch m.ID {
+	case Choke, Unchoke, Interested, NotInterested, HaveAll, HaveNone:
+		if len(payload) != 0 {
+			return nil, ErrBadMessage
+		}
+	case Have, Suggest, AllowedFast:
+		if len(payload) != 4 {
+			return nil, ErrBadMessage
+		}
+		m.Index = binary.BigEndian.Uint32(payload)
+	case Request, Cancel, Reject:
+		if len(payload) != 12 {
+			return nil, ErrBadMessage
+		}
+		m.Index = binary.BigEndian.Uint32(payload)
+		m.Begin = binary.BigEndian.Uint32(payload[4:])
+		m.Length = binary.BigEndian.Uint32(payload[8:])
+	case Piece:
+		if len(payload) < 8 {
+			return nil, ErrBadMessage
+		}
+		m.Index = binary.BigEndian.Uint32(payload)
+		m.Begin = binary.BigEndian.Uint32(payload[4:])
+		m.Data = payload[8:]
+	case Bitfield:
+		m.Data = payload
+	case Port:
+		if len(payload) != 2 {
+			return nil, ErrBadMessage
+		}
+		m.Port = binary.BigEndian.Uint16(payload)
+	case Extended:
+		if len(payload) < 1 {
+			return nil, ErrBadMessage
+		}
+		m.ExtendedID = payload[0]
+		m.Data = payload[1:]
+	case HashRequest, Hashes, HashReject:
+		if len(payload) < 48 || (m.ID != Hashes && len(payload) != 48) {
+			return nil, ErrBadMessage
+		}
+		m.PiecesRoot = string(payload[:32])
+		m.BaseLayer = binary.BigEndian.Uint32(payload[32:])
+		m.Index = binary.BigEndian.Uint32(payload[36:])
+		m.Length = binary.BigEndian.Uint32(payload[40:])
+		m.ProofLayers = binary.BigEndian.Uint32(payload[44:])
+		m.Data = payload[48:]
+	default:
+		// 未知消息保留原始数据，由调用方决定是否忽略
+		m.Data = payload
+	}
+	return m, nil
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
@@ -0,0 +1,112 @@
+package peerwire
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	cases := []*Message{
+		{KeepAlive: true},
+		{ID: Choke},
+		{ID: Unchoke},
+		{ID: Interested},
+		{ID: NotInterested},
+		{ID: HaveAll},
+		{ID: Have, Index: 7},
+		{ID: Bitfield, Data: []byte{0xff, 0x80}},
+		{ID: Request, Index: 1, Begin: 16384, Length: 16384},
+		{ID: Cancel, Index: 1, Begin: 0, Length: 16384},
+		{ID: Reject, Index: 2, Begin: 0, Length: 16384},
+		{ID: Piece, Index: 3, Begin: 32768, Data: []byte("data")},
+		{ID: Port, Port: 6881},
+		{ID: AllowedFast, Index: 9},
+		{ID: Extended, ExtendedID: 3, Data: []byte("d8:msg_typei0e5:piecei0ee")},
+		{ID: HashRequest, PiecesRoot: string(make([]byte, 32)), BaseLayer: 0, Index: 0, Length: 512, ProofLayers: 2},
+	}
+	for _, c := range cases {
+		var buf bytes.Buffer
+		if err := WriteMessage(&buf, c); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadMessage(&buf)
+		if err != nil {
+			t.Fatalf("%v: %v", c, err)
+		}
+		// 空payload解析出来是空切片
+		if len(got.Data) == 0 && len(c.Data) == 0 {
+			got.Data = c.Data
+		}
+		if !reflect.DeepEqual(got, c) {
+			t.Fatalf("got %+v want %+v", got, c)
+		}
+	}
+}
+
+func TestBadMessage(t *testing.T) {
+	for _, buf := range [][]byte{
+		{byte(Have), 0, 0},
+		{byte(Request), 0, 0, 0, 1},
+		{byte(Port), 1},
+		{byte(Extended)},
+	} {
+		if _, err := ParseMessage(buf); err != ErrBadMessage {
+			t.Fatalf("%v: err=%v", buf, err)
+		}
+	}
+}
+
+func TestExtendedHandshake(t *testing.T) {
+	h := &ExtendedHandshake{
+		M:            map[string]int{"ut_metadata": 2, "ut_pex": 1},
+		V:            "ciligo 1.0",
+		YourIP:       string([]byte{127, 0, 0, 1}),
+		MetadataSize: 31235,
+		P:            6881,
+	}
+	m, err := h.Message()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseExtendedHandshake(m.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, h) || got.ID("ut_pex") != 1 || got.ID("lt_donthave") != 0 {
+		t.Fatalf("got %+v", got)
+	}
+	if got.RemoteIP().String() != "127.0.0.1" {
+		t.Fatalf("yourip %v", got.RemoteIP())
+	}
+}
+
+func TestReserved(t *testing.T) {
+	r := DefaultReserved()
+	if r[5] != 0x10 || r[7] != 0x05 {
+		t.Fatalf("reserved %x", r)
+	}
+}
+
+func TestPex(t *testing.T) {
+	added := []PexPeer{
+		{Addr: &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4).To4(), Port: 6881}, Flags: PexSeed},
+		{Addr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51413}, Flags: PexUTP | PexReachable},
+	}
+	dropped := []*net.TCPAddr{{IP: net.IPv4(5, 6, 7, 8).To4(), Port: 80}}
+	m, err := NewExtended(1, *NewPex(added, dropped))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pex, err := ParsePex(m.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pex.AddedPeers(), added) {
+		t.Fatalf("added %+v", pex.AddedPeers())
+	}
+	if !reflect.DeepEqual(pex.DroppedPeers(), dropped) {
+		t.Fatalf("dropped %+v", pex.DroppedPeers())
+	}
+}
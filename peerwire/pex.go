@@ -0,0 +1,117 @@
+package peerwire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// Peer Exchange http://www.bittorrent.org/beps/bep_0011.html
+// added/dropped是紧凑格式的peer列表，ipv4每个6字节，ipv6每个18字节；added.f每个peer一个标志字节
+
+const PexName = "ut_pex"
+
+// pex标志位
+const (
+	PexEncryption = 0x01
+	PexSeed       = 0x02
+	PexUTP        = 0x04
+	PexHolepunch  = 0x08
+	PexReachable  = 0x10
+)
+
+type Pex struct {
+	Added    string `bencode:"added"`
+	AddedF   string `bencode:"added.f"`
+	Added6   string `bencode:"added6"`
+	Added6F  string `bencode:"added6.f"`
+	Dropped  string `bencode:"dropped"`
+	Dropped6 string `bencode:"dropped6"`
+}
+
+// PexPeer 一个pex里的peer及其标志
+type PexPeer struct {
+	Addr  *net.TCPAddr
+	Flags byte
+}
+
+func ParsePex(data []byte) (*Pex, error) {
+	var p Pex
+	if err := bencode.Unmarshal(bytes.NewReader(data), &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// NewPex 按地址族把peer分到added和added6
+func NewPex(added []PexPeer, dropped []*net.TCPAddr) *Pex {
+	p := &Pex{}
+	var buf4, buf6, flags4, flags6 []byte
+	for _, peer := range added {
+		if ip := peer.Addr.IP.To4(); ip != nil {
+			buf4 = appendCompact(buf4, ip, peer.Addr.Port)
+			flags4 = append(flags4, peer.Flags)
+		} else if ip := peer.Addr.IP.To16(); ip != nil {
+			buf6 = appendCompact(buf6, ip, peer.Addr.Port)
+			flags6 = append(flags6, peer.Flags)
+		}
+	}
+	p.Added, p.AddedF = string(buf4), string(flags4)
+	p.Added6, p.Added6F = string(buf6), string(flags6)
+	buf4, buf6 = nil, nil
+	for _, addr := range dropped {
+		if ip := addr.IP.To4(); ip != nil {
+			buf4 = appendCompact(buf4, ip, addr.Port)
+		} else if ip := addr.IP.To16(); ip != nil {
+			buf6 = appendCompact(buf6, ip, addr.Port)
+		}
+	}
+	p.Dropped, p.Dropped6 = string(buf4), string(buf6)
+	return p
+}
+
+// AddedPeers 返回added和added6中的peer
+func (p *Pex) AddedPeers() []PexPeer {
+	var peers []PexPeer
+	for i, addr := range DecodeCompactPeers(p.Added, 6) {
+		peer := PexPeer{Addr: addr}
+		if i < len(p.AddedF) {
+			peer.Flags = p.AddedF[i]
+		}
+		peers = append(peers, peer)
+	}
+	for i, addr := range DecodeCompactPeers(p.Added6, 18) {
+		peer := PexPeer{Addr: addr}
+		if i < len(p.Added6F) {
+			peer.Flags = p.Added6F[i]
+		}
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+func (p *Pex) DroppedPeers() []*net.TCPAddr {
+	return append(DecodeCompactPeers(p.Dropped, 6), DecodeCompactPeers(p.Dropped6, 18)...)
+}
+
+// DecodeCompactPeers 解析紧凑格式的peer列表，size为6(ipv4)或18(ipv6)，不完整的尾部忽略
+func DecodeCompactPeers(data string, size int) []*net.TCPAddr {
+	var peers []*net.TCPAddr
+	for i := 0; i+size <= len(data); i += size {
+		ip := make(net.IP, size-2)
+		copy(ip, data[i:i+size-2])
+		port := binary.BigEndian.Uint16([]byte(data[i+size-2 : i+size]))
+		if port == 0 {
+			continue
+		}
+		peers = append(peers, &net.TCPAddr{IP: ip, Port: int(port)})
+	}
+	return peers
+}
+
+func appendCompact(buf []byte, ip net.IP, port int) []byte {
+	buf = append(buf, ip...)
+	return append(buf, byte(port>>8), byte(port))
+}
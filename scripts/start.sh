@@ -8,9 +8,12 @@ else
 fi
 rm -rf log/*
 
+# NETWORK不为空时以私有网络模式启动，只和带相同标识的节点通信
+NET_ARGS=${NETWORK:+-network $NETWORK}
+
 # 启动n个进程
 # ipv6
 # ./ciligo -p 8050 -t "6">./console.out 2>&1 &
-./ciligo -p 8050 >./log/console8050.out 2>&1 &
-./ciligo -p 8051 -a test>./log/console8050.out 2>&1 &
-./ciligo -p 8053 -a localhost:8051 >./log/console8051.out  2>&1 &
\ No newline at end of file
+./ciligo -p 8050 $NET_ARGS >./log/console8050.out 2>&1 &
+./ciligo -p 8051 -a test $NET_ARGS >./log/console8050.out 2>&1 &
+./ciligo -p 8053 -a localhost:8051 $NET_ARGS >./log/console8051.out  2>&1 &
\ No newline at end of file
@@ -0,0 +1,201 @@
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+	"github.com/zxw/ciligo/dht"
+)
+
+// http tracker
+// http://www.bittorrent.org/beps/bep_0003.html
+// compact http://www.bittorrent.org/beps/bep_0023.html
+// peers6 http://www.bittorrent.org/beps/bep_0007.html
+// scrape http://www.bittorrent.org/beps/bep_0048.html
+
+// maxResponseSize tracker响应的上限，peers最多几千个，远小于这个值
+const maxResponseSize = 1 << 20
+
+var (
+	ErrNoScrape         = errors.New("tracker does not support scrape")
+	ErrResponseTooLarge = errors.New("tracker response too large")
+)
+
+type HTTPClient struct {
+	client *http.Client
+}
+
+func NewHTTPClient(timeout time.Duration) *HTTPClient {
+	return &HTTPClient{
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+func (c *HTTPClient) Announce(ctx context.Context, tracker string, req *AnnounceRequest) (*AnnounceResponse, error) {
+	if !isHTTP(tracker) {
+		return nil, ErrBadURL
+	}
+	query := url.Values{}
+	query.Set("info_hash", req.InfoHash)
+	query.Set("peer_id", req.PeerID)
+	query.Set("port", strconv.Itoa(int(req.Port)))
+	query.Set("uploaded", strconv.FormatInt(req.Uploaded, 10))
+	query.Set("downloaded", strconv.FormatInt(req.Downloaded, 10))
+	query.Set("left", strconv.FormatInt(req.Left, 10))
+	query.Set("compact", "1")
+	query.Set("key", strconv.FormatUint(uint64(req.Key), 16))
+	if req.NumWant >= 0 {
+		query.Set("numwant", strconv.Itoa(int(req.NumWant)))
+	}
+	switch req.Event {
+	case EventStarted:
+		query.Set("event", "started")
+	case EventCompleted:
+		query.Set("event", "completed")
+	case EventStopped:
+		query.Set("event", "stopped")
+	}
+	dict, err := c.get(ctx, tracker, query)
+	if err != nil {
+		return nil, err
+	}
+	resp := &AnnounceResponse{
+		Interval:    dictInt(dict, "interval"),
+		MinInterval: dictInt(dict, "min interval"),
+		Seeders:     dictInt(dict, "complete"),
+		Leechers:    dictInt(dict, "incomplete"),
+	}
+	switch peers := dict["peers"].(type) {
+	case string:
+		resp.Peers = compactPeers(peers, 6)
+	case []interface{}:
+		// 非compact格式 [{peer id, ip, port}]
+		for _, item := range peers {
+			peer, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			host, _ := peer["ip"].(string)
+			ip := net.ParseIP(host)
+			port := dictInt(peer, "port")
+			if ip == nil || port <= 0 || port > 65535 {
+				continue
+			}
+			resp.Peers = append(resp.Peers, &net.TCPAddr{IP: ip, Port: port})
+		}
+	}
+	if peers6, ok := dict["peers6"].(string); ok {
+		resp.Peers = append(resp.Peers, compactPeers(peers6, 18)...)
+	}
+	return resp, nil
+}
+
+// Scrape scrape地址由announce地址最后一段的announce替换为scrape得到
+func (c *HTTPClient) Scrape(ctx context.Context, tracker string, infoHashes []string) ([]ScrapeResult, error) {
+	if !isHTTP(tracker) {
+		return nil, ErrBadURL
+	}
+	u, err := url.Parse(tracker)
+	if err != nil {
+		return nil, err
+	}
+	i := strings.LastIndex(u.Path, "/")
+	if !strings.HasPrefix(u.Path[i+1:], "announce") {
+		return nil, ErrNoScrape
+	}
+	u.Path = u.Path[:i+1] + "scrape" + u.Path[i+1+len("announce"):]
+	query := url.Values{}
+	for _, infoHash := range infoHashes {
+		query.Add("info_hash", infoHash)
+	}
+	dict, err := c.get(ctx, u.String(), query)
+	if err != nil {
+		return nil, err
+	}
+	files, _ := dict["files"].(map[string]interface{})
+	results := make([]ScrapeResult, 0, len(infoHashes))
+	for _, infoHash := range infoHashes {
+		result := ScrapeResult{InfoHash: infoHash}
+		if file, ok := files[infoHash].(map[string]interface{}); ok {
+			result.Seeders = dictInt(file, "complete")
+			result.Completed = dictInt(file, "downloaded")
+			result.Leechers = dictInt(file, "incomplete")
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// get 在tracker原有的参数(如passkey)后追加query，返回bencode字典
+func (c *HTTPClient) get(ctx context.Context, tracker string, query url.Values) (map[string]interface{}, error) {
+	sep := "?"
+	if strings.Contains(tracker, "?") {
+		sep = "&"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tracker+sep+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &Error{Tracker: tracker, Message: resp.Status}
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxResponseSize {
+		return nil, ErrResponseTooLarge
+	}
+	v, err := bencode.Decode(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("decode tracker response: %w", err)
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, ErrBadResponse
+	}
+	if reason, ok := dict["failure reason"].(string); ok {
+		return nil, &Error{Tracker: tracker, Message: reason}
+	}
+	return dict, nil
+}
+
+func isHTTP(tracker string) bool {
+	return strings.HasPrefix(tracker, "http://") || strings.HasPrefix(tracker, "https://")
+}
+
+func dictInt(dict map[string]interface{}, key string) int {
+	v, _ := dict[key].(int64)
+	return int(v)
+}
+
+// compactPeers 按size切分后用dht的compact格式解码，size为6(ipv4)或18(ipv6)
+func compactPeers(data string, size int) []*net.TCPAddr {
+	values := make([]string, 0, len(data)/size)
+	for i := 0; i+size <= len(data); i += size {
+		values = append(values, data[i:i+size])
+	}
+	var peers []*net.TCPAddr
+	for _, addr := range dht.DecodeCompactValues(values) {
+		if addr.Port == 0 {
+			continue
+		}
+		peers = append(peers, &net.TCPAddr{IP: addr.IP, Port: addr.Port})
+	}
+	return peers
+}
@@ -0,0 +1,132 @@
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+func newFakeHTTPTracker(t *testing.T, handler func(w http.ResponseWriter, r *http.Request) interface{}) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		if err := bencode.Marshal(&buf, handler(w, r)); err != nil {
+			t.Error(err)
+		}
+		w.Write(buf.Bytes())
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestHTTPAnnounce(t *testing.T) {
+	infoHash := strings.Repeat("\xff", 20)
+	server := newFakeHTTPTracker(t, func(w http.ResponseWriter, r *http.Request) interface{} {
+		query := r.URL.Query()
+		if query.Get("info_hash") != infoHash || query.Get("compact") != "1" || query.Get("passkey") != "x" {
+			return map[string]interface{}{"failure reason": "bad query " + r.URL.RawQuery}
+		}
+		return map[string]interface{}{
+			"interval":   900,
+			"complete":   4,
+			"incomplete": 6,
+			"peers":      "\x0a\x00\x00\x01\x1a\xe1",
+			"peers6":     "\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe2",
+		}
+	})
+	c := NewHTTPClient(time.Second)
+	resp, err := c.Announce(context.Background(), server.URL+"/announce?passkey=x", &AnnounceRequest{
+		InfoHash: infoHash,
+		PeerID:   strings.Repeat("p", 20),
+		Port:     6881,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Interval != 900 || resp.Seeders != 4 || resp.Leechers != 6 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	if len(resp.Peers) != 2 || resp.Peers[0].String() != "10.0.0.1:6881" || resp.Peers[1].String() != "[2001:db8::1]:6882" {
+		t.Fatalf("unexpected peers %v", resp.Peers)
+	}
+}
+
+func TestHTTPAnnounceDictPeers(t *testing.T) {
+	server := newFakeHTTPTracker(t, func(w http.ResponseWriter, r *http.Request) interface{} {
+		return map[string]interface{}{
+			"interval": 60,
+			"peers": []interface{}{
+				map[string]interface{}{"peer id": strings.Repeat("a", 20), "ip": "192.168.1.2", "port": 51413},
+				map[string]interface{}{"ip": "bogus", "port": 1},
+			},
+		}
+	})
+	resp, err := NewHTTPClient(time.Second).Announce(context.Background(), server.URL+"/announce", &AnnounceRequest{
+		InfoHash: strings.Repeat("a", 20),
+		PeerID:   strings.Repeat("p", 20),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Peers) != 1 || resp.Peers[0].String() != "192.168.1.2:51413" {
+		t.Fatalf("unexpected peers %v", resp.Peers)
+	}
+}
+
+func TestHTTPFailureReason(t *testing.T) {
+	server := newFakeHTTPTracker(t, func(w http.ResponseWriter, r *http.Request) interface{} {
+		return map[string]interface{}{"failure reason": "unregistered torrent"}
+	})
+	_, err := NewHTTPClient(time.Second).Announce(context.Background(), server.URL+"/announce", &AnnounceRequest{})
+	var trackerErr *Error
+	if !errors.As(err, &trackerErr) || trackerErr.Message != "unregistered torrent" {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestHTTPScrape(t *testing.T) {
+	infoHash := strings.Repeat("b", 20)
+	server := newFakeHTTPTracker(t, func(w http.ResponseWriter, r *http.Request) interface{} {
+		if r.URL.Path != "/x/scrape" {
+			return map[string]interface{}{"failure reason": "bad path " + r.URL.Path}
+		}
+		return map[string]interface{}{
+			"files": map[string]interface{}{
+				infoHash: map[string]interface{}{"complete": 3, "downloaded": 10, "incomplete": 1},
+			},
+		}
+	})
+	c := NewHTTPClient(time.Second)
+	results, err := c.Scrape(context.Background(), server.URL+"/x/announce", []string{infoHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Seeders != 3 || results[0].Completed != 10 || results[0].Leechers != 1 {
+		t.Fatalf("unexpected scrape %+v", results)
+	}
+	if _, err := c.Scrape(context.Background(), server.URL+"/x/tracker", []string{infoHash}); err != ErrNoScrape {
+		t.Fatalf("err = %v, want ErrNoScrape", err)
+	}
+}
+
+func TestHTTPResponseTooLarge(t *testing.T) {
+	server := newFakeHTTPTracker(t, func(w http.ResponseWriter, r *http.Request) interface{} {
+		return map[string]interface{}{
+			"interval": 900,
+			"peers":    strings.Repeat("\x0a\x00\x00\x01\x1a\xe1", maxResponseSize/6+1),
+		}
+	})
+	_, err := NewHTTPClient(time.Second).Announce(context.Background(), server.URL+"/announce", &AnnounceRequest{
+		InfoHash: strings.Repeat("a", 20),
+		PeerID:   strings.Repeat("p", 20),
+	})
+	if err != ErrResponseTooLarge {
+		t.Fatalf("err = %v, want ErrResponseTooLarge", err)
+	}
+}
@@ -0,0 +1,327 @@
+package tracker
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+	"github.com/zeromicro/go-zero/core/logx"
+	"github.com/zxw/ciligo/logging"
+)
+
+var logger = logging.Get("tracker")
+
+// 内置tracker，http和udp共用dht的PeerStore
+
+const (
+	serverInterval = 1800 // 秒
+	defaultNumWant = 50
+	maxNumWant     = 200
+	connIDWindow   = time.Minute
+	maxUDPResponse = 1472 // 不分片的最大udp负载
+)
+
+// PeerStore dht.PeerStore实现了它
+type PeerStore interface {
+	Announce(infoHash string, addr *net.TCPAddr, seed bool)
+	Remove(infoHash string, addr *net.TCPAddr)
+	Completed(infoHash string)
+	Get(infoHash string, max int) []*net.TCPAddr
+	Stats(infoHash string) (seeders, leechers, completed int)
+}
+
+type Server struct {
+	store  PeerStore
+	secret []byte
+}
+
+func NewServer(store PeerStore) *Server {
+	secret := make([]byte, 20)
+	rand.Read(secret)
+	return &Server{
+		store:  store,
+		secret: secret,
+	}
+}
+
+// announce 处理一次announce，返回给请求方的peer(不含请求方自己)
+func (s *Server) announce(req *AnnounceRequest, addr *net.TCPAddr) (*AnnounceResponse, error) {
+	if len(req.InfoHash) != 20 || len(req.PeerID) != 20 {
+		return nil, errors.New("invalid info_hash or peer_id")
+	}
+	switch {
+	case req.Port == 0:
+		// 端口为0表示只取peer不提供下载(例如tracker.Source)，不记录
+	case req.Event == EventStopped:
+		s.store.Remove(req.InfoHash, addr)
+	case req.Event == EventCompleted:
+		// 先记录peer，第一次出现就是completed的也要计数
+		s.store.Announce(req.InfoHash, addr, req.Left == 0)
+		s.store.Completed(req.InfoHash)
+	default:
+		s.store.Announce(req.InfoHash, addr, req.Left == 0)
+	}
+	numWant := int(req.NumWant)
+	if numWant < 0 {
+		numWant = defaultNumWant
+	}
+	if numWant > maxNumWant {
+		numWant = maxNumWant
+	}
+	resp := &AnnounceResponse{Interval: serverInterval}
+	resp.Seeders, resp.Leechers, _ = s.store.Stats(req.InfoHash)
+	if req.Event == EventStopped {
+		return resp, nil
+	}
+	for _, peer := range s.store.Get(req.InfoHash, numWant+1) {
+		if len(resp.Peers) < numWant && peer.String() != addr.String() {
+			resp.Peers = append(resp.Peers, peer)
+		}
+	}
+	return resp, nil
+}
+
+func (s *Server) scrape(infoHashes []string) []ScrapeResult {
+	results := make([]ScrapeResult, 0, len(infoHashes))
+	for _, infoHash := range infoHashes {
+		result := ScrapeResult{InfoHash: infoHash}
+		result.Seeders, result.Leechers, result.Completed = s.store.Stats(infoHash)
+		results = append(results, result)
+	}
+	return results
+}
+
+// ServeHTTP 处理/announce和/scrape
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var resp interface{}
+	switch r.URL.Path {
+	case "/announce":
+		resp = s.httpAnnounce(r)
+	case "/scrape":
+		resp = s.httpScrape(r)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(buf.Bytes())
+}
+
+func failure(reason string) map[string]interface{} {
+	return map[string]interface{}{"failure reason": reason}
+}
+
+func (s *Server) httpAnnounce(r *http.Request) interface{} {
+	query := r.URL.Query()
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return failure("bad remote address")
+	}
+	port, err := strconv.ParseUint(query.Get("port"), 10, 16)
+	if err != nil {
+		return failure("invalid port")
+	}
+	left, _ := strconv.ParseInt(query.Get("left"), 10, 64)
+	numWant := int64(-1)
+	if v := query.Get("numwant"); v != "" {
+		numWant, _ = strconv.ParseInt(v, 10, 32)
+	}
+	req := &AnnounceRequest{
+		InfoHash: query.Get("info_hash"),
+		PeerID:   query.Get("peer_id"),
+		Left:     left,
+		NumWant:  int32(numWant),
+		Port:     uint16(port),
+	}
+	switch query.Get("event") {
+	case "started":
+		req.Event = EventStarted
+	case "completed":
+		req.Event = EventCompleted
+	case "stopped":
+		req.Event = EventStopped
+	}
+	resp, err := s.announce(req, &net.TCPAddr{IP: net.ParseIP(host), Port: int(port)})
+	if err != nil {
+		return failure(err.Error())
+	}
+	dict := map[string]interface{}{
+		"interval":   resp.Interval,
+		"complete":   resp.Seeders,
+		"incomplete": resp.Leechers,
+	}
+	if query.Get("compact") == "0" {
+		peers := make([]interface{}, 0, len(resp.Peers))
+		for _, peer := range resp.Peers {
+			peers = append(peers, map[string]interface{}{
+				"ip":   peer.IP.String(),
+				"port": peer.Port,
+			})
+		}
+		dict["peers"] = peers
+		return dict
+	}
+	// compact默认开启，ipv4放peers，ipv6放peers6
+	var peers, peers6 []byte
+	for _, peer := range resp.Peers {
+		if ip := peer.IP.To4(); ip != nil {
+			peers = appendPeer(peers, ip, peer.Port)
+		} else {
+			peers6 = appendPeer(peers6, peer.IP.To16(), peer.Port)
+		}
+	}
+	dict["peers"] = string(peers)
+	if len(peers6) > 0 {
+		dict["peers6"] = string(peers6)
+	}
+	return dict
+}
+
+func (s *Server) httpScrape(r *http.Request) interface{} {
+	infoHashes := r.URL.Query()["info_hash"]
+	if len(infoHashes) == 0 {
+		// 不支持返回全部种子
+		return failure("info_hash required")
+	}
+	files := make(map[string]interface{})
+	for _, result := range s.scrape(infoHashes) {
+		files[result.InfoHash] = map[string]interface{}{
+			"complete":   result.Seeders,
+			"downloaded": result.Completed,
+			"incomplete": result.Leechers,
+		}
+	}
+	return map[string]interface{}{"files": files}
+}
+
+func appendPeer(buf []byte, ip net.IP, port int) []byte {
+	buf = append(buf, ip...)
+	return append(buf, byte(port>>8), byte(port))
+}
+
+// ServeUDP 在conn上处理bep-015请求，conn关闭后返回
+func (s *Server) ServeUDP(conn net.PacketConn) error {
+	buffer := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok || n < 16 {
+			continue
+		}
+		if resp := s.handleUDP(buffer[:n], udpAddr); resp != nil {
+			conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (s *Server) handleUDP(req []byte, addr *net.UDPAddr) []byte {
+	action := binary.BigEndian.Uint32(req[8:12])
+	resp := make([]byte, 8, 256)
+	binary.BigEndian.PutUint32(resp[0:4], action)
+	copy(resp[4:8], req[12:16])
+	if action == actionConnect {
+		if binary.BigEndian.Uint64(req[0:8]) != protocolID {
+			return nil
+		}
+		return appendUint64(resp, s.connectionID(addr.IP, time.Now()))
+	}
+	if !s.validConnectionID(binary.BigEndian.Uint64(req[0:8]), addr.IP) {
+		return udpError(req, "invalid connection id")
+	}
+	switch action {
+	case actionAnnounce:
+		if len(req) < 98 {
+			return udpError(req, "bad announce")
+		}
+		port := binary.BigEndian.Uint16(req[96:98])
+		announce := &AnnounceRequest{
+			InfoHash: string(req[16:36]),
+			PeerID:   string(req[36:56]),
+			Left:     int64(binary.BigEndian.Uint64(req[64:72])),
+			Event:    int32(binary.BigEndian.Uint32(req[80:84])),
+			NumWant:  int32(binary.BigEndian.Uint32(req[92:96])),
+			Port:     port,
+		}
+		result, err := s.announce(announce, &net.TCPAddr{IP: addr.IP, Port: int(port)})
+		if err != nil {
+			return udpError(req, err.Error())
+		}
+		resp = appendUint32s(resp, uint32(result.Interval), uint32(result.Leechers), uint32(result.Seeders))
+		// udp只返回和请求方同一地址族的peer
+		v4 := addr.IP.To4() != nil
+		for _, peer := range result.Peers {
+			if len(resp)+18 > maxUDPResponse {
+				break
+			}
+			if ip := peer.IP.To4(); v4 && ip != nil {
+				resp = appendPeer(resp, ip, peer.Port)
+			} else if !v4 && ip == nil {
+				resp = appendPeer(resp, peer.IP.To16(), peer.Port)
+			}
+		}
+		return resp
+	case actionScrape:
+		var infoHashes []string
+		for i := 16; i+20 <= len(req) && len(infoHashes) < maxScrapeHashes; i += 20 {
+			infoHashes = append(infoHashes, string(req[i:i+20]))
+		}
+		for _, result := range s.scrape(infoHashes) {
+			resp = appendUint32s(resp, uint32(result.Seeders), uint32(result.Completed), uint32(result.Leechers))
+		}
+		return resp
+	}
+	return udpError(req, "unknown action")
+}
+
+// connectionID 由secret、ip和时间窗口算出，不用保存状态，有效期1到2分钟
+func (s *Server) connectionID(ip net.IP, now time.Time) uint64 {
+	window := make([]byte, 8)
+	binary.BigEndian.PutUint64(window, uint64(now.Unix()/int64(connIDWindow/time.Second)))
+	h := sha1.New()
+	h.Write(s.secret)
+	h.Write(ip.To16())
+	h.Write(window)
+	return binary.BigEndian.Uint64(h.Sum(nil))
+}
+
+func (s *Server) validConnectionID(id uint64, ip net.IP) bool {
+	now := time.Now()
+	return id == s.connectionID(ip, now) || id == s.connectionID(ip, now.Add(-connIDWindow))
+}
+
+func udpError(req []byte, msg string) []byte {
+	logger.Debugw("udp error reply", logx.Field("msg", msg))
+	resp := make([]byte, 8, 8+len(msg))
+	binary.BigEndian.PutUint32(resp[0:4], actionError)
+	copy(resp[4:8], req[12:16])
+	return append(resp, msg...)
+}
+
+func appendUint32s(buf []byte, vs ...uint32) []byte {
+	for _, v := range vs {
+		buf = append(buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+	return buf
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	return appendUint32s(buf, uint32(v>>32), uint32(v))
+}
@@ -0,0 +1,146 @@
+package tracker
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zxw/ciligo/dht"
+)
+
+func TestServer(t *testing.T) {
+	server := NewServer(dht.NewPeerStore())
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go server.ServeUDP(conn)
+
+	udp := newTestClient(t)
+	httpClient := NewHTTPClient(time.Second)
+	ctx := context.Background()
+	infoHash := strings.Repeat("i", 20)
+	udpURL := "udp://" + conn.LocalAddr().String() + "/announce"
+	httpURL := httpServer.URL + "/announce"
+
+	// 做种者通过udp announce
+	resp, err := udp.Announce(ctx, udpURL, &AnnounceRequest{
+		InfoHash: infoHash,
+		PeerID:   strings.Repeat("a", 20),
+		Event:    EventStarted,
+		NumWant:  -1,
+		Port:     7001,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Seeders != 1 || len(resp.Peers) != 0 {
+		t.Fatalf("unexpected first announce %+v", resp)
+	}
+	// 下载者通过http announce，拿到做种者
+	resp, err = httpClient.Announce(ctx, httpURL, &AnnounceRequest{
+		InfoHash: infoHash,
+		PeerID:   strings.Repeat("b", 20),
+		Left:     100,
+		Event:    EventStarted,
+		NumWant:  -1,
+		Port:     7002,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Seeders != 1 || resp.Leechers != 1 || len(resp.Peers) != 1 || resp.Peers[0].Port != 7001 {
+		t.Fatalf("unexpected second announce %+v", resp)
+	}
+
+	results, err := udp.Scrape(ctx, udpURL, []string{infoHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Seeders != 1 || results[0].Leechers != 1 {
+		t.Fatalf("unexpected udp scrape %+v", results)
+	}
+
+	// 下载者停止后只剩做种者
+	if _, err = httpClient.Announce(ctx, httpURL, &AnnounceRequest{
+		InfoHash: infoHash,
+		PeerID:   strings.Repeat("b", 20),
+		Left:     100,
+		Event:    EventStopped,
+		Port:     7002,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	results, err = httpClient.Scrape(ctx, httpURL, []string{infoHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Seeders != 1 || results[0].Leechers != 0 {
+		t.Fatalf("unexpected http scrape %+v", results)
+	}
+}
+
+func TestServerRejectsBadConnectionID(t *testing.T) {
+	server := NewServer(dht.NewPeerStore())
+	req := make([]byte, 98)
+	req[11] = actionAnnounce
+	resp := server.handleUDP(req, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+	if len(resp) < 8 || resp[3] != actionError {
+		t.Fatalf("expected error response, got %x", resp)
+	}
+}
+
+func TestServerFirstCompleted(t *testing.T) {
+	server := NewServer(dht.NewPeerStore())
+	infoHash := strings.Repeat("c", 20)
+	// 第一次announce就是completed
+	resp, err := server.announce(&AnnounceRequest{
+		InfoHash: infoHash,
+		PeerID:   strings.Repeat("a", 20),
+		Event:    EventCompleted,
+		Port:     7001,
+	}, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 7001})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Seeders != 1 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	results := server.scrape([]string{infoHash})
+	if results[0].Seeders != 1 || results[0].Completed != 1 {
+		t.Fatalf("unexpected scrape %+v", results)
+	}
+}
+
+func TestServerPortZero(t *testing.T) {
+	server := NewServer(dht.NewPeerStore())
+	infoHash := strings.Repeat("z", 20)
+	seeder := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 7001}
+	if _, err := server.announce(&AnnounceRequest{InfoHash: infoHash, PeerID: strings.Repeat("a", 20), Port: 7001}, seeder); err != nil {
+		t.Fatal(err)
+	}
+	// 端口为0的只取peer，不加入peer列表
+	resp, err := server.announce(&AnnounceRequest{InfoHash: infoHash, PeerID: strings.Repeat("b", 20), Left: 1, NumWant: -1}, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Peers) != 1 || resp.Peers[0].String() != seeder.String() || resp.Seeders != 1 || resp.Leechers != 0 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+
+	// 我们自己的tracker客户端可以用在自己的tracker上
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	source := NewSource(nil, NewHTTPClient(time.Second), []string{httpServer.URL + "/announce"}, strings.Repeat("c", 20))
+	peers, err := source.GetPeers(context.Background(), infoHash)
+	if err != nil || len(peers) != 1 || peers[0].Port != seeder.Port {
+		t.Fatalf("peers = %v, err = %v", peers, err)
+	}
+	source.Finish(infoHash)
+}
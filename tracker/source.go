@@ -0,0 +1,181 @@
+package tracker
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zeromicro/go-zero/core/logx"
+	"github.com/zxw/ciligo/logging"
+)
+
+const (
+	defaultInterval = time.Minute * 30
+	maxCached       = 10000
+	stoppedTimeout  = time.Second * 15
+)
+
+var ErrNoTrackers = errors.New("no trackers")
+
+type cachedAnnounce struct {
+	peers []*net.TCPAddr
+	next  time.Time
+}
+
+// Source 并发向多个tracker announce，合并返回的peer。实现了metadata.PeerSource，可以和dht的get_peers一起使用。
+// 在tracker给出的interval内不重复announce，直接返回上次的结果。
+// 我们只取metadata，不提供下载：announce不带event，端口为0，获取结束后调用Finish发送stopped
+type Source struct {
+	udp      *UDPClient
+	http     *HTTPClient
+	trackers []string
+	peerID   string
+	key      uint32
+	mutex    sync.Mutex
+	cache    map[string]*cachedAnnounce // tracker+infohash，只记录成功的announce
+}
+
+func NewSource(udp *UDPClient, http *HTTPClient, trackers []string, peerID string) *Source {
+	return &Source{
+		udp:      udp,
+		http:     http,
+		trackers: trackers,
+		peerID:   peerID,
+		key:      newKey(),
+		cache:    make(map[string]*cachedAnnounce),
+	}
+}
+
+func (s *Source) newRequest(infoHash string, event int32) *AnnounceRequest {
+	return &AnnounceRequest{
+		InfoHash: infoHash,
+		PeerID:   s.peerID,
+		Left:     1, // left为0时tracker可能不返回做种者
+		Event:    event,
+		Key:      s.key,
+		NumWant:  -1,
+	}
+}
+
+func (s *Source) send(ctx context.Context, tracker string, req *AnnounceRequest) (*AnnounceResponse, error) {
+	switch {
+	case strings.HasPrefix(tracker, "udp://") && s.udp != nil:
+		return s.udp.Announce(ctx, tracker, req)
+	case isHTTP(tracker) && s.http != nil:
+		return s.http.Announce(ctx, tracker, req)
+	}
+	return nil, ErrBadURL
+}
+
+func (s *Source) announce(ctx context.Context, tracker string, req *AnnounceRequest) ([]*net.TCPAddr, error) {
+	key := tracker + req.InfoHash
+	s.mutex.Lock()
+	cached := s.cache[key]
+	s.mutex.Unlock()
+	if cached != nil && time.Now().Before(cached.next) {
+		return cached.peers, nil
+	}
+	resp, err := s.send(ctx, tracker, req)
+	if err != nil {
+		return nil, err
+	}
+	interval := time.Duration(resp.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	if min := time.Duration(resp.MinInterval) * time.Second; interval < min {
+		interval = min
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.cache) >= maxCached {
+		s.expire()
+	}
+	s.cache[key] = &cachedAnnounce{peers: resp.Peers, next: time.Now().Add(interval)}
+	return resp.Peers, nil
+}
+
+func (s *Source) expire() {
+	now := time.Now()
+	for key, cached := range s.cache {
+		if now.After(cached.next) {
+			delete(s.cache, key)
+		}
+	}
+}
+
+func (s *Source) GetPeers(ctx context.Context, infoHash string) ([]*net.UDPAddr, error) {
+	if len(s.trackers) == 0 {
+		return nil, ErrNoTrackers
+	}
+	req := s.newRequest(infoHash, EventNone)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	seen := make(map[string]bool)
+	var peers []*net.UDPAddr
+	var lastErr error
+	for _, tracker := range s.trackers {
+		wg.Add(1)
+		go func(tracker string) {
+			defer wg.Done()
+			found, err := s.announce(ctx, tracker, req)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				lastErr = err
+				return
+			}
+			for _, peer := range found {
+				if key := peer.String(); !seen[key] {
+					seen[key] = true
+					peers = append(peers, &net.UDPAddr{IP: peer.IP, Port: peer.Port})
+				}
+			}
+		}(tracker)
+	}
+	wg.Wait()
+	if len(peers) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return peers, nil
+}
+
+// Finish infohash获取成功或放弃后，向announce过的tracker发送stopped，让tracker删除我们
+func (s *Source) Finish(infoHash string) {
+	var announced []string
+	s.mutex.Lock()
+	for _, tracker := range s.trackers {
+		if key := tracker + infoHash; s.cache[key] != nil {
+			announced = append(announced, tracker)
+			delete(s.cache, key)
+		}
+	}
+	s.mutex.Unlock()
+	if len(announced) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), stoppedTimeout)
+	defer cancel()
+	req := s.newRequest(infoHash, EventStopped)
+	var wg sync.WaitGroup
+	for _, tracker := range announced {
+		wg.Add(1)
+		go func(tracker string) {
+			defer wg.Done()
+			if _, err := s.send(ctx, tracker, req); err != nil {
+				logger.Debugw("send stopped", logx.Field("tracker", tracker), logging.InfoHash(infoHash), logging.Err(err))
+			}
+		}(tracker)
+	}
+	wg.Wait()
+}
+
+func newKey() uint32 {
+	var buf [4]byte
+	rand.Read(buf[:])
+	return uint32(buf[0])<<24 | uint32(buf[1])<<16 | uint32(buf[2])<<8 | uint32(buf[3])
+}
@@ -0,0 +1,43 @@
+package tracker
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSource(t *testing.T) {
+	var mutex sync.Mutex
+	var queries []string
+	server := newFakeHTTPTracker(t, func(w http.ResponseWriter, r *http.Request) interface{} {
+		mutex.Lock()
+		queries = append(queries, r.URL.Query().Get("event")+"/"+r.URL.Query().Get("port"))
+		mutex.Unlock()
+		return map[string]interface{}{
+			"interval": 900,
+			"peers":    "\x0a\x00\x00\x01\x1a\xe1",
+		}
+	})
+	s := NewSource(nil, NewHTTPClient(time.Second), []string{server.URL + "/announce"}, strings.Repeat("p", 20))
+	infoHash := strings.Repeat("i", 20)
+
+	// 只取peer，不带event，端口为0；interval内使用缓存
+	for i := 0; i < 2; i++ {
+		peers, err := s.GetPeers(context.Background(), infoHash)
+		if err != nil || len(peers) != 1 || peers[0].String() != "10.0.0.1:6881" {
+			t.Fatalf("peers=%v err=%v", peers, err)
+		}
+	}
+	// 获取结束后发送一次stopped
+	s.Finish(infoHash)
+	s.Finish(infoHash)
+	s.Finish(strings.Repeat("x", 20))
+	mutex.Lock()
+	defer mutex.Unlock()
+	if strings.Join(queries, ",") != "/0,stopped/0" {
+		t.Fatalf("queries=%v", queries)
+	}
+}
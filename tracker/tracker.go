@@ -0,0 +1,70 @@
+package tracker
+
+import (
+	"errors"
+	"net"
+	"net/url"
+)
+
+// tracker协议
+// http://www.bittorrent.org/beps/bep_0003.html
+// udp http://www.bittorrent.org/beps/bep_0015.html
+
+// announce的event
+const (
+	EventNone      = 0
+	EventCompleted = 1
+	EventStarted   = 2
+	EventStopped   = 3
+)
+
+var ErrBadURL = errors.New("unsupported tracker url")
+
+type AnnounceRequest struct {
+	InfoHash   string
+	PeerID     string
+	Downloaded int64
+	Left       int64
+	Uploaded   int64
+	Event      int32
+	Key        uint32
+	NumWant    int32 // -1表示由tracker决定
+	Port       uint16
+}
+
+type AnnounceResponse struct {
+	Interval    int // 秒
+	MinInterval int
+	Leechers    int
+	Seeders     int
+	Peers       []*net.TCPAddr
+}
+
+type ScrapeResult struct {
+	InfoHash  string
+	Seeders   int
+	Completed int
+	Leechers  int
+}
+
+// Error tracker返回的错误信息
+type Error struct {
+	Tracker string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return "tracker " + e.Tracker + ": " + e.Message
+}
+
+// udpHost 从udp://host:port/announce中取出host:port
+func udpHost(tracker string) (string, error) {
+	u, err := url.Parse(tracker)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "udp" || u.Port() == "" {
+		return "", ErrBadURL
+	}
+	return u.Host, nil
+}
@@ -0,0 +1,284 @@
+package tracker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/zeromicro/go-zero/core/logx"
+)
+
+const (
+	protocolID      = 0x41727101980
+	actionConnect   = 0
+	actionAnnounce  = 1
+	actionScrape    = 2
+	actionError     = 3
+	connIDLifetime  = time.Minute
+	maxScrapeHashes = 74 // 一个包最多scrape的infohash数
+)
+
+var (
+	ErrBadResponse = errors.New("bad tracker response")
+	ErrTimeout     = errors.New("udp tracker timeout")
+)
+
+type connID struct {
+	id      uint64
+	expires time.Time
+}
+
+// UDPClient bep-015 udp tracker客户端，多个tracker共用一个udp socket，按transaction_id分发回包
+type UDPClient struct {
+	// 第n次重传等待 Timeout*2^n，超过MaxRetries次返回超时
+	Timeout    time.Duration
+	MaxRetries int
+
+	conn    *net.UDPConn
+	mutex   sync.Mutex
+	pending map[uint32]chan []byte
+	connIDs map[string]connID
+}
+
+func NewUDPClient() (*UDPClient, error) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	c := &UDPClient{
+		Timeout:    time.Second * 15,
+		MaxRetries: 3,
+		conn:       conn,
+		pending:    make(map[uint32]chan []byte),
+		connIDs:    make(map[string]connID),
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+func (c *UDPClient) Close() error {
+	return c.conn.Close()
+}
+
+func (c *UDPClient) readLoop() {
+	buffer := make([]byte, 65536)
+	for {
+		n, _, err := c.conn.ReadFromUDP(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if n < 8 {
+			continue
+		}
+		tx := binary.BigEndian.Uint32(buffer[4:8])
+		c.mutex.Lock()
+		ch := c.pending[tx]
+		delete(c.pending, tx)
+		c.mutex.Unlock()
+		if ch != nil {
+			ch <- append([]byte(nil), buffer[:n]...)
+		}
+	}
+}
+
+// roundTrip 发送请求并等待回包，超时按指数退避重传。req[12:16]会被填上transaction_id
+func (c *UDPClient) roundTrip(ctx context.Context, host string, req []byte, action uint32) ([]byte, error) {
+	addr, err := net.ResolveUDPAddr("udp", host)
+	if err != nil {
+		return nil, err
+	}
+	for n := 0; n <= c.MaxRetries; n++ {
+		tx := c.newTransaction()
+		ch := make(chan []byte, 1)
+		c.mutex.Lock()
+		c.pending[tx] = ch
+		c.mutex.Unlock()
+		binary.BigEndian.PutUint32(req[12:16], tx)
+		if _, err := c.conn.WriteToUDP(req, addr); err != nil {
+			c.cancel(tx)
+			return nil, err
+		}
+		timer := time.NewTimer(c.Timeout << uint(n))
+		select {
+		case resp := <-ch:
+			timer.Stop()
+			return parseResponse(host, resp, action)
+		case <-timer.C:
+			c.cancel(tx)
+			logger.Debugw("udp tracker timeout", logx.Field("host", host), logx.Field("retry", n+1))
+		case <-ctx.Done():
+			timer.Stop()
+			c.cancel(tx)
+			return nil, ctx.Err()
+		}
+	}
+	return nil, ErrTimeout
+}
+
+func parseResponse(host string, resp []byte, action uint32) ([]byte, error) {
+	got := binary.BigEndian.Uint32(resp[0:4])
+	if got == actionError {
+		return nil, &Error{Tracker: host, Message: string(resp[8:])}
+	}
+	if got != action {
+		return nil, ErrBadResponse
+	}
+	return resp, nil
+}
+
+func (c *UDPClient) newTransaction() uint32 {
+	var buf [4]byte
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for {
+		rand.Read(buf[:])
+		tx := binary.BigEndian.Uint32(buf[:])
+		if c.pending[tx] == nil {
+			return tx
+		}
+	}
+}
+
+func (c *UDPClient) cancel(tx uint32) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.pending, tx)
+}
+
+// connect 获取connection_id，1分钟内复用
+func (c *UDPClient) connect(ctx context.Context, host string) (uint64, error) {
+	c.mutex.Lock()
+	cached, ok := c.connIDs[host]
+	c.mutex.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.id, nil
+	}
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[0:8], protocolID)
+	binary.BigEndian.PutUint32(req[8:12], actionConnect)
+	resp, err := c.roundTrip(ctx, host, req, actionConnect)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp) < 16 {
+		return 0, ErrBadResponse
+	}
+	id := binary.BigEndian.Uint64(resp[8:16])
+	c.mutex.Lock()
+	c.connIDs[host] = connID{id: id, expires: time.Now().Add(connIDLifetime)}
+	c.mutex.Unlock()
+	return id, nil
+}
+
+func (c *UDPClient) forget(host string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.connIDs, host)
+}
+
+// request 带connection_id的请求，tracker返回错误时可能是connection_id失效，重新connect后再试一次。
+// 超时说明tracker不可达，不再重试
+func (c *UDPClient) request(ctx context.Context, host string, action uint32, body []byte) ([]byte, error) {
+	for i := 0; ; i++ {
+		id, err := c.connect(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		req := make([]byte, 16+len(body))
+		binary.BigEndian.PutUint64(req[0:8], id)
+		binary.BigEndian.PutUint32(req[8:12], action)
+		copy(req[16:], body)
+		resp, err := c.roundTrip(ctx, host, req, action)
+		var trackerErr *Error
+		if i == 0 && errors.As(err, &trackerErr) {
+			c.forget(host)
+			continue
+		}
+		return resp, err
+	}
+}
+
+// Announce tracker为udp://host:port/announce格式
+func (c *UDPClient) Announce(ctx context.Context, tracker string, req *AnnounceRequest) (*AnnounceResponse, error) {
+	host, err := udpHost(tracker)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.InfoHash) != 20 || len(req.PeerID) != 20 {
+		return nil, errors.New("infohash and peer id must be 20 bytes")
+	}
+	body := make([]byte, 82)
+	copy(body[0:20], req.InfoHash)
+	copy(body[20:40], req.PeerID)
+	binary.BigEndian.PutUint64(body[40:48], uint64(req.Downloaded))
+	binary.BigEndian.PutUint64(body[48:56], uint64(req.Left))
+	binary.BigEndian.PutUint64(body[56:64], uint64(req.Uploaded))
+	binary.BigEndian.PutUint32(body[64:68], uint32(req.Event))
+	// ip为0表示使用源地址
+	binary.BigEndian.PutUint32(body[72:76], req.Key)
+	binary.BigEndian.PutUint32(body[76:80], uint32(req.NumWant))
+	binary.BigEndian.PutUint16(body[80:82], req.Port)
+	resp, err := c.request(ctx, host, actionAnnounce, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 20 {
+		return nil, ErrBadResponse
+	}
+	result := &AnnounceResponse{
+		Interval: int(binary.BigEndian.Uint32(resp[8:12])),
+		Leechers: int(binary.BigEndian.Uint32(resp[12:16])),
+		Seeders:  int(binary.BigEndian.Uint32(resp[16:20])),
+	}
+	// ipv6的tracker返回18字节的peer
+	size := 6
+	if addr, err := net.ResolveUDPAddr("udp", host); err == nil && addr.IP.To4() == nil {
+		size = 18
+	}
+	result.Peers = compactPeers(string(resp[20:]), size)
+	return result, nil
+}
+
+// Scrape 查询多个infohash的做种数、完成数和下载数
+func (c *UDPClient) Scrape(ctx context.Context, tracker string, infoHashes []string) ([]ScrapeResult, error) {
+	host, err := udpHost(tracker)
+	if err != nil {
+		return nil, err
+	}
+	var results []ScrapeResult
+	for len(infoHashes) > 0 {
+		batch := infoHashes
+		if len(batch) > maxScrapeHashes {
+			batch = batch[:maxScrapeHashes]
+		}
+		infoHashes = infoHashes[len(batch):]
+		body := make([]byte, 0, 20*len(batch))
+		for _, infoHash := range batch {
+			body = append(body, infoHash...)
+		}
+		resp, err := c.request(ctx, host, actionScrape, body)
+		if err != nil {
+			return nil, err
+		}
+		if len(resp) < 8+12*len(batch) {
+			return nil, ErrBadResponse
+		}
+		for i, infoHash := range batch {
+			b := resp[8+12*i:]
+			results = append(results, ScrapeResult{
+				InfoHash:  infoHash,
+				Seeders:   int(binary.BigEndian.Uint32(b[0:4])),
+				Completed: int(binary.BigEndian.Uint32(b[4:8])),
+				Leechers:  int(binary.BigEndian.Uint32(b[8:12])),
+			})
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,171 @@
+package tracker
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeUDPTracker 最简单的bep-015 tracker，dropFirst个包不回复用于测试重传
+type fakeUDPTracker struct {
+	conn      *net.UDPConn
+	connects  int32
+	dropFirst int32
+	received  int32
+}
+
+func newFakeUDPTracker(t *testing.T, dropFirst int32) *fakeUDPTracker {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeUDPTracker{conn: conn, dropFirst: dropFirst}
+	go f.serve()
+	t.Cleanup(func() { conn.Close() })
+	return f
+}
+
+func (f *fakeUDPTracker) url() string {
+	return "udp://" + f.conn.LocalAddr().String() + "/announce"
+}
+
+func (f *fakeUDPTracker) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := f.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if atomic.AddInt32(&f.received, 1) <= f.dropFirst || n < 16 {
+			continue
+		}
+		action := binary.BigEndian.Uint32(buf[8:12])
+		resp := make([]byte, 8, 64)
+		binary.BigEndian.PutUint32(resp[0:4], action)
+		copy(resp[4:8], buf[12:16])
+		switch action {
+		case actionConnect:
+			atomic.AddInt32(&f.connects, 1)
+			resp = append(resp, 0, 0, 0, 0, 0, 0, 0, 42)
+		case actionAnnounce:
+			if binary.BigEndian.Uint64(buf[0:8]) != 42 {
+				resp = errorResp(buf, "bad connection id")
+				break
+			}
+			resp = appendUint32s(resp, 1800, 3, 5)
+			resp = append(resp, 10, 0, 0, 1, 0x1a, 0xe1, 10, 0, 0, 2, 0x1a, 0xe2)
+		case actionScrape:
+			for i := 16; i+20 <= n; i += 20 {
+				resp = appendUint32s(resp, uint32(buf[i]), 7, 2)
+			}
+		}
+		f.conn.WriteToUDP(resp, addr)
+	}
+}
+
+func errorResp(req []byte, msg string) []byte {
+	resp := make([]byte, 8)
+	binary.BigEndian.PutUint32(resp[0:4], actionError)
+	copy(resp[4:8], req[12:16])
+	return append(resp, msg...)
+}
+
+func newTestClient(t *testing.T) *UDPClient {
+	c, err := NewUDPClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Timeout = time.Millisecond * 100
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestUDPAnnounceAndScrape(t *testing.T) {
+	f := newFakeUDPTracker(t, 0)
+	c := newTestClient(t)
+	ctx := context.Background()
+	infoHash := strings.Repeat("a", 20)
+	resp, err := c.Announce(ctx, f.url(), &AnnounceRequest{
+		InfoHash: infoHash,
+		PeerID:   strings.Repeat("p", 20),
+		NumWant:  -1,
+		Port:     6881,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Interval != 1800 || resp.Leechers != 3 || resp.Seeders != 5 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	if len(resp.Peers) != 2 || resp.Peers[0].String() != "10.0.0.1:6881" || resp.Peers[1].String() != "10.0.0.2:6882" {
+		t.Fatalf("unexpected peers %v", resp.Peers)
+	}
+
+	results, err := c.Scrape(ctx, f.url(), []string{infoHash, strings.Repeat("b", 20)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Seeders != 'a' || results[1].Seeders != 'b' || results[1].Completed != 7 || results[1].Leechers != 2 {
+		t.Fatalf("unexpected scrape %+v", results)
+	}
+	// connection_id在有效期内复用
+	if n := atomic.LoadInt32(&f.connects); n != 1 {
+		t.Fatalf("connects = %v, want 1", n)
+	}
+}
+
+func TestUDPRetransmit(t *testing.T) {
+	f := newFakeUDPTracker(t, 2)
+	c := newTestClient(t)
+	_, err := c.Scrape(context.Background(), f.url(), []string{strings.Repeat("a", 20)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&f.received); n != 4 {
+		t.Fatalf("received = %v, want 4", n)
+	}
+}
+
+func TestUDPTimeout(t *testing.T) {
+	f := newFakeUDPTracker(t, 1000)
+	c := newTestClient(t)
+	c.MaxRetries = 1
+	_, err := c.Scrape(context.Background(), f.url(), []string{strings.Repeat("a", 20)})
+	if err == nil {
+		t.Fatal("expected timeout")
+	}
+}
+
+func TestUDPReconnect(t *testing.T) {
+	ctx := context.Background()
+	req := &AnnounceRequest{InfoHash: strings.Repeat("a", 20), PeerID: strings.Repeat("p", 20), Port: 6881}
+
+	// connection_id失效时tracker返回错误，重新connect后成功
+	f := newFakeUDPTracker(t, 0)
+	c := newTestClient(t)
+	host, _ := udpHost(f.url())
+	c.connIDs[host] = connID{id: 7, expires: time.Now().Add(time.Minute)}
+	if _, err := c.Announce(ctx, f.url(), req); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&f.connects); n != 1 {
+		t.Fatalf("connects = %v, want 1", n)
+	}
+
+	// 超时不重新connect
+	f = newFakeUDPTracker(t, 1000)
+	c = newTestClient(t)
+	c.MaxRetries = 1
+	host, _ = udpHost(f.url())
+	c.connIDs[host] = connID{id: 42, expires: time.Now().Add(time.Minute)}
+	if _, err := c.Announce(ctx, f.url(), req); err != ErrTimeout {
+		t.Fatalf("err = %v, want ErrTimeout", err)
+	}
+	if n := atomic.LoadInt32(&f.received); n != 2 {
+		t.Fatalf("received = %v, want 2", n)
+	}
+}
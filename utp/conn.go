@@ -0,0 +1,496 @@
+package utp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// 连接状态
+const (
+	stateSynSent = iota
+	stateSynRecv
+	stateConnected
+	stateFinSent
+	stateClosed
+)
+
+const (
+	recvBufferSize = 1024 * 1024
+	maxTransmits   = 8 // 同一个包重传超过这个次数认为连接断开
+	tickInterval   = 50 * time.Millisecond
+	dupAckResend   = 3
+)
+
+type outPacket struct {
+	hdr       header
+	payload   []byte
+	sentAt    time.Time
+	transmits int
+}
+
+// Conn 一个uTP连接，实现了net.Conn
+type Conn struct {
+	socket         *Socket
+	raddr          *net.UDPAddr
+	recvID, sendID uint16
+
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	state     int
+	err       error
+	connected chan struct{}
+	done      chan struct{}
+
+	// 发送
+	seqNr     uint16 // 下一个发出的包序号
+	inflight  []*outPacket
+	curWindow int // 在途字节数
+	peerWnd   int
+	lastAck   uint16
+	dupAcks   int
+	cc        *ledbat
+	finSeq    uint16
+
+	// 接收
+	ackNr     uint16 // 按序收到的最后一个包
+	reorder   map[uint16][]byte
+	readBuf   bytes.Buffer
+	gotFin    bool
+	eofSeq    uint16
+	eof       bool
+	replyDiff uint32 // 回给对方的timestamp_difference
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	deadlineTimer *time.Timer
+}
+
+func newConn(s *Socket, raddr *net.UDPAddr, recvID, sendID uint16) *Conn {
+	c := &Conn{
+		socket:    s,
+		raddr:     raddr,
+		recvID:    recvID,
+		sendID:    sendID,
+		state:     stateSynRecv,
+		connected: make(chan struct{}),
+		done:      make(chan struct{}),
+		peerWnd:   maxWindow,
+		cc:        newLedbat(),
+		reorder:   make(map[uint16][]byte),
+	}
+	c.cond = sync.NewCond(&c.mutex)
+	go c.loop()
+	return c
+}
+
+// connect 发起方发送SYN，SYN和数据包一样会超时重传
+func (c *Conn) connect() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.state = stateSynSent
+	c.seqNr = 1
+	c.lastAck = 0
+	c.sendPacket(stSyn, nil, c.recvID)
+}
+
+// sendPacket 发送占用序号的包(SYN、DATA、FIN)，加入在途队列等待确认
+func (c *Conn) sendPacket(typ uint8, payload []byte, connID uint16) {
+	p := &outPacket{
+		hdr: header{
+			typ:    typ,
+			connID: connID,
+			seqNr:  c.seqNr,
+		},
+		payload: payload,
+	}
+	c.seqNr++
+	c.inflight = append(c.inflight, p)
+	c.curWindow += len(payload)
+	c.transmit(p)
+}
+
+func (c *Conn) transmit(p *outPacket) {
+	p.hdr.timestamp = nowMicros()
+	p.hdr.timeDiff = c.replyDiff
+	p.hdr.wndSize = c.recvWindow()
+	p.hdr.ackNr = c.ackNr
+	p.sentAt = time.Now()
+	p.transmits++
+	c.socket.write(p.hdr.marshal(p.payload), c.raddr)
+}
+
+// sendState 发送确认包，不占用序号
+func (c *Conn) sendState() {
+	h := &header{
+		typ:       stState,
+		connID:    c.sendID,
+		timestamp: nowMicros(),
+		timeDiff:  c.replyDiff,
+		wndSize:   c.recvWindow(),
+		seqNr:     c.seqNr,
+		ackNr:     c.ackNr,
+		sack:      c.sackMask(),
+	}
+	c.socket.write(h.marshal(nil), c.raddr)
+}
+
+func (c *Conn) recvWindow() uint32 {
+	if c.readBuf.Len() >= recvBufferSize {
+		return 0
+	}
+	return uint32(recvBufferSize - c.readBuf.Len())
+}
+
+// sackMask 乱序收到的包，第i位对应ack_nr+2+i，长度需为4的倍数
+func (c *Conn) sackMask() []byte {
+	if len(c.reorder) == 0 {
+		return nil
+	}
+	mask := make([]byte, 4)
+	for seq := range c.reorder {
+		i := int(seq - c.ackNr - 2)
+		if i < 0 || i >= 32*8 {
+			continue
+		}
+		for i/8 >= len(mask) {
+			mask = append(mask, 0, 0, 0, 0)
+		}
+		mask[i/8] |= 1 << uint(i%8)
+	}
+	return mask
+}
+
+// handle 处理收到的包，由Socket调用
+func (c *Conn) handle(h *header, payload []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	defer c.cond.Broadcast()
+	if c.state == stateClosed {
+		return
+	}
+	c.replyDiff = nowMicros() - h.timestamp
+
+	switch h.typ {
+	case stReset:
+		c.fail(ErrReset)
+		return
+	case stSyn:
+		// 被动方：记录对方序号并回确认，重复的SYN只重发确认
+		if c.state == stateSynRecv {
+			c.ackNr = h.seqNr
+			c.seqNr = randomSeq()
+			c.lastAck = c.seqNr - 1
+			c.state = stateConnected
+			close(c.connected)
+		}
+		c.sendState()
+		return
+	}
+
+	if c.state == stateSynSent {
+		if h.typ != stState {
+			return
+		}
+		c.ackNr = h.seqNr - 1
+		c.state = stateConnected
+		close(c.connected)
+	}
+	c.peerWnd = int(h.wndSize)
+	c.processAck(h)
+
+	if h.typ == stData || h.typ == stFin {
+		if h.typ == stFin && !c.gotFin {
+			c.gotFin = true
+			c.eofSeq = h.seqNr
+		}
+		c.receive(h.seqNr, payload)
+		c.sendState()
+	}
+	if c.state == stateFinSent && len(c.inflight) == 0 {
+		c.teardown(nil)
+	}
+}
+
+// receive 按序的数据放入读缓冲，超前的放入乱序队列
+func (c *Conn) receive(seq uint16, payload []byte) {
+	if seq == c.ackNr+1 {
+		c.deliver(seq, payload)
+		for {
+			next, ok := c.reorder[c.ackNr+1]
+			if !ok {
+				break
+			}
+			delete(c.reorder, c.ackNr+1)
+			c.deliver(c.ackNr+1, next)
+		}
+		return
+	}
+	if seqLess(c.ackNr, seq) && seq-c.ackNr < 0x4000 {
+		c.reorder[seq] = payload
+	}
+}
+
+func (c *Conn) deliver(seq uint16, payload []byte) {
+	c.ackNr = seq
+	c.readBuf.Write(payload)
+	if c.gotFin && seq == c.eofSeq {
+		c.eof = true
+	}
+}
+
+// processAck 删除已确认的包，更新rtt和拥塞窗口，处理快速重传
+func (c *Conn) processAck(h *header) {
+	acked := 0
+	now := time.Now()
+	remain := c.inflight[:0]
+	for _, p := range c.inflight {
+		if !seqLess(h.ackNr, p.hdr.seqNr) || sacked(h, p.hdr.seqNr) {
+			acked += len(p.payload)
+			if p.transmits == 1 {
+				c.cc.onRTT(now.Sub(p.sentAt))
+			}
+			continue
+		}
+		remain = append(remain, p)
+	}
+	c.inflight = remain
+	c.curWindow -= acked
+	if acked > 0 || seqLess(c.lastAck, h.ackNr) {
+		c.cc.onAck(acked, h.timeDiff)
+		c.lastAck = h.ackNr
+		c.dupAcks = 0
+	} else if len(c.inflight) > 0 && h.typ == stState && h.ackNr == c.lastAck {
+		c.dupAcks++
+	}
+	// 重复确认或sack显示后面已收到多个包，说明第一个在途包丢了。每个包只快速重传一次，之后靠超时
+	if len(c.inflight) > 0 && c.inflight[0].transmits == 1 &&
+		(c.dupAcks >= dupAckResend || sackCount(h) >= dupAckResend) {
+		c.dupAcks = 0
+		c.cc.onLoss()
+		c.transmit(c.inflight[0])
+	}
+}
+
+func sacked(h *header, seq uint16) bool {
+	i := int(seq - h.ackNr - 2)
+	if i < 0 || i/8 >= len(h.sack) {
+		return false
+	}
+	return h.sack[i/8]&(1<<uint(i%8)) != 0
+}
+
+func sackCount(h *header) int {
+	n := 0
+	for _, b := range h.sack {
+		for ; b != 0; b &= b - 1 {
+			n++
+		}
+	}
+	return n
+}
+
+// loop 定时检查重传超时
+func (c *Conn) loop() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		c.mutex.Lock()
+		if len(c.inflight) > 0 && time.Since(c.inflight[0].sentAt) > c.cc.rto {
+			p := c.inflight[0]
+			if p.transmits >= maxTransmits {
+				if c.state == stateSynSent {
+					c.fail(ErrRefused)
+				} else {
+					c.fail(ErrTimeout)
+				}
+			} else {
+				c.cc.onTimeout()
+				c.transmit(p)
+			}
+			c.cond.Broadcast()
+		}
+		c.mutex.Unlock()
+	}
+}
+
+// Read 实现net.Conn
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for c.readBuf.Len() == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		if !c.readDeadline.IsZero() && !time.Now().Before(c.readDeadline) {
+			return 0, ErrTimeout
+		}
+		c.cond.Wait()
+	}
+	wasFull := c.recvWindow() == 0
+	n, _ := c.readBuf.Read(b)
+	if wasFull {
+		c.sendState()
+	}
+	return n, nil
+}
+
+// Write 实现net.Conn，窗口满时阻塞
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	written := 0
+	for len(b) > 0 {
+		if c.err != nil {
+			return written, c.err
+		}
+		if c.state != stateConnected {
+			return written, ErrClosed
+		}
+		if !c.writeDeadline.IsZero() && !time.Now().Before(c.writeDeadline) {
+			return written, ErrTimeout
+		}
+		size := len(b)
+		if size > maxPayload {
+			size = maxPayload
+		}
+		window := c.cc.window
+		if c.peerWnd < window {
+			window = c.peerWnd
+		}
+		if len(c.inflight) > 0 && c.curWindow+size > window {
+			c.cond.Wait()
+			continue
+		}
+		c.sendPacket(stData, append([]byte(nil), b[:size]...), c.sendID)
+		b = b[size:]
+		written += size
+	}
+	return written, nil
+}
+
+// Close 发送FIN后立即返回，后台继续重传直到FIN被确认
+func (c *Conn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	defer c.cond.Broadcast()
+	switch c.state {
+	case stateConnected:
+		c.finSeq = c.seqNr
+		c.sendPacket(stFin, nil, c.sendID)
+		c.state = stateFinSent
+		if c.err == nil {
+			c.err = ErrClosed
+		}
+	case stateFinSent, stateClosed:
+	default:
+		c.teardown(ErrClosed)
+	}
+	return nil
+}
+
+func (c *Conn) Err() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.state == stateClosed {
+		return c.err
+	}
+	return nil
+}
+
+func (c *Conn) abort(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.fail(err)
+	c.cond.Broadcast()
+}
+
+// fail 异常断开，Read、Write返回err
+func (c *Conn) fail(err error) {
+	c.teardown(err)
+	select {
+	case <-c.connected:
+	default:
+		close(c.connected)
+	}
+}
+
+func (c *Conn) teardown(err error) {
+	if c.state == stateClosed {
+		return
+	}
+	c.state = stateClosed
+	if c.err == nil || err != nil {
+		c.err = err
+	}
+	if c.err == nil {
+		c.err = ErrClosed
+	}
+	close(c.done)
+	if c.deadlineTimer != nil {
+		c.deadlineTimer.Stop()
+	}
+	c.socket.remove(c)
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.socket.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.resetDeadlineTimer()
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.readDeadline = t
+	c.resetDeadlineTimer()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.writeDeadline = t
+	c.resetDeadlineTimer()
+	return nil
+}
+
+// 到期时唤醒阻塞的Read、Write
+func (c *Conn) resetDeadlineTimer() {
+	if c.deadlineTimer != nil {
+		c.deadlineTimer.Stop()
+	}
+	next := c.readDeadline
+	if next.IsZero() || (!c.writeDeadline.IsZero() && c.writeDeadline.Before(next)) {
+		next = c.writeDeadline
+	}
+	if next.IsZero() {
+		return
+	}
+	c.deadlineTimer = time.AfterFunc(time.Until(next), func() {
+		c.mutex.Lock()
+		c.cond.Broadcast()
+		c.mutex.Unlock()
+	})
+}
@@ -0,0 +1,131 @@
+package utp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// lossyConn 每n个包丢一个，用于测试重传
+type lossyConn struct {
+	net.PacketConn
+	n     int64
+	count int64
+}
+
+func (l *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if atomic.AddInt64(&l.count, 1)%l.n == 0 {
+		return len(b), nil
+	}
+	return l.PacketConn.WriteTo(b, addr)
+}
+
+func transfer(t *testing.T, server *Socket, client *Socket, size int) {
+	data := make([]byte, size)
+	rand.Read(data)
+
+	done := make(chan []byte, 1)
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			t.Error(err)
+			done <- nil
+			return
+		}
+		defer conn.Close()
+		got, err := io.ReadAll(conn)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- got
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	conn, err := client.DialContext(ctx, "utp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second * 20))
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	select {
+	case got := <-done:
+		if !bytes.Equal(got, data) {
+			t.Fatalf("data mismatch, got %v bytes want %v", len(got), len(data))
+		}
+	case <-time.After(time.Second * 20):
+		t.Fatal("transfer timeout")
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	server, err := Listen("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := Listen("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	transfer(t, server, client, 512*1024)
+}
+
+func listenLossy(t *testing.T, n int64) *Socket {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSocket(&lossyConn{PacketConn: conn, n: n})
+	s.listening = true
+	go s.readLoop(conn)
+	return s
+}
+
+func TestTransferLossy(t *testing.T) {
+	server := listenLossy(t, 7)
+	defer server.Close()
+	client := listenLossy(t, 5)
+	defer client.Close()
+	transfer(t, server, client, 128*1024)
+}
+
+func TestDialRefused(t *testing.T) {
+	client, err := Listen("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// 对方只发包不接受连接，会回复RESET
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	shared := NewSocket(peer)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := peer.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			shared.HandlePacket(buf[:n], addr)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	if _, err := client.DialContext(ctx, "utp", peer.LocalAddr().String()); err != ErrReset {
+		t.Fatalf("err=%v", err)
+	}
+}
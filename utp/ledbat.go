@@ -0,0 +1,139 @@
+package utp
+
+import "time"
+
+// LEDBAT拥塞控制：以单向延迟为信号，延迟低于目标时增大窗口，高于目标时缩小，
+// 让uTP在链路拥塞时主动让出带宽
+
+const (
+	ccontrolTarget     = 100000 // 目标排队延迟，微秒
+	maxCwndIncrease    = 3000   // 每个rtt窗口最多增加的字节数
+	minWindow          = maxPayload
+	maxWindow          = 1024 * 1024
+	baseDelayHistory   = 2 // 保留最近2分钟的最小延迟
+	baseDelayInterval  = time.Minute
+	minRTO             = 500 * time.Millisecond
+	initialRTO         = time.Second
+	maxRTO             = 16 * time.Second
+	initialWindowBytes = 2 * maxPayload
+)
+
+type ledbat struct {
+	window int // max_window，允许在途的字节数
+	// 每分钟的最小延迟，baseDelay取其最小值
+	baseDelays  []uint32
+	baseStarted time.Time
+	rtt         time.Duration
+	rttVar      time.Duration
+	rto         time.Duration
+}
+
+func newLedbat() *ledbat {
+	return &ledbat{
+		window: initialWindowBytes,
+		rto:    initialRTO,
+	}
+}
+
+func (l *ledbat) baseDelay() uint32 {
+	base := l.baseDelays[0]
+	for _, d := range l.baseDelays[1:] {
+		if d < base {
+			base = d
+		}
+	}
+	return base
+}
+
+func (l *ledbat) updateBaseDelay(delay uint32) {
+	now := time.Now()
+	if len(l.baseDelays) == 0 || now.Sub(l.baseStarted) > baseDelayInterval {
+		l.baseDelays = append(l.baseDelays, delay)
+		if len(l.baseDelays) > baseDelayHistory {
+			l.baseDelays = l.baseDelays[1:]
+		}
+		l.baseStarted = now
+		return
+	}
+	last := len(l.baseDelays) - 1
+	if delay < l.baseDelays[last] {
+		l.baseDelays[last] = delay
+	}
+}
+
+// onAck 收到确认后按延迟调整窗口，delay为对方回带的timestamp_difference
+func (l *ledbat) onAck(bytesAcked int, delay uint32) {
+	if bytesAcked <= 0 {
+		return
+	}
+	l.resetRTO()
+	if delay != 0 {
+		l.updateBaseDelay(delay)
+	}
+	ourDelay := 0
+	if delay != 0 {
+		ourDelay = int(delay - l.baseDelay())
+	}
+	offTarget := float64(ccontrolTarget-ourDelay) / ccontrolTarget
+	windowFactor := float64(bytesAcked) / float64(maxInt(l.window, bytesAcked))
+	l.window += int(maxCwndIncrease * offTarget * windowFactor)
+	l.clamp()
+}
+
+// onLoss 快速重传时窗口减半
+func (l *ledbat) onLoss() {
+	l.window /= 2
+	l.clamp()
+}
+
+// onTimeout 超时后窗口降到一个包，超时时间加倍
+func (l *ledbat) onTimeout() {
+	l.window = minWindow
+	l.rto *= 2
+	if l.rto > maxRTO {
+		l.rto = maxRTO
+	}
+}
+
+// onRTT 按bep-029更新rtt和超时时间
+func (l *ledbat) onRTT(sample time.Duration) {
+	if l.rtt == 0 {
+		l.rtt = sample
+		l.rttVar = sample / 2
+	} else {
+		delta := l.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		l.rttVar += (delta - l.rttVar) / 4
+		l.rtt += (sample - l.rtt) / 8
+	}
+	l.resetRTO()
+}
+
+// resetRTO 超时退避后，收到新的确认时恢复按rtt计算的超时时间
+func (l *ledbat) resetRTO() {
+	if l.rtt == 0 {
+		return
+	}
+	l.rto = l.rtt + 4*l.rttVar
+	if l.rto < minRTO {
+		l.rto = minRTO
+	}
+}
+
+func (l *ledbat) clamp() {
+	if l.window < minWindow {
+		l.window = minWindow
+	}
+	if l.window > maxWindow {
+		l.window = maxWindow
+	}
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
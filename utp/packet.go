@@ -0,0 +1,117 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// uTP协议 http://www.bittorrent.org/beps/bep_0029.html
+// 包头20字节：
+// 0       4       8               16              24              32
+// +-------+-------+---------------+---------------+---------------+
+// | type  | ver   | extension     | connection_id                 |
+// +-------+-------+---------------+---------------+---------------+
+// | timestamp_microseconds                                        |
+// +---------------+---------------+---------------+---------------+
+// | timestamp_difference_microseconds                             |
+// +---------------+---------------+---------------+---------------+
+// | wnd_size                                                      |
+// +---------------+---------------+---------------+---------------+
+// | seq_nr                        | ack_nr                        |
+// +---------------+---------------+---------------+---------------+
+
+const (
+	stData  = 0
+	stFin   = 1
+	stState = 2
+	stReset = 3
+	stSyn   = 4
+
+	version    = 1
+	headerSize = 20
+	extSack    = 1
+	// 负载上限，保证整个udp包不超过常见MTU
+	maxPayload = 1400 - headerSize
+)
+
+var ErrBadPacket = errors.New("bad utp packet")
+
+type header struct {
+	typ       uint8
+	connID    uint16
+	timestamp uint32
+	timeDiff  uint32
+	wndSize   uint32
+	seqNr     uint16
+	ackNr     uint16
+	// selective ack位图，第i位表示ack_nr+2+i已收到
+	sack []byte
+}
+
+// IsPacket 根据第一个字节判断是否uTP包。KRPC包是bencode字典，首字节为'd'
+func IsPacket(b []byte) bool {
+	return len(b) >= headerSize && b[0]&0x0f == version && b[0]>>4 <= stSyn
+}
+
+func (h *header) marshal(payload []byte) []byte {
+	size := headerSize + len(payload)
+	if len(h.sack) > 0 {
+		size += 2 + len(h.sack)
+	}
+	b := make([]byte, size)
+	b[0] = h.typ<<4 | version
+	binary.BigEndian.PutUint16(b[2:], h.connID)
+	binary.BigEndian.PutUint32(b[4:], h.timestamp)
+	binary.BigEndian.PutUint32(b[8:], h.timeDiff)
+	binary.BigEndian.PutUint32(b[12:], h.wndSize)
+	binary.BigEndian.PutUint16(b[16:], h.seqNr)
+	binary.BigEndian.PutUint16(b[18:], h.ackNr)
+	n := headerSize
+	if len(h.sack) > 0 {
+		b[1] = extSack
+		b[n] = 0
+		b[n+1] = byte(len(h.sack))
+		n += 2 + copy(b[n+2:], h.sack)
+	}
+	copy(b[n:], payload)
+	return b
+}
+
+func unmarshal(b []byte) (*header, []byte, error) {
+	if !IsPacket(b) {
+		return nil, nil, ErrBadPacket
+	}
+	h := &header{
+		typ:       b[0] >> 4,
+		connID:    binary.BigEndian.Uint16(b[2:]),
+		timestamp: binary.BigEndian.Uint32(b[4:]),
+		timeDiff:  binary.BigEndian.Uint32(b[8:]),
+		wndSize:   binary.BigEndian.Uint32(b[12:]),
+		seqNr:     binary.BigEndian.Uint16(b[16:]),
+		ackNr:     binary.BigEndian.Uint16(b[18:]),
+	}
+	ext := b[1]
+	n := headerSize
+	for ext != 0 {
+		if len(b) < n+2 || len(b) < n+2+int(b[n+1]) {
+			return nil, nil, ErrBadPacket
+		}
+		next, size := b[n], int(b[n+1])
+		if ext == extSack {
+			h.sack = b[n+2 : n+2+size]
+		}
+		ext = next
+		n += 2 + size
+	}
+	return h, b[n:], nil
+}
+
+func nowMicros() uint32 {
+	return uint32(time.Now().UnixNano() / 1000)
+}
+
+// 序号回绕后的比较
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
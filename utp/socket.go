@@ -0,0 +1,206 @@
+package utp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+)
+
+var (
+	ErrClosed  = errors.New("utp: socket closed")
+	ErrRefused = errors.New("utp: connection refused")
+	ErrReset   = errors.New("utp: connection reset")
+	ErrTimeout = &timeoutError{}
+)
+
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "utp: i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+type connKey struct {
+	addr string
+	id   uint16 // 收包的connection_id
+}
+
+// Socket 在一个udp socket上复用多个uTP连接。
+// NewSocket创建的Socket只负责发包，收到的包由socket的持有者(如dht.Client)按首字节分流后交给HandlePacket
+type Socket struct {
+	conn      net.PacketConn
+	mutex     sync.Mutex
+	conns     map[connKey]*Conn
+	listening bool
+	accept    chan *Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewSocket(conn net.PacketConn) *Socket {
+	return &Socket{
+		conn:   conn,
+		conns:  make(map[connKey]*Conn),
+		accept: make(chan *Conn, 16),
+		closed: make(chan struct{}),
+	}
+}
+
+// Listen 独占一个udp端口，接受连接并自己收包
+func Listen(network, address string) (*Socket, error) {
+	addr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	s := NewSocket(conn)
+	s.listening = true
+	go s.readLoop(conn)
+	return s, nil
+}
+
+func (s *Socket) readLoop(conn *net.UDPConn) {
+	buffer := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+				continue
+			}
+		}
+		s.HandlePacket(buffer[:n], addr)
+	}
+}
+
+// HandlePacket 处理一个收到的uTP包，不会长时间阻塞
+func (s *Socket) HandlePacket(b []byte, addr *net.UDPAddr) {
+	h, payload, err := unmarshal(b)
+	if err != nil {
+		return
+	}
+	key := connKey{addr: addr.String(), id: h.connID}
+	if h.typ == stSyn {
+		key.id = h.connID + 1
+	}
+	s.mutex.Lock()
+	c := s.conns[key]
+	if c == nil && h.typ == stSyn && s.listening {
+		c = newConn(s, addr, h.connID+1, h.connID)
+		select {
+		case s.accept <- c:
+			s.conns[key] = c
+		default:
+			c = nil
+		}
+	}
+	s.mutex.Unlock()
+	if c == nil {
+		if h.typ != stReset {
+			s.sendReset(h, addr)
+		}
+		return
+	}
+	c.handle(h, append([]byte(nil), payload...))
+}
+
+func (s *Socket) sendReset(h *header, addr *net.UDPAddr) {
+	reset := &header{
+		typ:       stReset,
+		connID:    h.connID,
+		timestamp: nowMicros(),
+		seqNr:     randomSeq(),
+		ackNr:     h.seqNr,
+	}
+	s.conn.WriteTo(reset.marshal(nil), addr)
+}
+
+// DialContext 建立uTP连接，network参数会被忽略，方便作为tcp的替代dialer
+func (s *Socket) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	var recvID uint16
+	for {
+		recvID = randomSeq()
+		if s.conns[connKey{addr.String(), recvID}] == nil {
+			break
+		}
+	}
+	c := newConn(s, addr, recvID, recvID+1)
+	s.conns[connKey{addr.String(), recvID}] = c
+	s.mutex.Unlock()
+	c.connect()
+	select {
+	case <-c.connected:
+		if c.Err() != nil {
+			return nil, c.Err()
+		}
+		return c, nil
+	case <-ctx.Done():
+		c.abort(ctx.Err())
+		return nil, ctx.Err()
+	}
+}
+
+// Accept 实现net.Listener，只有Listen创建的Socket才会接受连接
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-s.closed:
+		return nil, ErrClosed
+	}
+}
+
+func (s *Socket) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *Socket) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.mutex.Lock()
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mutex.Unlock()
+		for _, c := range conns {
+			c.abort(ErrClosed)
+		}
+		if s.listening {
+			s.conn.Close()
+		}
+	})
+	return nil
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := connKey{c.raddr.String(), c.recvID}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+func (s *Socket) write(b []byte, addr *net.UDPAddr) error {
+	_, err := s.conn.WriteTo(b, addr)
+	return err
+}
+
+func randomSeq() uint16 {
+	var buf [2]byte
+	rand.Read(buf[:])
+	return binary.BigEndian.Uint16(buf[:])
+}
@@ -0,0 +1,295 @@
+package watchlist
+
+import (
+	"bufio"
+	"encoding/hex"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zeromicro/go-zero/core/logx"
+	"github.com/zxw/ciligo/logging"
+)
+
+var logger = logging.Get("watchlist")
+
+// 关注列表：dht定期查找关注的infohash，这里记录每次查到的peer数和不同ip数，
+// 在swarm出现、超过阈值、消失时发出事件
+
+const (
+	EventAppeared = "appeared" // 从没有peer到有peer
+	EventGrew     = "grew"     // peer数达到阈值
+	EventDied     = "died"     // 连续几次查不到peer
+)
+
+// Watcher dht.Client实现了它
+type Watcher interface {
+	Watch(infoHash string) error
+	Unwatch(infoHash string)
+}
+
+type Config struct {
+	GrowThreshold int // peer数达到这个值时发出grew，降到一半以下后可以再次发出
+	DeadAfter     int // 连续这么多次查不到peer认为swarm消失
+	MaxSamples    int // 每个infohash保留的历史记录数
+	MaxIPs        int // 每个infohash最多记录的不同ip数
+}
+
+func DefaultConfig() Config {
+	return Config{
+		GrowThreshold: 50,
+		DeadAfter:     2,
+		MaxSamples:    96, // 15分钟一次，保留一天
+		MaxIPs:        10000,
+	}
+}
+
+type Event struct {
+	Type     string    `json:"type"`
+	InfoHash string    `json:"infohash"` // hex
+	Label    string    `json:"label,omitempty"`
+	Peers    int       `json:"peers"`
+	Time     time.Time `json:"time"`
+}
+
+// Sample 一次查找的结果
+type Sample struct {
+	Time  time.Time `json:"time"`
+	Peers int       `json:"peers"`
+	IPs   int       `json:"ips"` // 这次查到的不同ip数
+}
+
+// Item 一个关注的infohash
+type Item struct {
+	InfoHash  string    `json:"infohash"` // hex
+	Label     string    `json:"label,omitempty"`
+	Added     time.Time `json:"added"`
+	Alive     bool      `json:"alive"`
+	Peers     int       `json:"peers"` // 最近一次查到的peer数
+	MaxPeers  int       `json:"max_peers"`
+	UniqueIPs int       `json:"unique_ips"` // 累计见过的不同ip数
+	Samples   []Sample  `json:"samples"`
+	ips       map[string]bool
+	empty     int // 连续查不到peer的次数
+	grown     bool
+}
+
+type Watchlist struct {
+	mutex   sync.RWMutex
+	conf    Config
+	watcher Watcher
+	items   map[string]*Item // 20字节infohash
+	// 事件回调，类型为func(*Event)
+	event atomic.Value
+	// 不为空时Add、Remove之后把列表写回这个文件
+	file      string
+	fileMutex sync.Mutex
+}
+
+func New(conf Config, watcher Watcher) *Watchlist {
+	return &Watchlist{
+		conf:    conf,
+		watcher: watcher,
+		items:   make(map[string]*Item),
+	}
+}
+
+// OnEvent 设置事件回调，在dht的查找协程中调用，不能阻塞
+func (w *Watchlist) OnEvent(fn func(*Event)) {
+	w.event.Store(fn)
+}
+
+// Persist 之后Add、Remove的修改写回path，一般在LoadFile之后调用，需在开始修改之前调用
+func (w *Watchlist) Persist(path string) {
+	w.file = path
+}
+
+// Add 关注20字节的infoHash，已关注的只更新label
+func (w *Watchlist) Add(infoHash string, label string) error {
+	if err := w.watcher.Watch(infoHash); err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	if item := w.items[infoHash]; item != nil {
+		item.Label = label
+	} else {
+		w.items[infoHash] = &Item{
+			InfoHash: hex.EncodeToString([]byte(infoHash)),
+			Label:    label,
+			Added:    time.Now(),
+			ips:      make(map[string]bool),
+		}
+	}
+	w.mutex.Unlock()
+	return w.save()
+}
+
+func (w *Watchlist) Remove(infoHash string) error {
+	w.watcher.Unwatch(infoHash)
+	w.mutex.Lock()
+	delete(w.items, infoHash)
+	w.mutex.Unlock()
+	return w.save()
+}
+
+func (w *Watchlist) save() error {
+	if w.file == "" {
+		return nil
+	}
+	return w.SaveFile(w.file)
+}
+
+// SaveFile 按LoadFile的格式保存，原文件里的注释不保留
+func (w *Watchlist) SaveFile(path string) error {
+	w.fileMutex.Lock()
+	defer w.fileMutex.Unlock()
+	var buf strings.Builder
+	for _, item := range w.List() {
+		buf.WriteString(item.InfoHash)
+		if item.Label != "" {
+			buf.WriteString(" " + item.Label)
+		}
+		buf.WriteString("\n")
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(buf.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadFile 每行"<40位hex> [label]"，#开头的行是注释
+func (w *Watchlist) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		data, err := hex.DecodeString(fields[0])
+		if err != nil || len(data) != 20 {
+			logger.Infow("skip line", logx.Field("path", path), logx.Field("line", line))
+			continue
+		}
+		label := ""
+		if len(fields) == 2 {
+			label = strings.TrimSpace(fields[1])
+		}
+		if err := w.Add(string(data), label); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Observe 记录一次查找结果并检查是否需要发出事件，没有关注的infohash忽略
+func (w *Watchlist) Observe(infoHash string, peers []*net.UDPAddr, at time.Time) {
+	ips := make(map[string]bool, len(peers))
+	for _, peer := range peers {
+		ips[peer.IP.String()] = true
+	}
+	w.mutex.Lock()
+	item := w.items[infoHash]
+	if item == nil {
+		w.mutex.Unlock()
+		return
+	}
+	item.Peers = len(peers)
+	if item.Peers > item.MaxPeers {
+		item.MaxPeers = item.Peers
+	}
+	for ip := range ips {
+		if len(item.ips) >= w.conf.MaxIPs {
+			break
+		}
+		item.ips[ip] = true
+	}
+	item.UniqueIPs = len(item.ips)
+	item.Samples = append(item.Samples, Sample{Time: at, Peers: item.Peers, IPs: len(ips)})
+	if len(item.Samples) > w.conf.MaxSamples {
+		item.Samples = item.Samples[len(item.Samples)-w.conf.MaxSamples:]
+	}
+	events := w.check(item, at)
+	w.mutex.Unlock()
+	if fn, ok := w.event.Load().(func(*Event)); ok {
+		for _, e := range events {
+			fn(e)
+		}
+	}
+}
+
+func (w *Watchlist) check(item *Item, at time.Time) []*Event {
+	var events []*Event
+	emit := func(typ string) {
+		events = append(events, &Event{Type: typ, InfoHash: item.InfoHash, Label: item.Label, Peers: item.Peers, Time: at})
+	}
+	if item.Peers == 0 {
+		item.empty++
+		if item.Alive && item.empty >= w.conf.DeadAfter {
+			item.Alive = false
+			item.grown = false
+			emit(EventDied)
+		}
+		return events
+	}
+	item.empty = 0
+	if !item.Alive {
+		item.Alive = true
+		emit(EventAppeared)
+	}
+	if !item.grown && w.conf.GrowThreshold > 0 && item.Peers >= w.conf.GrowThreshold {
+		item.grown = true
+		emit(EventGrew)
+	} else if item.grown && item.Peers < w.conf.GrowThreshold/2 {
+		item.grown = false
+	}
+	return events
+}
+
+// Get 按hex格式的infohash查询，返回副本
+func (w *Watchlist) Get(hexHash string) (*Item, bool) {
+	data, err := hex.DecodeString(hexHash)
+	if err != nil || len(data) != 20 {
+		return nil, false
+	}
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	item, ok := w.items[string(data)]
+	if !ok {
+		return nil, false
+	}
+	return item.copy(), true
+}
+
+// List 所有关注的infohash，不带历史记录，按加入时间排序
+func (w *Watchlist) List() []*Item {
+	w.mutex.RLock()
+	items := make([]*Item, 0, len(w.items))
+	for _, item := range w.items {
+		cp := item.copy()
+		cp.Samples = nil
+		items = append(items, cp)
+	}
+	w.mutex.RUnlock()
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Added.Before(items[j].Added)
+	})
+	return items
+}
+
+func (item *Item) copy() *Item {
+	cp := *item
+	cp.ips = nil
+	cp.Samples = append([]Sample(nil), item.Samples...)
+	return &cp
+}
@@ -0,0 +1,121 @@
+package watchlist
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeWatcher map[string]bool
+
+func (f fakeWatcher) Watch(infoHash string) error {
+	f[infoHash] = true
+	return nil
+}
+
+func (f fakeWatcher) Unwatch(infoHash string) {
+	delete(f, infoHash)
+}
+
+func makePeers(n int) []*net.UDPAddr {
+	peers := make([]*net.UDPAddr, 0, n)
+	for i := 0; i < n; i++ {
+		// 每个ip两个端口
+		peers = append(peers, &net.UDPAddr{IP: net.IPv4(10, 0, byte(i/2/256), byte(i/2)), Port: 6881 + i%2})
+	}
+	return peers
+}
+
+func TestEvents(t *testing.T) {
+	watcher := fakeWatcher{}
+	conf := DefaultConfig()
+	conf.GrowThreshold = 10
+	conf.MaxSamples = 4
+	w := New(conf, watcher)
+	var events []string
+	w.OnEvent(func(e *Event) {
+		events = append(events, e.Type)
+	})
+	infoHash := strings.Repeat("\xab", 20)
+	if err := w.Add(infoHash, "release"); err != nil || !watcher[infoHash] {
+		t.Fatal("infohash not watched")
+	}
+	now := time.Now()
+	for i, n := range []int{0, 4, 12, 3, 12, 0, 0, 6} {
+		w.Observe(infoHash, makePeers(n), now.Add(time.Duration(i)*time.Minute))
+	}
+	want := []string{EventAppeared, EventGrew, EventGrew, EventDied, EventAppeared}
+	if strings.Join(events, ",") != strings.Join(want, ",") {
+		t.Fatalf("events = %v, want %v", events, want)
+	}
+	item, ok := w.Get(strings.Repeat("ab", 20))
+	if !ok || !item.Alive || item.Peers != 6 || item.MaxPeers != 12 || item.UniqueIPs != 6 || item.Label != "release" {
+		t.Fatalf("unexpected item %+v", item)
+	}
+	if len(item.Samples) != 4 || item.Samples[3].Peers != 6 || item.Samples[3].IPs != 3 {
+		t.Fatalf("unexpected samples %+v", item.Samples)
+	}
+
+	// 没有关注的infohash忽略
+	w.Observe(strings.Repeat("\x01", 20), makePeers(3), now)
+	if len(w.List()) != 1 {
+		t.Fatal("unwatched infohash recorded")
+	}
+	if err := w.Remove(infoHash); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.List()) != 0 || watcher[infoHash] {
+		t.Fatal("infohash not removed")
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "watch.txt")
+	data := "# our releases\n" + strings.Repeat("01", 20) + " ubuntu iso\nzz\n" + strings.Repeat("02", 20) + "\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	watcher := fakeWatcher{}
+	w := New(DefaultConfig(), watcher)
+	if err := w.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	items := w.List()
+	if len(items) != 2 || len(watcher) != 2 {
+		t.Fatalf("items = %v", len(items))
+	}
+	if item, _ := w.Get(strings.Repeat("01", 20)); item.Label != "ubuntu iso" {
+		t.Fatalf("label = %q", item.Label)
+	}
+}
+
+func TestPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "watch.txt")
+	w := New(DefaultConfig(), fakeWatcher{})
+	w.Persist(path)
+	if err := w.Add(strings.Repeat("\x01", 20), "ubuntu iso"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add(strings.Repeat("\x02", 20), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Remove(strings.Repeat("\x01", 20)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add(strings.Repeat("\x03", 20), "debian"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重启后从文件恢复
+	other := New(DefaultConfig(), fakeWatcher{})
+	if err := other.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	items := other.List()
+	if len(items) != 2 || items[0].InfoHash != strings.Repeat("02", 20) || items[1].Label != "debian" {
+		t.Fatalf("items = %+v %+v", items[0], items[len(items)-1])
+	}
+}
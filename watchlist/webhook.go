@@ -0,0 +1,62 @@
+package watchlist
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/zeromicro/go-zero/core/logx"
+	"github.com/zxw/ciligo/logging"
+)
+
+const webhookQueue = 256
+
+// Webhook 把事件以json POST到url，用于告警。在单独的协程里按顺序发送，不阻塞dht的查找协程
+type Webhook struct {
+	url    string
+	client *http.Client
+	queue  chan *Event
+}
+
+func NewWebhook(url string, timeout time.Duration) *Webhook {
+	return &Webhook{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+		queue:  make(chan *Event, webhookQueue),
+	}
+}
+
+// Send 可以直接作为OnEvent的回调，队列满时丢弃
+func (h *Webhook) Send(e *Event) {
+	select {
+	case h.queue <- e:
+	default:
+		logger.Errorw("webhook queue full", logx.Field("type", e.Type), logx.Field("infohash", e.InfoHash))
+	}
+}
+
+func (h *Webhook) Run() {
+	for e := range h.queue {
+		if err := h.post(e); err != nil {
+			logger.Errorw("webhook failed", logx.Field("url", h.url), logx.Field("type", e.Type), logx.Field("infohash", e.InfoHash), logging.Err(err))
+		}
+	}
+}
+
+func (h *Webhook) post(e *Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Post(h.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New("webhook response " + resp.Status)
+	}
+	return nil
+}
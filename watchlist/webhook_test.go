@@ -0,0 +1,33 @@
+package watchlist
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	received := make(chan Event, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e Event
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil || r.Method != http.MethodPost {
+			t.Errorf("method %v err %v", r.Method, err)
+		}
+		received <- e
+	}))
+	defer server.Close()
+
+	hook := NewWebhook(server.URL, time.Second)
+	go hook.Run()
+	hook.Send(&Event{Type: EventGrew, InfoHash: "abcd", Label: "release", Peers: 60, Time: time.Now()})
+	select {
+	case e := <-received:
+		if e.Type != EventGrew || e.InfoHash != "abcd" || e.Peers != 60 {
+			t.Fatalf("unexpected event %+v", e)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("event not posted")
+	}
+}